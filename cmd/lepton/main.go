@@ -0,0 +1,392 @@
+// Command lepton compresses JPEG files to Lepton format and decompresses them
+// again. The type of the input is detected from its first bytes. The process
+// exits with the numeric lepton.ExitCode of the failure, or 0 on success.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/leijurv/lepton_jpeg_go/lepton"
+)
+
+const usage = `lepton - a JPEG compressor
+
+Usage: lepton [options] [inputfile outputfile]
+       lepton dump [--all] [--json] inputfile
+       lepton info inputfile
+
+Compresses a JPEG file to Lepton format or decompresses a Lepton file back to
+the original JPEG, depending on the type of the input. Without file names the
+input is read from stdin and the output written to stdout. A file name of "-"
+also stands for stdin or stdout.
+
+The dump command prints the structure of a JPEG or Lepton file as the parser
+sees it: tables, components, scans, pad bit and garbage. With --all the
+coefficients of every block are included.
+
+The info command prints a JSON summary of a JPEG or Lepton file, such as its
+dimensions, type, original size and partitions, reading only its header.
+
+Options:
+`
+
+type fileType int
+
+const (
+	fileTypeJpeg fileType = iota
+	fileTypeLepton
+)
+
+// config holds the command line settings
+type config struct {
+	verify    bool
+	overwrite bool
+	quiet     bool
+	input     string
+	output    string
+
+	// overrides are applied to the default options for the type of input,
+	// only for the flags given on the command line
+	overrides []func(*lepton.Options)
+}
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "lepton: %v\n", err)
+		os.Exit(int(exitCode(err)))
+	}
+}
+
+// exitCode returns the ExitCode for err the same way the Rust utility does
+func exitCode(err error) lepton.ExitCode {
+	if lepErr, ok := lepton.IsLeptonError(err); ok {
+		return lepErr.Code
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return lepton.ExitCodeShortRead
+	}
+	return lepton.ExitCodeOsError
+}
+
+func run(args []string) error {
+	if len(args) > 0 && args[0] == "dump" {
+		return runDump(args[1:])
+	}
+	if len(args) > 0 && args[0] == "info" {
+		return runInfo(args[1:])
+	}
+
+	cfg, err := parseArgs(args)
+	if err != nil {
+		return err
+	}
+	if cfg == nil {
+		// help was requested
+		return nil
+	}
+
+	input, err := readInput(cfg.input)
+	if err != nil {
+		return err
+	}
+
+	kind, err := identifyFileType(input)
+	if err != nil {
+		return err
+	}
+
+	var opts *lepton.Options
+	if kind == fileTypeJpeg {
+		opts = lepton.CompatLeptonVectorWrite()
+	} else {
+		// Decode the files that other Lepton implementations decode, some of
+		// which record a larger size than they decode to
+		opts = lepton.CompatLeptonVectorRead()
+		opts.AcceptShortOutput = true
+	}
+	for _, override := range cfg.overrides {
+		override(opts)
+	}
+
+	output, err := process(kind, input, opts, cfg.verify)
+	if err != nil {
+		return err
+	}
+
+	if err := writeOutput(cfg.output, output, cfg.overwrite); err != nil {
+		return err
+	}
+
+	if !cfg.quiet {
+		if kind == fileTypeJpeg {
+			fmt.Fprintf(os.Stderr, "compressed input %d, output %d bytes (compression = %.1f%%)\n",
+				len(input), len(output), (float64(len(input))/float64(len(output))-1)*100)
+		} else {
+			fmt.Fprintf(os.Stderr, "decompressed input %d, output %d bytes\n", len(input), len(output))
+		}
+	}
+	if opts.Metrics != nil {
+		if err := opts.Metrics.WriteText(os.Stderr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseArgs parses the command line. It returns nil if only help was requested.
+func parseArgs(args []string) (*config, error) {
+	cfg := &config{}
+	fs := flag.NewFlagSet("lepton", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	help := fs.Bool("help", false, "print this help message")
+	noVerify := fs.Bool("noverify", false, "do not verify that the output decompresses to the input")
+	fs.BoolVar(&cfg.overwrite, "overwrite", false, "overwrite the output file if it exists")
+	fs.BoolVar(&cfg.quiet, "quiet", false, "suppress all output except errors")
+
+	overrideAtLeast := func(min uint32, name, usage string, set func(*lepton.Options, uint32)) {
+		fs.Func(name, usage, func(s string) error {
+			var v uint32
+			if _, err := fmt.Sscan(s, &v); err != nil {
+				return fmt.Errorf("not a number: %q", s)
+			}
+			if v < min {
+				return fmt.Errorf("must be at least %d", min)
+			}
+			cfg.overrides = append(cfg.overrides, func(o *lepton.Options) { set(o, v) })
+			return nil
+		})
+	}
+	override := func(name, usage string, set func(*lepton.Options, uint32)) {
+		overrideAtLeast(0, name, usage, set)
+	}
+	flagOverride := func(name, usage string, set func(*lepton.Options)) {
+		fs.BoolFunc(name, usage, func(string) error {
+			cfg.overrides = append(cfg.overrides, set)
+			return nil
+		})
+	}
+
+	overrideAtLeast(1, "threads", "maximum number of threads and partitions to use", func(o *lepton.Options, v uint32) {
+		o.MaxProcessorThreads = v
+		o.MaxPartitions = v
+	})
+	override("max-width", "maximum width of the JPEG file", func(o *lepton.Options, v uint32) { o.MaxJpegWidth = v })
+	override("max-height", "maximum height of the JPEG file", func(o *lepton.Options, v uint32) { o.MaxJpegHeight = v })
+	override("max-jpeg-file-size", "maximum size of the JPEG file in bytes", func(o *lepton.Options, v uint32) { o.MaxJpegFileSize = v })
+	flagOverride("allowfourcomponents", "compress CMYK files, which other Lepton implementations cannot read", func(o *lepton.Options) { o.AllowFourComponents = true })
+	flagOverride("allowexplicitzeroruns", "compress files with blocks that end in ZRL symbols, which other Lepton implementations cannot read", func(o *lepton.Options) {
+		o.AllowExplicitZeroRuns = true
+	})
+	flagOverride("allowsamplingbeyondtwo", "compress files with sampling factors of 3 or 4, which other Lepton implementations cannot read", func(o *lepton.Options) {
+		o.AllowSamplingBeyondTwo = true
+	})
+	flagOverride("rejectprogressive", "reject progressive JPEG files", func(o *lepton.Options) { o.Progressive = false })
+	flagOverride("rejectdqtswithzeros", "reject DQT tables with zeros", func(o *lepton.Options) { o.RejectDQTsWithZeros = true })
+	flagOverride("rejectinvalidhuffman", "reject invalid Huffman tables", func(o *lepton.Options) { o.AcceptInvalidDHT = false })
+	flagOverride("rejectshortoutput", "reject Lepton files that decode to fewer bytes than they record", func(o *lepton.Options) { o.AcceptShortOutput = false })
+	flagOverride("use32bitdc", "use 32 bit DC estimate", func(o *lepton.Options) { o.Use16BitDCEstimate = false })
+	flagOverride("use32bitadv", "use 32 bit advanced prediction", func(o *lepton.Options) { o.Use16BitAdvPredict = false })
+	flagOverride("metrics", "print the compressed size of each model component to stderr", func(o *lepton.Options) {
+		o.Metrics = &lepton.Metrics{}
+	})
+	flagOverride("useleptonscalar", "use the math of the scalar C++ encoder", func(o *lepton.Options) {
+		o.Use16BitDCEstimate = false
+		o.Use16BitAdvPredict = false
+	})
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			printUsage(fs)
+			return nil, nil
+		}
+		return nil, lepton.ErrExitCode(lepton.ExitCodeSyntaxError, err.Error())
+	}
+	if *help {
+		printUsage(fs)
+		return nil, nil
+	}
+	cfg.verify = !*noVerify
+
+	switch fs.NArg() {
+	case 0:
+		cfg.input, cfg.output = "-", "-"
+		if isTerminal(os.Stdin) || isTerminal(os.Stdout) {
+			return nil, lepton.ErrExitCode(lepton.ExitCodeSyntaxError,
+				"source and destination filename are needed or input needs to be redirected")
+		}
+	case 2:
+		cfg.input, cfg.output = fs.Arg(0), fs.Arg(1)
+	default:
+		return nil, lepton.ErrExitCode(lepton.ExitCodeSyntaxError,
+			fmt.Sprintf("expected an input and an output file name, got %d arguments", fs.NArg()))
+	}
+
+	return cfg, nil
+}
+
+func printUsage(fs *flag.FlagSet) {
+	fs.SetOutput(os.Stdout)
+	fmt.Print(usage)
+	fs.PrintDefaults()
+}
+
+// isTerminal reports whether f is a character device such as a console
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// readInput reads the whole input file, or stdin for "-"
+func readInput(name string) ([]byte, error) {
+	if name == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+
+	data, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, lepton.ErrExitCode(lepton.ExitCodeFileNotFound, err.Error())
+	}
+	return data, err
+}
+
+// identifyFileType tells JPEG and Lepton input apart by their magic numbers
+func identifyFileType(data []byte) (fileType, error) {
+	if len(data) < 2 {
+		return 0, lepton.ErrExitCode(lepton.ExitCodeBadLeptonFile, "input file too small")
+	}
+
+	switch {
+	case data[0] == 0xFF && data[1] == lepton.MarkerSOI:
+		return fileTypeJpeg, nil
+	case data[0] == lepton.LeptonFileHeader[0] && data[1] == lepton.LeptonFileHeader[1]:
+		return fileTypeLepton, nil
+	default:
+		return 0, lepton.ErrExitCode(lepton.ExitCodeBadLeptonFile, "input file is not a valid JPEG or Lepton file")
+	}
+}
+
+// process compresses or decompresses input. Compressed output is decoded again
+// and compared with the input unless verify is false.
+func process(kind fileType, input []byte, opts *lepton.Options, verify bool) ([]byte, error) {
+	if kind == fileTypeLepton {
+		var output bytes.Buffer
+		if err := lepton.DecodeWithOptions(bytes.NewReader(input), &output, opts); err != nil {
+			return nil, err
+		}
+		return output.Bytes(), nil
+	}
+
+	if verify {
+		return lepton.EncodeVerifyWithOptions(input, opts)
+	}
+
+	var output bytes.Buffer
+	if err := lepton.EncodeWithOptions(bytes.NewReader(input), &output, opts); err != nil {
+		return nil, err
+	}
+	return output.Bytes(), nil
+}
+
+// writeOutput writes data to the output file, or stdout for "-". An existing
+// file is only replaced if overwrite is set.
+func writeOutput(name string, data []byte, overwrite bool) error {
+	if name == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if overwrite {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	file, err := os.OpenFile(name, flags, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// runDump prints the structure of the input file
+func runDump(args []string) error {
+	fs := flag.NewFlagSet("lepton dump", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	all := fs.Bool("all", false, "include the coefficients of every block")
+	asJSON := fs.Bool("json", false, "print JSON instead of text")
+	if err := fs.Parse(args); err != nil {
+		return lepton.ErrExitCode(lepton.ExitCodeSyntaxError, err.Error())
+	}
+	if fs.NArg() != 1 {
+		return lepton.ErrExitCode(lepton.ExitCodeSyntaxError, "dump needs exactly one input file name")
+	}
+
+	input, err := readInput(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	kind, err := identifyFileType(input)
+	if err != nil {
+		return err
+	}
+
+	var dump *lepton.Dump
+	if kind == fileTypeJpeg {
+		dump, err = lepton.DumpJpeg(input, *all, nil)
+	} else {
+		dump, err = lepton.DumpLepton(input, *all, nil)
+	}
+
+	// A partial dump is printed before the error, that is what it is for
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if encodeErr := encoder.Encode(dump); encodeErr != nil {
+			return encodeErr
+		}
+	} else if writeErr := dump.WriteText(os.Stdout); writeErr != nil {
+		return writeErr
+	}
+
+	return err
+}
+
+// runInfo prints a summary of the header of the input file
+func runInfo(args []string) error {
+	fs := flag.NewFlagSet("lepton info", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		return lepton.ErrExitCode(lepton.ExitCodeSyntaxError, err.Error())
+	}
+	if fs.NArg() != 1 {
+		return lepton.ErrExitCode(lepton.ExitCodeSyntaxError, "info needs exactly one input file name")
+	}
+
+	var info *lepton.Info
+	var err error
+	if name := fs.Arg(0); name == "-" {
+		info, err = lepton.ReadInfo(os.Stdin)
+	} else {
+		info, err = lepton.Stat(name)
+		if errors.Is(err, os.ErrNotExist) {
+			return lepton.ErrExitCode(lepton.ExitCodeFileNotFound, err.Error())
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(info)
+}
@@ -0,0 +1,267 @@
+package lepton
+
+import "fmt"
+
+// Sizes of the statistics areas of the arithmetic coder, as laid out by libjpeg
+const (
+	arithDCStatBins = 64
+	arithACStatBins = 256
+
+	// arithFixedState is the state of the estimator with a fixed probability
+	// of one half, used for sign and refinement bits
+	arithFixedState = 113
+)
+
+// arithState is an entry of the probability estimation state machine of
+// ITU T.81 table D.2
+type arithState struct {
+	qe        uint16 // LPS probability estimate
+	nextMPS   uint8  // next state after coding the MPS
+	nextLPS   uint8  // next state after coding the LPS
+	switchMPS bool   // the MPS sense flips after coding the LPS
+}
+
+// arithStates is table D.2 of ITU T.81 with the extra state 113 of libjpeg,
+// which keeps a fixed probability of one half
+var arithStates = [114]arithState{
+	{0x5a1d, 1, 1, true},      // 0
+	{0x2586, 2, 14, false},    // 1
+	{0x1114, 3, 16, false},    // 2
+	{0x080b, 4, 18, false},    // 3
+	{0x03d8, 5, 20, false},    // 4
+	{0x01da, 6, 23, false},    // 5
+	{0x00e5, 7, 25, false},    // 6
+	{0x006f, 8, 28, false},    // 7
+	{0x0036, 9, 30, false},    // 8
+	{0x001a, 10, 33, false},   // 9
+	{0x000d, 11, 35, false},   // 10
+	{0x0006, 12, 9, false},    // 11
+	{0x0003, 13, 10, false},   // 12
+	{0x0001, 13, 12, false},   // 13
+	{0x5a7f, 15, 15, true},    // 14
+	{0x3f25, 16, 36, false},   // 15
+	{0x2cf2, 17, 38, false},   // 16
+	{0x207c, 18, 39, false},   // 17
+	{0x17b9, 19, 40, false},   // 18
+	{0x1182, 20, 42, false},   // 19
+	{0x0cef, 21, 43, false},   // 20
+	{0x09a1, 22, 45, false},   // 21
+	{0x072f, 23, 46, false},   // 22
+	{0x055c, 24, 48, false},   // 23
+	{0x0406, 25, 49, false},   // 24
+	{0x0303, 26, 51, false},   // 25
+	{0x0240, 27, 52, false},   // 26
+	{0x01b1, 28, 54, false},   // 27
+	{0x0144, 29, 56, false},   // 28
+	{0x00f5, 30, 57, false},   // 29
+	{0x00b7, 31, 59, false},   // 30
+	{0x008a, 32, 60, false},   // 31
+	{0x0068, 33, 62, false},   // 32
+	{0x004e, 34, 63, false},   // 33
+	{0x003b, 35, 32, false},   // 34
+	{0x002c, 9, 33, false},    // 35
+	{0x5ae1, 37, 37, true},    // 36
+	{0x484c, 38, 64, false},   // 37
+	{0x3a0d, 39, 65, false},   // 38
+	{0x2ef1, 40, 67, false},   // 39
+	{0x261f, 41, 68, false},   // 40
+	{0x1f33, 42, 69, false},   // 41
+	{0x19a8, 43, 70, false},   // 42
+	{0x1518, 44, 72, false},   // 43
+	{0x1177, 45, 73, false},   // 44
+	{0x0e74, 46, 74, false},   // 45
+	{0x0bfb, 47, 75, false},   // 46
+	{0x09f8, 48, 77, false},   // 47
+	{0x0861, 49, 78, false},   // 48
+	{0x0706, 50, 79, false},   // 49
+	{0x05cd, 51, 48, false},   // 50
+	{0x04de, 52, 50, false},   // 51
+	{0x040f, 53, 50, false},   // 52
+	{0x0363, 54, 51, false},   // 53
+	{0x02d4, 55, 52, false},   // 54
+	{0x025c, 56, 53, false},   // 55
+	{0x01f8, 57, 54, false},   // 56
+	{0x01a4, 58, 55, false},   // 57
+	{0x0160, 59, 56, false},   // 58
+	{0x0125, 60, 57, false},   // 59
+	{0x00f6, 61, 58, false},   // 60
+	{0x00cb, 62, 59, false},   // 61
+	{0x00ab, 63, 61, false},   // 62
+	{0x008f, 32, 61, false},   // 63
+	{0x5b12, 65, 65, true},    // 64
+	{0x4d04, 66, 80, false},   // 65
+	{0x412c, 67, 81, false},   // 66
+	{0x37d8, 68, 82, false},   // 67
+	{0x2fe8, 69, 83, false},   // 68
+	{0x293c, 70, 84, false},   // 69
+	{0x2379, 71, 86, false},   // 70
+	{0x1edf, 72, 87, false},   // 71
+	{0x1aa9, 73, 87, false},   // 72
+	{0x174e, 74, 72, false},   // 73
+	{0x1424, 75, 72, false},   // 74
+	{0x119c, 76, 74, false},   // 75
+	{0x0f6b, 77, 74, false},   // 76
+	{0x0d51, 78, 75, false},   // 77
+	{0x0bb6, 79, 77, false},   // 78
+	{0x0a40, 48, 77, false},   // 79
+	{0x5832, 81, 80, true},    // 80
+	{0x4d1c, 82, 88, false},   // 81
+	{0x438e, 83, 89, false},   // 82
+	{0x3bdd, 84, 90, false},   // 83
+	{0x34ee, 85, 91, false},   // 84
+	{0x2eae, 86, 92, false},   // 85
+	{0x299a, 87, 93, false},   // 86
+	{0x2516, 71, 86, false},   // 87
+	{0x5570, 89, 88, true},    // 88
+	{0x4ca9, 90, 95, false},   // 89
+	{0x44d9, 91, 96, false},   // 90
+	{0x3e22, 92, 97, false},   // 91
+	{0x3824, 93, 99, false},   // 92
+	{0x32b4, 94, 99, false},   // 93
+	{0x2e17, 86, 93, false},   // 94
+	{0x56a8, 96, 95, true},    // 95
+	{0x4f46, 97, 101, false},  // 96
+	{0x47e5, 98, 102, false},  // 97
+	{0x41cf, 99, 103, false},  // 98
+	{0x3c3d, 100, 104, false}, // 99
+	{0x375e, 93, 99, false},   // 100
+	{0x5231, 102, 105, false}, // 101
+	{0x4c0f, 103, 106, false}, // 102
+	{0x4639, 104, 107, false}, // 103
+	{0x415e, 99, 103, false},  // 104
+	{0x5627, 106, 105, true},  // 105
+	{0x50e7, 107, 108, false}, // 106
+	{0x4b85, 103, 109, false}, // 107
+	{0x5597, 109, 110, false}, // 108
+	{0x504f, 107, 111, false}, // 109
+	{0x5a10, 111, 110, true},  // 110
+	{0x5522, 109, 112, false}, // 111
+	{0x59eb, 111, 112, true},  // 112
+	{0x5a1d, 113, 113, false}, // 113
+}
+
+// arithmeticStatistics holds the adaptive state of an arithmetic coded scan.
+// Each statistics bin is an index into arithStates with the MPS sense in the
+// top bit.
+type arithmeticStatistics struct {
+	dc        [4][arithDCStatBins]uint8
+	ac        [4][arithACStatBins]uint8
+	fixed     uint8
+	lastDC    [MaxComponents]int16
+	dcContext [MaxComponents]int
+}
+
+// reset clears the statistics at the start of a scan or restart interval.
+// DC statistics belong to scans that code the first bits of the DC
+// coefficient and AC statistics to scans that code AC coefficients, every
+// other scan keeps them.
+func (s *arithmeticStatistics) reset(header *JpegHeader) {
+	if header.CsFrom == 0 && header.CsSah == 0 {
+		s.dc = [4][arithDCStatBins]uint8{}
+		s.lastDC = [MaxComponents]int16{}
+		s.dcContext = [MaxComponents]int{}
+	}
+	if header.CsTo != 0 {
+		s.ac = [4][arithACStatBins]uint8{}
+	}
+	s.fixed = arithFixedState
+}
+
+// updateDCContext picks the conditioning category of the next DC difference
+// from the magnitude category m of the last one (ITU T.81 F.1.4.4.1.2)
+func (s *arithmeticStatistics) updateDCContext(header *JpegHeader, cmp, tbl, m int, negative bool) {
+	sign := 0
+	if negative {
+		sign = 1
+	}
+	switch {
+	case m < (1<<header.ArithDCL[tbl])>>1:
+		s.dcContext[cmp] = 0
+	case m > (1<<header.ArithDCU[tbl])>>1:
+		s.dcContext[cmp] = 12 + sign*4
+	default:
+		s.dcContext[cmp] = 4 + sign*4
+	}
+}
+
+// acMagnitudeBin returns the first statistics bin of the magnitude category of
+// an AC coefficient at zigzag position k that is at least 2
+func acMagnitudeBin(header *JpegHeader, tbl, k int) int {
+	if k <= int(header.ArithACK[tbl]) {
+		return 189
+	}
+	return 217
+}
+
+// checkArithmeticScan validates the parameters of an arithmetic coded scan,
+// which are used as is to index the statistics
+func checkArithmeticScan(header *JpegHeader) error {
+	for _, cmp := range header.ScanComponentOrder {
+		if header.CmpInfo[cmp].HuffDC >= 4 || header.CmpInfo[cmp].HuffAC >= 4 {
+			return NewLeptonError(ExitCodeUnsupportedJpeg, "arithmetic conditioning table index too big")
+		}
+	}
+
+	if header.JpegType == JpegTypeSequential {
+		if header.CsFrom != 0 || header.CsTo != 63 || header.CsSah != 0 || header.CsSal != 0 {
+			return NewLeptonError(ExitCodeUnsupportedJpeg, "sequential scan must cover all coefficients")
+		}
+		return nil
+	}
+
+	if header.CsSal > 13 || (header.CsSah != 0 && header.CsSah != header.CsSal+1) {
+		return NewLeptonError(ExitCodeUnsupportedJpeg,
+			fmt.Sprintf("invalid successive approximation %d to %d", header.CsSah, header.CsSal))
+	}
+	if header.CsFrom == 0 {
+		if header.CsTo != 0 {
+			return NewLeptonError(ExitCodeUnsupportedJpeg, "progressive DC scan cannot contain AC coefficients")
+		}
+		return nil
+	}
+	if header.CsTo >= 64 || header.CsFrom > header.CsTo {
+		return NewLeptonError(ExitCodeUnsupportedJpeg,
+			fmt.Sprintf("progressive encoding range was invalid %d to %d", header.CsFrom, header.CsTo))
+	}
+	if len(header.ScanComponentOrder) != 1 {
+		return NewLeptonError(ExitCodeUnsupportedJpeg, "progressive AC encoding cannot be interleaved")
+	}
+	return nil
+}
+
+// parseDAC parses a Define Arithmetic Conditioning segment
+func parseDAC(header *JpegHeader, data []byte) error {
+	if len(data)%2 != 0 {
+		return NewLeptonError(ExitCodeUnsupportedJpeg, "DAC segment has odd length")
+	}
+
+	for pos := 0; pos < len(data); pos += 2 {
+		class := data[pos] >> 4
+		index := data[pos] & 0x0F
+		value := data[pos+1]
+
+		if index >= 4 {
+			return NewLeptonError(ExitCodeUnsupportedJpeg, "arithmetic conditioning table index too big")
+		}
+
+		switch class {
+		case 0:
+			lower, upper := value&0x0F, value>>4
+			if lower > upper {
+				return NewLeptonError(ExitCodeUnsupportedJpeg,
+					fmt.Sprintf("invalid DC conditioning bounds %d to %d", lower, upper))
+			}
+			header.ArithDCL[index] = lower
+			header.ArithDCU[index] = upper
+		case 1:
+			if value < 1 || value > 63 {
+				return NewLeptonError(ExitCodeUnsupportedJpeg, fmt.Sprintf("invalid AC conditioning %d", value))
+			}
+			header.ArithACK[index] = value
+		default:
+			return NewLeptonError(ExitCodeUnsupportedJpeg, fmt.Sprintf("invalid DAC table class %d", class))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,421 @@
+package lepton
+
+import (
+	"bufio"
+	"fmt"
+)
+
+// arithmeticDecoder decodes the bits of an arithmetic coded JPEG scan (ITU
+// T.81 annex D), the way libjpeg does
+type arithmeticDecoder struct {
+	reader *bufio.Reader
+	c      int64 // base of the coding interval and input bit buffer
+	a      int64 // size of the coding interval
+	ct     int   // bits left in the input bit buffer, negative while starting
+
+	atMarker bool  // a marker or the end of the file was reached, zeros are fed from here on
+	eof      bool  // the file ended within the scan
+	position int64 // bytes taken from reader since the start of the scan
+}
+
+// newArithmeticDecoder creates a decoder for the scan data that follows in reader
+func newArithmeticDecoder(reader *bufio.Reader) *arithmeticDecoder {
+	d := &arithmeticDecoder{reader: reader}
+	d.start()
+	return d
+}
+
+// start resets the decoder for a new scan or restart interval
+func (d *arithmeticDecoder) start() {
+	d.c = 0
+	d.a = 0
+	d.ct = -16 // read two bytes before the first decision
+	d.atMarker = false
+}
+
+// readByte returns the next byte of coded data. Once a marker or the end of
+// the file is reached it is left unread and zeros are returned instead.
+func (d *arithmeticDecoder) readByte() int64 {
+	if d.atMarker {
+		return 0
+	}
+
+	b, _ := d.reader.Peek(2)
+	switch {
+	case len(b) == 0 || (b[0] == 0xFF && len(b) == 1):
+		d.atMarker = true
+		d.eof = true
+		return 0
+	case b[0] != 0xFF:
+		d.reader.Discard(1)
+		d.position++
+		return int64(b[0])
+	case b[1] == 0x00:
+		// Stuffed zero byte
+		d.reader.Discard(2)
+		d.position += 2
+		return 0xFF
+	default:
+		d.atMarker = true
+		return 0
+	}
+}
+
+// skipToMarker discards the coded data up to the next marker. The encoder
+// may write a byte or two more than the decoder needs to read.
+func (d *arithmeticDecoder) skipToMarker() {
+	for !d.atMarker {
+		d.readByte()
+	}
+}
+
+// readRestartMarker consumes the RST marker with index idx at the end of a
+// restart interval. It returns false if the file ends first.
+func (d *arithmeticDecoder) readRestartMarker(idx int) (bool, error) {
+	d.skipToMarker()
+	if d.eof {
+		return false, nil
+	}
+
+	b, _ := d.reader.Peek(2)
+	expectedRst := MarkerRST0 + byte(idx&7)
+	if b[1] != expectedRst {
+		return false, NewLeptonError(ExitCodeInvalidResetCode,
+			fmt.Sprintf("invalid reset code %02x %02x found in stream (expected ff %02x)", b[0], b[1], expectedRst))
+	}
+	d.reader.Discard(2)
+	d.position += 2
+
+	d.start()
+	return true, nil
+}
+
+// decode decodes a bit with the statistics bin st (ITU T.81 D.2)
+func (d *arithmeticDecoder) decode(st *uint8) int {
+	// Renormalization and data input
+	for d.a < 0x8000 {
+		d.ct--
+		if d.ct < 0 {
+			d.c = d.c<<8 | d.readByte()
+			d.ct += 8
+			if d.ct < 0 {
+				// Still reading the first two bytes
+				d.ct++
+				if d.ct == 0 {
+					d.a = 0x8000 // becomes 0x10000 below
+				}
+			}
+		}
+		d.a <<= 1
+	}
+
+	sv := *st
+	state := &arithStates[sv&0x7F]
+	qe := int64(state.qe)
+	mps := int(sv >> 7)
+
+	// Decoding and probability estimation
+	d.a -= qe
+	temp := d.a << d.ct
+	if d.c >= temp {
+		d.c -= temp
+		// Conditional exchange of the LPS and MPS
+		if d.a < qe {
+			d.a = qe
+			*st = nextArithState(sv, state, false)
+			return mps
+		}
+		d.a = qe
+		*st = nextArithState(sv, state, true)
+		return mps ^ 1
+	}
+	if d.a < 0x8000 {
+		if d.a < qe {
+			*st = nextArithState(sv, state, true)
+			return mps ^ 1
+		}
+		*st = nextArithState(sv, state, false)
+	}
+	return mps
+}
+
+// nextArithState returns the statistics bin after coding the LPS or the MPS
+// in the bin sv
+func nextArithState(sv uint8, state *arithState, lps bool) uint8 {
+	if !lps {
+		return sv&0x80 | state.nextMPS
+	}
+	if state.switchMPS {
+		return (sv&0x80 ^ 0x80) | state.nextLPS
+	}
+	return sv&0x80 | state.nextLPS
+}
+
+// errArithmeticCorrupt is returned for coded values that do not fit a coefficient
+var errArithmeticCorrupt = NewLeptonError(ExitCodeUnsupportedJpeg, "corrupt arithmetic coded data")
+
+// decodeMagnitude decodes the magnitude of a nonzero value (ITU T.81 F.23 and
+// F.24). Its category is known to be at least m, which is 1 or 2, and continues
+// in the bins from st on. The magnitude bits are coded in the bins 14 further.
+// It returns the magnitude and its category.
+func (d *arithmeticDecoder) decodeMagnitude(stats []uint8, st, m int) (int, int, error) {
+	for d.decode(&stats[st]) != 0 {
+		m <<= 1
+		if m == 0x8000 {
+			return 0, 0, errArithmeticCorrupt
+		}
+		st++
+	}
+
+	v := m
+	for bit := m >> 1; bit != 0; bit >>= 1 {
+		if d.decode(&stats[st+14]) != 0 {
+			v |= bit
+		}
+	}
+	return v + 1, m, nil
+}
+
+// decodeBlock decodes the part of block that the current scan codes
+func (d *arithmeticDecoder) decodeBlock(stats *arithmeticStatistics, header *JpegHeader, cmp int, block *AlignedBlock) error {
+	if header.CsFrom == 0 {
+		if header.CsSah != 0 {
+			d.decodeDCRefine(stats, header, block)
+			return nil
+		}
+		if err := d.decodeDCFirst(stats, header, cmp, block); err != nil {
+			return err
+		}
+		if header.CsTo == 0 {
+			return nil
+		}
+		// A sequential scan goes on with the AC coefficients
+		return d.decodeACFirst(stats, header, cmp, block, 1)
+	}
+
+	if header.CsSah != 0 {
+		return d.decodeACRefine(stats, header, cmp, block)
+	}
+	return d.decodeACFirst(stats, header, cmp, block, int(header.CsFrom))
+}
+
+// decodeDCFirst decodes the DC difference of a block (ITU T.81 F.19)
+func (d *arithmeticDecoder) decodeDCFirst(stats *arithmeticStatistics, header *JpegHeader, cmp int, block *AlignedBlock) error {
+	tbl := int(header.CmpInfo[cmp].HuffDC)
+	dcStats := stats.dc[tbl][:]
+	s0 := stats.dcContext[cmp]
+
+	if d.decode(&dcStats[s0]) == 0 {
+		stats.dcContext[cmp] = 0
+	} else {
+		sign := d.decode(&dcStats[s0+1])
+		v, m := 1, 0
+		if d.decode(&dcStats[s0+2+sign]) != 0 {
+			var err error
+			if v, m, err = d.decodeMagnitude(dcStats, 20, 1); err != nil {
+				return err
+			}
+		}
+		stats.updateDCContext(header, cmp, tbl, m, sign != 0)
+		if sign != 0 {
+			v = -v
+		}
+		stats.lastDC[cmp] += int16(v)
+	}
+
+	block.SetTransposedFromZigzag(0, stats.lastDC[cmp]<<header.CsSal)
+	return nil
+}
+
+// decodeDCRefine decodes the next bit of the DC coefficient of a block
+func (d *arithmeticDecoder) decodeDCRefine(stats *arithmeticStatistics, header *JpegHeader, block *AlignedBlock) {
+	if d.decode(&stats.fixed) != 0 {
+		block.SetTransposedFromZigzag(0, block.GetTransposedFromZigzag(0)|1<<header.CsSal)
+	}
+}
+
+// decodeACFirst decodes the AC coefficients of a block from zigzag position
+// from to the end of the band (ITU T.81 F.20)
+func (d *arithmeticDecoder) decodeACFirst(stats *arithmeticStatistics, header *JpegHeader, cmp int, block *AlignedBlock, from int) error {
+	tbl := int(header.CmpInfo[cmp].HuffAC)
+	acStats := stats.ac[tbl][:]
+	to := int(header.CsTo)
+
+	for k := from; k <= to; k++ {
+		st := 3 * (k - 1)
+		if d.decode(&acStats[st]) != 0 {
+			// End of block
+			break
+		}
+		for d.decode(&acStats[st+1]) == 0 {
+			st += 3
+			k++
+			if k > to {
+				return errArithmeticCorrupt
+			}
+		}
+
+		sign := d.decode(&stats.fixed)
+		v := 1
+		if d.decode(&acStats[st+2]) != 0 {
+			v = 2
+			if d.decode(&acStats[st+2]) != 0 {
+				var err error
+				if v, _, err = d.decodeMagnitude(acStats, acMagnitudeBin(header, tbl, k), 2); err != nil {
+					return err
+				}
+			}
+		}
+		if sign != 0 {
+			v = -v
+		}
+		block.SetTransposedFromZigzag(k, int16(v<<header.CsSal))
+	}
+
+	return nil
+}
+
+// decodeACRefine decodes the next bit of the AC coefficients in the band of a
+// block (ITU T.81 G.1.3.3)
+func (d *arithmeticDecoder) decodeACRefine(stats *arithmeticStatistics, header *JpegHeader, cmp int, block *AlignedBlock) error {
+	acStats := stats.ac[header.CmpInfo[cmp].HuffAC][:]
+	from, to := int(header.CsFrom), int(header.CsTo)
+	p1 := int16(1) << header.CsSal
+	m1 := int16(-1) << header.CsSal
+
+	// The end of block of the previous stage
+	kex := to
+	for ; kex > 0; kex-- {
+		if block.GetTransposedFromZigzag(kex) != 0 {
+			break
+		}
+	}
+
+	for k := from; k <= to; k++ {
+		st := 3 * (k - 1)
+		if k > kex && d.decode(&acStats[st]) != 0 {
+			// End of block
+			break
+		}
+		for {
+			coef := block.GetTransposedFromZigzag(k)
+			if coef != 0 {
+				// Correction bit of a coefficient that is already nonzero
+				if d.decode(&acStats[st+2]) != 0 {
+					if coef < 0 {
+						block.SetTransposedFromZigzag(k, coef+m1)
+					} else {
+						block.SetTransposedFromZigzag(k, coef+p1)
+					}
+				}
+				break
+			}
+			if d.decode(&acStats[st+1]) != 0 {
+				// Newly nonzero coefficient
+				if d.decode(&stats.fixed) != 0 {
+					block.SetTransposedFromZigzag(k, m1)
+				} else {
+					block.SetTransposedFromZigzag(k, p1)
+				}
+				break
+			}
+			st += 3
+			k++
+			if k > to {
+				return errArithmeticCorrupt
+			}
+		}
+	}
+
+	return nil
+}
+
+// readArithmeticScans reads the scans of an arithmetic coded JPEG, starting
+// with the one whose SOS segment was just parsed. Sequential images can
+// consist of several scans as well.
+func readArithmeticScans(reader *bufio.Reader, header *JpegHeader, result *JpegReadResult, opts *Options) error {
+	for firstScan := true; ; firstScan = false {
+		recordScanProgress(header, result)
+		if err := readArithmeticScan(reader, header, result, firstScan); err != nil {
+			return err
+		}
+		if result.EarlyEOF {
+			return truncateProgressiveScans(header, result, opts)
+		}
+
+		moreScans, err := readNextScanHeader(reader, header, result, opts)
+		if err != nil || !moreScans {
+			return err
+		}
+	}
+}
+
+// readArithmeticScan reads the coded data of the current scan. The first scan
+// records a partition at the start of every MCU row.
+func readArithmeticScan(reader *bufio.Reader, header *JpegHeader, result *JpegReadResult, firstScan bool) error {
+	if err := checkArithmeticScan(header); err != nil {
+		return err
+	}
+
+	decoder := newArithmeticDecoder(reader)
+	stats := &arithmeticStatistics{}
+	stats.reset(header)
+	state := NewJpegPositionState(header, 0)
+	doHandoff := firstScan
+	restartIdx := 0
+	sta := DecodeInProgress
+
+	for sta != ScanCompleted {
+		state.ResetRstw(header)
+
+		for sta == DecodeInProgress {
+			if doHandoff {
+				mcuY := state.GetMcu() / header.Mcuh
+				lumaMul := header.CmpInfo[0].Bcv / header.Mcuv
+
+				result.Partitions = append(result.Partitions, JpegPartition{
+					Position:   decoder.position,
+					LastDC:     stats.lastDC,
+					LumaYStart: lumaMul * mcuY,
+					LumaYEnd:   lumaMul * (mcuY + 1),
+				})
+				doHandoff = false
+			}
+
+			cmp := state.GetCmp()
+			block := result.ImageData[cmp].EnsureBlock(state.GetDpos())
+			if err := decoder.decodeBlock(stats, header, cmp, block); err != nil {
+				return err
+			}
+
+			oldMcu := state.GetMcu()
+			sta = state.NextMcuPos(header)
+
+			if firstScan && state.GetMcu()%header.Mcuh == 0 && oldMcu != state.GetMcu() {
+				doHandoff = true
+			}
+		}
+
+		if sta == RestartIntervalExpired {
+			found, err := decoder.readRestartMarker(restartIdx)
+			if err != nil {
+				return err
+			}
+			if !found {
+				break
+			}
+			restartIdx++
+			stats.reset(header)
+			sta = DecodeInProgress
+		}
+	}
+
+	// A truncated scan is decoded to its end from zeros, the way libjpeg does.
+	// The encoder verifies that the same data comes out again.
+	decoder.skipToMarker()
+	result.EarlyEOF = decoder.eof
+	if firstScan {
+		result.EndScanPosition = decoder.position
+	}
+	return nil
+}
@@ -0,0 +1,429 @@
+package lepton
+
+// arithmeticEncoder encodes the bits of an arithmetic coded JPEG scan (ITU
+// T.81 annex D) into the same bytes as libjpeg, including the way it
+// terminates each restart interval
+type arithmeticEncoder struct {
+	c      int64 // base of the coding interval
+	a      int64 // size of the coding interval
+	sc     int64 // 0xFF bytes held back because a carry may still change them
+	zc     int64 // 0x00 bytes held back because they are dropped at the end
+	ct     int   // bits until the next byte is ready
+	buffer int   // last byte before the held back ones, -1 if none
+
+	data []byte
+}
+
+// newArithmeticEncoder creates an encoder for a new scan
+func newArithmeticEncoder() *arithmeticEncoder {
+	e := &arithmeticEncoder{}
+	e.start()
+	return e
+}
+
+// start resets the encoder for a new scan or restart interval
+func (e *arithmeticEncoder) start() {
+	e.c = 0
+	e.a = 0x10000
+	e.sc = 0
+	e.zc = 0
+	e.ct = 11
+	e.buffer = -1
+}
+
+// emit appends a byte of coded data, stuffing a zero byte after 0xFF
+func (e *arithmeticEncoder) emit(b int) {
+	e.data = append(e.data, byte(b))
+	if b == 0xFF {
+		e.data = append(e.data, 0x00)
+	}
+}
+
+// emitZeros writes the held back 0x00 bytes
+func (e *arithmeticEncoder) emitZeros() {
+	for ; e.zc > 0; e.zc-- {
+		e.data = append(e.data, 0x00)
+	}
+}
+
+// carry adds a carry to the buffered byte. The held back 0xFF bytes become
+// 0x00 bytes that are held back in turn.
+func (e *arithmeticEncoder) carry() {
+	if e.buffer >= 0 {
+		e.emitZeros()
+		e.emit(e.buffer + 1)
+	}
+	e.zc += e.sc
+	e.sc = 0
+}
+
+// flushBuffer writes the buffered byte and the held back 0xFF bytes, which
+// can no longer be changed by a carry
+func (e *arithmeticEncoder) flushBuffer() {
+	if e.buffer == 0 {
+		e.zc++
+	} else if e.buffer >= 0 {
+		e.emitZeros()
+		e.emit(e.buffer)
+	}
+	if e.sc > 0 {
+		e.emitZeros()
+		for ; e.sc > 0; e.sc-- {
+			e.emit(0xFF)
+		}
+	}
+}
+
+// encode encodes bit with the statistics bin st (ITU T.81 D.1)
+func (e *arithmeticEncoder) encode(st *uint8, bit int) {
+	sv := *st
+	state := &arithStates[sv&0x7F]
+	qe := int64(state.qe)
+
+	// Encoding and probability estimation
+	e.a -= qe
+	if bit != int(sv>>7) {
+		// The LPS, unless the interval of the MPS is the smaller one
+		if e.a >= qe {
+			e.c += e.a
+			e.a = qe
+		}
+		*st = nextArithState(sv, state, true)
+	} else {
+		if e.a >= 0x8000 {
+			return
+		}
+		if e.a < qe {
+			e.c += e.a
+			e.a = qe
+		}
+		*st = nextArithState(sv, state, false)
+	}
+
+	// Renormalization and data output
+	for {
+		e.a <<= 1
+		e.c <<= 1
+		e.ct--
+		if e.ct == 0 {
+			// Another byte is ready
+			temp := int(e.c >> 19)
+			if temp > 0xFF {
+				e.carry()
+				e.buffer = temp & 0xFF
+			} else if temp == 0xFF {
+				e.sc++
+			} else {
+				e.flushBuffer()
+				e.buffer = temp
+			}
+			e.c &= 0x7FFFF
+			e.ct += 8
+		}
+		if e.a >= 0x8000 {
+			break
+		}
+	}
+}
+
+// finish terminates the coded data of a scan or restart interval (ITU T.81
+// D.1.8), leaving out trailing zero bytes like libjpeg
+func (e *arithmeticEncoder) finish() {
+	// Pick the value in the coding interval with the most trailing zero bits
+	temp := (e.a - 1 + e.c) &^ 0xFFFF
+	if temp < e.c {
+		e.c = temp + 0x8000
+	} else {
+		e.c = temp
+	}
+
+	// Send the remaining bytes
+	e.c <<= e.ct
+	if e.c&0xF8000000 != 0 {
+		e.carry()
+	} else {
+		e.flushBuffer()
+	}
+
+	// Output the final bytes only if they are not zero
+	if e.c&0x7FFF800 != 0 {
+		e.emitZeros()
+		e.emit(int(e.c>>19) & 0xFF)
+		if e.c&0x7F800 != 0 {
+			e.emit(int(e.c>>11) & 0xFF)
+		}
+	}
+}
+
+// encodeMagnitude encodes the magnitude v of a nonzero value whose category
+// has been coded up to m, which is 1 or 2, and continues in the bins from st
+// on. It is the counterpart of arithmeticDecoder.decodeMagnitude and returns
+// the category.
+func (e *arithmeticEncoder) encodeMagnitude(stats []uint8, st, m, v int) int {
+	v--
+	for v >= m<<1 {
+		e.encode(&stats[st], 1)
+		m <<= 1
+		st++
+	}
+	e.encode(&stats[st], 0)
+
+	for bit := m >> 1; bit != 0; bit >>= 1 {
+		e.encode(&stats[st+14], boolToBit(v&bit != 0))
+	}
+	return m
+}
+
+// boolToBit returns 1 for true and 0 for false
+func boolToBit(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// encodeBlock encodes the part of block that the current scan codes
+func (e *arithmeticEncoder) encodeBlock(stats *arithmeticStatistics, header *JpegHeader, cmp int, block *AlignedBlock) {
+	if header.CsFrom == 0 {
+		if header.CsSah != 0 {
+			// The next bit of the DC coefficient
+			e.encode(&stats.fixed, int(block.GetTransposedFromZigzag(0)>>header.CsSal)&1)
+			return
+		}
+		e.encodeDCFirst(stats, header, cmp, block)
+		if header.CsTo != 0 {
+			// A sequential scan goes on with the AC coefficients
+			e.encodeACFirst(stats, header, cmp, block, 1)
+		}
+		return
+	}
+
+	if header.CsSah != 0 {
+		e.encodeACRefine(stats, header, cmp, block)
+		return
+	}
+	e.encodeACFirst(stats, header, cmp, block, int(header.CsFrom))
+}
+
+// encodeDCFirst encodes the DC difference of a block (ITU T.81 F.4)
+func (e *arithmeticEncoder) encodeDCFirst(stats *arithmeticStatistics, header *JpegHeader, cmp int, block *AlignedBlock) {
+	tbl := int(header.CmpInfo[cmp].HuffDC)
+	dcStats := stats.dc[tbl][:]
+	s0 := stats.dcContext[cmp]
+
+	dc := block.GetTransposedFromZigzag(0) >> header.CsSal
+	v := int(dc) - int(stats.lastDC[cmp])
+	stats.lastDC[cmp] = dc
+	if v == 0 {
+		e.encode(&dcStats[s0], 0)
+		stats.dcContext[cmp] = 0
+		return
+	}
+
+	e.encode(&dcStats[s0], 1)
+	sign := boolToBit(v < 0)
+	e.encode(&dcStats[s0+1], sign)
+	if v < 0 {
+		v = -v
+	}
+
+	m := 0
+	if v > 1 {
+		e.encode(&dcStats[s0+2+sign], 1)
+		m = e.encodeMagnitude(dcStats, 20, 1, v)
+	} else {
+		e.encode(&dcStats[s0+2+sign], 0)
+	}
+	stats.updateDCContext(header, cmp, tbl, m, sign != 0)
+}
+
+// acMagnitude returns the magnitude of the AC coefficient at zigzag position k
+// of block after the point transform of the scan, and whether it is negative
+func acMagnitude(block *AlignedBlock, k int, al uint8) (int, bool) {
+	v := int(block.GetTransposedFromZigzag(k))
+	if v < 0 {
+		return -v >> al, true
+	}
+	return v >> al, false
+}
+
+// encodeACFirst encodes the AC coefficients of a block from zigzag position
+// from to the end of the band (ITU T.81 F.5)
+func (e *arithmeticEncoder) encodeACFirst(stats *arithmeticStatistics, header *JpegHeader, cmp int, block *AlignedBlock, from int) {
+	tbl := int(header.CmpInfo[cmp].HuffAC)
+	acStats := stats.ac[tbl][:]
+	to := int(header.CsTo)
+
+	// The end of block
+	end := to
+	for ; end > 0; end-- {
+		if v, _ := acMagnitude(block, end, header.CsSal); v != 0 {
+			break
+		}
+	}
+
+	k := from
+	for ; k <= end; k++ {
+		st := 3 * (k - 1)
+		e.encode(&acStats[st], 0)
+
+		v, negative := acMagnitude(block, k, header.CsSal)
+		for v == 0 {
+			e.encode(&acStats[st+1], 0)
+			st += 3
+			k++
+			v, negative = acMagnitude(block, k, header.CsSal)
+		}
+		e.encode(&acStats[st+1], 1)
+		e.encode(&stats.fixed, boolToBit(negative))
+
+		if v > 1 {
+			e.encode(&acStats[st+2], 1)
+			if v > 2 {
+				e.encode(&acStats[st+2], 1)
+				e.encodeMagnitude(acStats, acMagnitudeBin(header, tbl, k), 2, v)
+			} else {
+				e.encode(&acStats[st+2], 0)
+			}
+		} else {
+			e.encode(&acStats[st+2], 0)
+		}
+	}
+
+	if k <= to {
+		e.encode(&acStats[3*(k-1)], 1)
+	}
+}
+
+// encodeACRefine encodes the next bit of the AC coefficients in the band of a
+// block (ITU T.81 G.1.3.3)
+func (e *arithmeticEncoder) encodeACRefine(stats *arithmeticStatistics, header *JpegHeader, cmp int, block *AlignedBlock) {
+	acStats := stats.ac[header.CmpInfo[cmp].HuffAC][:]
+	to := int(header.CsTo)
+
+	// The end of block of this stage and of the previous one
+	end := to
+	for ; end > 0; end-- {
+		if v, _ := acMagnitude(block, end, header.CsSal); v != 0 {
+			break
+		}
+	}
+	previousEnd := end
+	for ; previousEnd > 0; previousEnd-- {
+		if v, _ := acMagnitude(block, previousEnd, header.CsSah); v != 0 {
+			break
+		}
+	}
+
+	k := int(header.CsFrom)
+	for ; k <= end; k++ {
+		st := 3 * (k - 1)
+		if k > previousEnd {
+			e.encode(&acStats[st], 0)
+		}
+		for {
+			v, negative := acMagnitude(block, k, header.CsSal)
+			if v > 1 {
+				// Correction bit of a coefficient that is already nonzero
+				e.encode(&acStats[st+2], v&1)
+				break
+			}
+			if v == 1 {
+				// Newly nonzero coefficient
+				e.encode(&acStats[st+1], 1)
+				e.encode(&stats.fixed, boolToBit(negative))
+				break
+			}
+			e.encode(&acStats[st+1], 0)
+			st += 3
+			k++
+		}
+	}
+
+	if k <= to {
+		e.encode(&acStats[3*(k-1)], 1)
+	}
+}
+
+// writeArithmeticScan regenerates the coded data of the current scan of an
+// arithmetic coded image
+func (w *JpegWriter) writeArithmeticScan(images []*BlockBasedImage) error {
+	jpegHeader := w.header.JpegHeader
+	encoder := newArithmeticEncoder()
+	stats := &arithmeticStatistics{}
+	stats.reset(jpegHeader)
+
+	restartInterval := int(jpegHeader.RestartInterval)
+	unitCount := 0
+	restartMarkerIdx := 0
+
+	// endUnit is called after each MCU, or each block of a non-interleaved
+	// scan, and terminates the restart interval once it is full. No marker
+	// follows the last unit of the scan.
+	endUnit := func(last bool) error {
+		unitCount++
+		if restartInterval == 0 || unitCount < restartInterval || last {
+			return nil
+		}
+
+		encoder.finish()
+		encoder.data = append(encoder.data, 0xFF, MarkerRST0+byte(restartMarkerIdx&7))
+		restartMarkerIdx++
+		if _, err := w.output.Write(encoder.data); err != nil {
+			return err
+		}
+		encoder.data = encoder.data[:0]
+		encoder.start()
+		stats.reset(jpegHeader)
+		unitCount = 0
+		return nil
+	}
+
+	encodeBlockXY := func(cmp int, blockX, blockY uint32) {
+		block := images[cmp].GetBlockXY(blockX, blockY)
+		if block == nil {
+			block = &EmptyBlock
+		}
+		encoder.encodeBlock(stats, jpegHeader, cmp, block)
+	}
+
+	if len(jpegHeader.ScanComponentOrder) == 1 {
+		// A single component scan codes the blocks inside the image in raster order
+		cmp := jpegHeader.ScanComponentOrder[0]
+		ci := &jpegHeader.CmpInfo[cmp]
+		for blockY := uint32(0); blockY < ci.Ncv; blockY++ {
+			if err := w.progress.check(); err != nil {
+				return err
+			}
+			for blockX := uint32(0); blockX < ci.Nch; blockX++ {
+				encodeBlockXY(cmp, blockX, blockY)
+				if err := endUnit(blockY == ci.Ncv-1 && blockX == ci.Nch-1); err != nil {
+					return err
+				}
+			}
+		}
+	} else {
+		for mcuY := uint32(0); mcuY < jpegHeader.Mcuv; mcuY++ {
+			if err := w.progress.check(); err != nil {
+				return err
+			}
+			for mcuX := uint32(0); mcuX < jpegHeader.Mcuh; mcuX++ {
+				for _, cmp := range jpegHeader.ScanComponentOrder {
+					ci := &jpegHeader.CmpInfo[cmp]
+					for v := uint32(0); v < ci.Sfv; v++ {
+						for h := uint32(0); h < ci.Sfh; h++ {
+							encodeBlockXY(cmp, mcuX*ci.Sfh+h, mcuY*ci.Sfv+v)
+						}
+					}
+				}
+				if err := endUnit(mcuY == jpegHeader.Mcuv-1 && mcuX == jpegHeader.Mcuh-1); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	encoder.finish()
+	_, err := w.output.Write(encoder.data)
+	return err
+}
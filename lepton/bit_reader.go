@@ -8,19 +8,36 @@ import (
 // BitReader reads JPEG Huffman-encoded bitstream, handling 0xFF escape codes
 type BitReader struct {
 	inner       io.Reader
+	byteReader  peekByteReader // set when inner can be read byte by byte without read-ahead
 	bits        uint64
 	bitsLeft    uint32
 	cpos        uint32 // reset counter position
 	eof         bool
+	eofBytes    uint32 // number of zero bytes added to the register past the end of the file
 	truncatedFF bool
 	buffer      []byte
 	bufferPos   int
 	bufferLen   int
 	totalRead   int64
+	lastBytes   [2]byte // the last two bytes read from the stream
+}
+
+// peekByteReader is a reader that can be read byte by byte and peeked, like bufio.Reader
+type peekByteReader interface {
+	io.ByteReader
+	Peek(n int) ([]byte, error)
 }
 
 // NewBitReader creates a new BitReader
+// If reader is a peekByteReader (e.g. a bufio.Reader) it is read byte by byte
+// so that nothing past the consumed bytes is taken from it.
 func NewBitReader(reader io.Reader) *BitReader {
+	if br, ok := reader.(peekByteReader); ok {
+		return &BitReader{
+			inner:      reader,
+			byteReader: br,
+		}
+	}
 	return &BitReader{
 		inner:  reader,
 		buffer: make([]byte, 4096),
@@ -69,6 +86,7 @@ func (r *BitReader) fillRegister(bitsToRead uint32) error {
 			if err == io.EOF {
 				// In case of a truncated file, treat the rest as zeros
 				r.eof = true
+				r.eofBytes++
 				r.bitsLeft += 8
 				r.bits <<= 8
 				continue
@@ -110,6 +128,15 @@ func (r *BitReader) fillRegister(bitsToRead uint32) error {
 
 // readByte reads a single byte from the buffer
 func (r *BitReader) readByte() (byte, error) {
+	if r.byteReader != nil {
+		b, err := r.byteReader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		r.totalRead++
+		r.lastBytes[0], r.lastBytes[1] = r.lastBytes[1], b
+		return b, nil
+	}
 	if r.bufferPos >= r.bufferLen {
 		n, err := r.inner.Read(r.buffer)
 		if n == 0 {
@@ -124,14 +151,82 @@ func (r *BitReader) readByte() (byte, error) {
 	b := r.buffer[r.bufferPos]
 	r.bufferPos++
 	r.totalRead++
+	r.lastBytes[0], r.lastBytes[1] = r.lastBytes[1], b
 	return b, nil
 }
 
+// peekBytes returns up to n upcoming bytes without consuming them.
+// Fewer bytes are returned only at the end of the stream.
+func (r *BitReader) peekBytes(n int) ([]byte, error) {
+	if r.byteReader != nil {
+		b, err := r.byteReader.Peek(n)
+		if err == io.EOF {
+			err = nil
+		}
+		return b, err
+	}
+
+	for r.bufferLen-r.bufferPos < n {
+		copy(r.buffer, r.buffer[r.bufferPos:r.bufferLen])
+		r.bufferLen -= r.bufferPos
+		r.bufferPos = 0
+
+		m, err := r.inner.Read(r.buffer[r.bufferLen:])
+		r.bufferLen += m
+		if err == io.EOF || (err == nil && m == 0) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r.buffer[r.bufferPos:min(r.bufferPos+n, r.bufferLen)], nil
+}
+
+// NextMarker returns the marker code that follows in the stream without
+// consuming it, or 0 if the stream continues with something else. It returns
+// io.EOF if fewer than two bytes are left. Only valid between restart intervals
+// when the bit register is empty.
+func (r *BitReader) NextMarker() (byte, error) {
+	b, err := r.peekBytes(2)
+	if err != nil {
+		return 0, err
+	}
+	if len(b) < 2 {
+		return 0, io.EOF
+	}
+	if b[0] != 0xff || b[1] == 0 {
+		return 0, nil
+	}
+	return b[1], nil
+}
+
+// SkipMarker consumes the marker returned by NextMarker
+func (r *BitReader) SkipMarker() error {
+	for i := 0; i < 2; i++ {
+		if _, err := r.readByte(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // IsEOF returns true if end of file has been reached
 func (r *BitReader) IsEOF() bool {
 	return r.eof
 }
 
+// ConsumedPastEOF returns true once bits beyond the end of a truncated file
+// have been read. IsEOF is already true when the file end was merely peeked at.
+func (r *BitReader) ConsumedPastEOF() bool {
+	return r.eof && r.bitsLeft < 8*r.eofBytes
+}
+
+// LastBytes returns the last two bytes read from the stream
+func (r *BitReader) LastBytes() [2]byte {
+	return r.lastBytes
+}
+
 // RemainingBuffer returns any unconsumed bytes in the internal buffer
 // This should be called after scan completion to get data that was read ahead
 func (r *BitReader) RemainingBuffer() []byte {
@@ -146,7 +241,10 @@ func (r *BitReader) RemainingBuffer() []byte {
 func (r *BitReader) Overhang() (uint8, uint8) {
 	bitsAlreadyRead := uint8((64 - r.bitsLeft) & 7)
 	mask := uint8(((1 << bitsAlreadyRead) - 1) << (8 - bitsAlreadyRead))
-	return bitsAlreadyRead, uint8(r.bits) & mask
+	// The register may hold whole bytes that were read ahead, so the current
+	// byte is not necessarily the lowest one
+	current := uint8(r.bits >> ((r.bitsLeft / 8) * 8))
+	return bitsAlreadyRead, current & mask
 }
 
 // ReadAndVerifyFillBits verifies padding bits at the end of an MCU
@@ -210,13 +308,33 @@ func (r *BitReader) VerifyResetCode() error {
 	return nil
 }
 
-// StreamPosition returns the approximate position in the stream
+// StreamPosition returns the position in the stream of the byte containing
+// the next unread bit, relative to where the reader was created
 func (r *BitReader) StreamPosition() int64 {
-	pos := r.totalRead - int64(r.bufferLen-r.bufferPos)
-	if r.bitsLeft > 0 && !r.eof {
-		// Account for bits we've read but not consumed
-		bytesInBits := int64((r.bitsLeft + 7) / 8)
-		pos -= bytesInBits
+	if r.eof {
+		return r.totalRead
+	}
+	return r.totalRead - r.rawBytesInRegister((r.bitsLeft+7)/8)
+}
+
+// ConsumedPosition returns the position in the stream just past the last byte
+// that has been at least partially read
+func (r *BitReader) ConsumedPosition() int64 {
+	if r.eof {
+		return r.totalRead
+	}
+	return r.totalRead - r.rawBytesInRegister(r.bitsLeft/8)
+}
+
+// rawBytesInRegister returns how many stream bytes the lowest n bytes of the
+// bit register occupied, taking 0xFF 0x00 escapes into account
+func (r *BitReader) rawBytesInRegister(n uint32) int64 {
+	var raw int64
+	for i := uint32(0); i < n; i++ {
+		raw++
+		if uint8(r.bits>>(8*i)) == 0xff && !(i == 0 && r.truncatedFF) {
+			raw++
+		}
 	}
-	return pos
+	return raw
 }
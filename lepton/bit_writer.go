@@ -111,6 +111,16 @@ func (w *BitWriter) DetachBuffer() []byte {
 	return result
 }
 
+// TakeWholeBytes returns the complete bytes written so far and empties the buffer,
+// keeping any partial byte in the register. The returned slice is only valid
+// until the next write.
+func (w *BitWriter) TakeWholeBytes() []byte {
+	w.flushWholeBytes()
+	result := w.dataBuffer
+	w.dataBuffer = w.dataBuffer[:0]
+	return result
+}
+
 // GetBuffer returns the current buffer without detaching
 func (w *BitWriter) GetBuffer() []byte {
 	return w.dataBuffer
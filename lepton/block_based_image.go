@@ -13,16 +13,26 @@ type BlockBasedImage struct {
 
 	// dposOffset stores the starting position for each row
 	dposOffset []uint32
+
+	// windowRows is the number of rows kept when only a sliding window of the
+	// image is stored, or 0 when every row is stored
+	windowRows uint32
 }
 
 // NewBlockBasedImage creates a new BlockBasedImage for a component
 func NewBlockBasedImage(componentInfo *ComponentInfo, luma *ComponentInfo) *BlockBasedImage {
+	img := newBlockBasedImageRows(componentInfo, luma)
+	img.blocks = make([]AlignedBlock, 0, componentInfo.Bc) // Empty slice with capacity
+	return img
+}
+
+// newBlockBasedImageRows creates a BlockBasedImage for a component with the
+// row offsets set up but no storage for blocks
+func newBlockBasedImageRows(componentInfo *ComponentInfo, luma *ComponentInfo) *BlockBasedImage {
 	blockWidth := componentInfo.Bch
 	blockHeight := componentInfo.Bcv
-	totalBlocks := int(componentInfo.Bc)
 
 	img := &BlockBasedImage{
-		blocks:         make([]AlignedBlock, 0, totalBlocks), // Empty slice with capacity
 		blockWidth:     blockWidth,
 		originalHeight: blockHeight,
 		dposOffset:     make([]uint32, blockHeight+1),
@@ -42,6 +52,16 @@ func NewBlockBasedImage(componentInfo *ComponentInfo, luma *ComponentInfo) *Bloc
 	return img
 }
 
+// NewBlockBasedImageWindow creates a BlockBasedImage for a component that only
+// stores the most recent windowRows rows. Rows are still addressed by their
+// position in the full image, and a row overwrites the one windowRows above it.
+func NewBlockBasedImageWindow(componentInfo *ComponentInfo, luma *ComponentInfo, windowRows uint32) *BlockBasedImage {
+	img := newBlockBasedImageRows(componentInfo, luma)
+	img.windowRows = windowRows
+	img.blocks = make([]AlignedBlock, windowRows*img.blockWidth)
+	return img
+}
+
 // NewBlockBasedImageSize creates a BlockBasedImage with specified dimensions
 func NewBlockBasedImageSize(width, height uint32) *BlockBasedImage {
 	totalBlocks := int(width * height)
@@ -70,9 +90,17 @@ func (img *BlockBasedImage) GetOriginalHeight() uint32 {
 	return img.originalHeight
 }
 
+// blockIndex maps a linear index (dpos) to its position in the block storage
+func (img *BlockBasedImage) blockIndex(dpos uint32) uint32 {
+	if img.windowRows == 0 {
+		return dpos
+	}
+	return (dpos/img.blockWidth%img.windowRows)*img.blockWidth + dpos%img.blockWidth
+}
+
 // GetBlockXY returns a pointer to the block at the given position
 func (img *BlockBasedImage) GetBlockXY(blockX, blockY uint32) *AlignedBlock {
-	index := blockY*img.blockWidth + blockX
+	index := img.blockIndex(blockY*img.blockWidth + blockX)
 	if index >= uint32(len(img.blocks)) {
 		return nil
 	}
@@ -83,6 +111,7 @@ func (img *BlockBasedImage) GetBlockXY(blockX, blockY uint32) *AlignedBlock {
 // NOTE: Returns &emptyBlock for non-existent blocks - DO NOT modify the returned block
 // Use EnsureBlock if you need to modify the block
 func (img *BlockBasedImage) GetBlock(dpos uint32) *AlignedBlock {
+	dpos = img.blockIndex(dpos)
 	if dpos >= uint32(len(img.blocks)) {
 		return &emptyBlock
 	}
@@ -92,12 +121,21 @@ func (img *BlockBasedImage) GetBlock(dpos uint32) *AlignedBlock {
 // EnsureBlock ensures the block at dpos exists and returns a pointer to it
 // This creates empty blocks up to dpos if they don't exist
 func (img *BlockBasedImage) EnsureBlock(dpos uint32) *AlignedBlock {
+	dpos = img.blockIndex(dpos)
 	for uint32(len(img.blocks)) <= dpos {
 		img.blocks = append(img.blocks, AlignedBlock{})
 	}
 	return &img.blocks[dpos]
 }
 
+// AllocateAllBlocks sizes the block storage to cover the whole image so that
+// rows can be filled in any order, e.g. by partitions decoded concurrently
+func (img *BlockBasedImage) AllocateAllBlocks() {
+	if total := img.blockWidth * img.originalHeight; total > 0 {
+		img.EnsureBlock(total - 1)
+	}
+}
+
 // GetBlockByIndex returns a pointer to the block at the given linear index
 func (img *BlockBasedImage) GetBlockByIndex(index int) *AlignedBlock {
 	if index < 0 || index >= len(img.blocks) {
@@ -108,7 +146,7 @@ func (img *BlockBasedImage) GetBlockByIndex(index int) *AlignedBlock {
 
 // SetBlock sets the block at the given position
 func (img *BlockBasedImage) SetBlock(blockX, blockY uint32, block AlignedBlock) {
-	index := blockY*img.blockWidth + blockX
+	index := img.blockIndex(blockY*img.blockWidth + blockX)
 	if index < uint32(len(img.blocks)) {
 		img.blocks[index] = block
 	}
@@ -121,6 +159,7 @@ func (img *BlockBasedImage) AppendBlock(block AlignedBlock) {
 
 // SetBlockByDpos sets the block at the given linear index
 func (img *BlockBasedImage) SetBlockByDpos(dpos uint32, block AlignedBlock) {
+	dpos = img.blockIndex(dpos)
 	// Extend if necessary
 	for uint32(len(img.blocks)) <= dpos {
 		img.blocks = append(img.blocks, AlignedBlock{})
@@ -19,7 +19,8 @@ const (
 	ScanCompleted
 )
 
-// ColorChannelNumBlockTypes is the number of color channel block types (Y, Cb, Cr)
+// ColorChannelNumBlockTypes is the number of color channel block types (Y, Cb, Cr).
+// Four component (CMYK) images are only encoded with AllowFourComponents.
 const ColorChannelNumBlockTypes = 3
 
 // RasterToZigzag maps raster order to zigzag order
@@ -120,6 +121,14 @@ var LeptonHeaderEarlyEofMarker = [3]byte{'E', 'E', 'E'}
 // LeptonHeaderPrefixGarbageMarker is the prefix garbage marker
 var LeptonHeaderPrefixGarbageMarker = [3]byte{'P', 'G', 'R'}
 
+// LeptonHeaderZeroRunMarker is the explicit zero run section marker. Only this
+// implementation writes it, with AllowExplicitZeroRuns, before the GRB section.
+// The marker is followed by a uint32 count and count entries of 6 bytes: the
+// component, the uint32 block position and the number of ZRL symbols that end
+// the block, ordered by component and block position. Integers are little
+// endian.
+var LeptonHeaderZeroRunMarker = [3]byte{'Z', 'R', 'L'}
+
 // LeptonHeaderGarbageMarker is the garbage section marker
 var LeptonHeaderGarbageMarker = [3]byte{'G', 'R', 'B'}
 
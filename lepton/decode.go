@@ -2,8 +2,11 @@ package lepton
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"sync"
 )
 
 // limitedWriter wraps a writer and limits output to a maximum size
@@ -11,11 +14,13 @@ type limitedWriter struct {
 	inner     io.Writer
 	remaining int64
 	written   int64
+	discarded int64
 }
 
 func (w *limitedWriter) Write(p []byte) (int, error) {
 	if w.remaining <= 0 {
-		// Silently discard excess data
+		// Discard excess data, checkLength reports it
+		w.discarded += int64(len(p))
 		return len(p), nil
 	}
 	toWrite := p
@@ -28,28 +33,69 @@ func (w *limitedWriter) Write(p []byte) (int, error) {
 	if err != nil {
 		return n, err
 	}
+	w.discarded += int64(len(p) - len(toWrite))
 	// Report full length written (even if truncated)
 	return len(p), nil
 }
 
+// checkLength fails unless the maximum size was written exactly. The scan data
+// of a truncated image is regenerated past the point where the original file
+// ended, so more data is expected then. Less data is accepted with acceptShort.
+func (w *limitedWriter) checkLength(truncated, acceptShort bool) error {
+	if (w.discarded != 0 && !truncated) || (w.remaining != 0 && !acceptShort) {
+		return ErrExitCode(ExitCodeVerificationLengthMismatch,
+			fmt.Sprintf("decoded %d bytes, expected %d", w.written+w.discarded, w.written+w.remaining))
+	}
+	return nil
+}
+
 // DecodeLepton decodes a Lepton file and writes the reconstructed JPEG to output
 func DecodeLepton(input io.Reader, output io.Writer) error {
+	return DecodeWithOptions(input, output, nil)
+}
+
+// DecodeLeptonWithThreads is like DecodeLepton but decodes at most maxThreads
+// partitions concurrently. A value of 0 or less uses runtime.GOMAXPROCS(0).
+func DecodeLeptonWithThreads(input io.Reader, output io.Writer, maxThreads int) error {
+	opts := CompatLeptonVectorRead()
+	opts.MaxProcessorThreads = uint32(max(maxThreads, 0))
+	return DecodeWithOptions(input, output, opts)
+}
+
+// DecodeWithOptions decodes a Lepton file using the given options.
+// A nil opts uses CompatLeptonVectorRead.
+func DecodeWithOptions(input io.Reader, output io.Writer, opts *Options) error {
+	return DecodeContext(context.Background(), input, output, opts)
+}
+
+// DecodeContext is like DecodeWithOptions but stops with the error of ctx once
+// it is cancelled. Cancellation is checked after every row of blocks that is
+// decoded and before every row of MCUs that is written to output.
+func DecodeContext(ctx context.Context, input io.Reader, output io.Writer, opts *Options) (err error) {
+	defer recoverPanic(&err)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if opts == nil {
+		opts = CompatLeptonVectorRead()
+	}
+
 	// Read and parse the Lepton header
-	header, err := ReadLeptonHeader(input)
+	header, err := ReadLeptonHeaderWithOptions(input, opts)
 	if err != nil {
 		return fmt.Errorf("failed to read Lepton header: %w", err)
 	}
 
-	// Create block-based images for each component
-	images := make([]*BlockBasedImage, header.JpegHeader.Cmpc)
-	for i := 0; i < header.JpegHeader.Cmpc; i++ {
-		ci := &header.JpegHeader.CmpInfo[i]
-		luma := &header.JpegHeader.CmpInfo[0]
-		images[i] = NewBlockBasedImage(ci, luma)
+	if err := readCompletionMarker(input); err != nil {
+		return err
 	}
 
-	// For single-threaded decoding, read the completion marker first,
-	// then read all scan data
+	progress := newProgressTracker(ctx, opts.Progress, header.JpegHeader, len(header.ThreadHandoffs))
+	return decodeBuffered(header, input, output, opts, progress)
+}
+
+// readCompletionMarker reads the marker that follows the Lepton header
+func readCompletionMarker(input io.Reader) error {
 	completionMarker := make([]byte, 3)
 	if _, err := io.ReadFull(input, completionMarker); err != nil {
 		return fmt.Errorf("failed to read completion marker: %w", err)
@@ -60,57 +106,163 @@ func DecodeLepton(input io.Reader, output io.Writer) error {
 			fmt.Sprintf("invalid completion marker: %v", completionMarker))
 	}
 
+	return nil
+}
+
+// decodeBuffered reads all the segment data that follows the completion marker,
+// decodes every partition into full images and then writes the JPEG
+func decodeBuffered(header *LeptonHeader, input io.Reader, output io.Writer, opts *Options, progress *progressTracker) error {
+	images, err := decodeImages(header, input, opts, progress)
+	if err != nil {
+		return err
+	}
+
+	// Wrap output with size limiter to match original file size exactly
+	limitedOutput := &limitedWriter{
+		inner:     output,
+		remaining: int64(header.OriginalFileSize),
+	}
+
+	// Reconstruct the JPEG
+	jpegWriter, err := NewJpegWriter(header, limitedOutput)
+	if err != nil {
+		return fmt.Errorf("failed to create JPEG writer: %w", err)
+	}
+	jpegWriter.progress = progress
+
+	if err := jpegWriter.WriteJpeg(images); err != nil {
+		return fmt.Errorf("failed to write JPEG: %w", err)
+	}
+
+	return limitedOutput.checkLength(header.RecoveryInfo.EarlyEofEncountered, opts.AcceptShortOutput)
+}
+
+// checkFooter compares the file size in the footer with the size of the file,
+// made up of the header and segmentSize bytes of segment data
+func (h *LeptonHeader) checkFooter(footer []byte, segmentSize int) error {
+	// 28 (fixed header) + compressed header + 3 (CMP) + segment data + 4 (footer)
+	fileSize := 28 + int64(h.CompressedHeaderSize) + 3 + int64(segmentSize) + leptonFooterSize
+	if recorded := int64(binary.LittleEndian.Uint32(footer)); recorded != fileSize {
+		return ErrExitCode(ExitCodeVerificationLengthMismatch,
+			fmt.Sprintf("file size footer says %d bytes, file has %d", recorded, fileSize))
+	}
+	return nil
+}
+
+// decodeImages reads the partitions that follow the Lepton header and
+// decodes the coefficients of every component. progress may be nil.
+func decodeImages(header *LeptonHeader, input io.Reader, opts *Options, progress *progressTracker) ([]*BlockBasedImage, error) {
+	blocks := uint64(0)
+	for i := 0; i < header.JpegHeader.Cmpc; i++ {
+		blocks += uint64(header.JpegHeader.CmpInfo[i].Bc)
+	}
+	if err := opts.checkBlockMemory(blocks, 0); err != nil {
+		return nil, err
+	}
+
+	// Create block-based images for each component
+	images := make([]*BlockBasedImage, header.JpegHeader.Cmpc)
+	for i := 0; i < header.JpegHeader.Cmpc; i++ {
+		ci := &header.JpegHeader.CmpInfo[i]
+		luma := &header.JpegHeader.CmpInfo[0]
+		images[i] = NewBlockBasedImage(ci, luma)
+	}
+
 	// Read all remaining data (multiplexed segment data + 4-byte footer)
 	remainingData, err := io.ReadAll(input)
 	if err != nil {
-		return fmt.Errorf("failed to read segment data: %w", err)
+		return nil, fmt.Errorf("failed to read segment data: %w", err)
 	}
 
 	// The last 4 bytes are the file size footer
 	if len(remainingData) < 4 {
-		return ErrExitCode(ExitCodeBadLeptonFile, "missing file size footer")
+		return nil, ErrExitCode(ExitCodeBadLeptonFile, "missing file size footer")
 	}
 	multiplexedData := remainingData[:len(remainingData)-4]
+	if err := header.checkFooter(remainingData[len(multiplexedData):], len(multiplexedData)); err != nil {
+		return nil, err
+	}
 
 	// Demultiplex the data for each thread
 	demuxer := newDemultiplexer(multiplexedData, len(header.ThreadHandoffs))
 
-	// Decode scan data for each thread partition
-	for threadIdx := 0; threadIdx < len(header.ThreadHandoffs); threadIdx++ {
-		handoff := &header.ThreadHandoffs[threadIdx]
+	// Partitions write disjoint rows, so allocate all blocks up front
+	for _, img := range images {
+		img.AllocateAllBlocks()
+	}
 
-		// Get the demultiplexed segment data for this thread
-		segmentData := demuxer.getPartitionData(threadIdx)
+	if err := decodePartitions(header, images, demuxer, opts.processorThreads(len(header.ThreadHandoffs)), opts.Metrics, progress); err != nil {
+		return nil, err
+	}
 
-		// Decode the segment
-		segmentReader := bytes.NewReader(segmentData)
-		decoder, err := NewLeptonDecoder(segmentReader, header.JpegHeader)
-		if err != nil {
-			return fmt.Errorf("failed to create decoder for thread %d: %w", threadIdx, err)
-		}
+	return images, nil
+}
+
+// decodePartitions decodes every thread partition into images using a bounded
+// pool of maxThreads goroutines. Each partition has its own model and arithmetic stream.
+// The statistics of all partitions are added to metrics if it is not nil.
+// Decoded rows and partitions are reported to progress.
+func decodePartitions(header *LeptonHeader, images []*BlockBasedImage, demuxer *demultiplexer, maxThreads int, metrics *Metrics, progress *progressTracker) error {
+	numPartitions := len(header.ThreadHandoffs)
+	partitionMetrics := newPartitionMetrics(metrics, numPartitions)
+
+	errs := make([]error, numPartitions)
+	work := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < maxThreads; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for threadIdx := range work {
+				var m *Metrics
+				if partitionMetrics != nil {
+					m = &partitionMetrics[threadIdx]
+				}
+				errs[threadIdx] = decodePartition(header, images, demuxer.getPartitionData(threadIdx), threadIdx, m, progress)
+			}
+		}()
+	}
 
-		err = decoder.DecodeRowRange(images, handoff.LumaYStart, handoff.LumaYEnd, handoff.LastDC,
-			header.RecoveryInfo.MaxDpos, header.RecoveryInfo.EarlyEofEncountered)
+	for threadIdx := 0; threadIdx < numPartitions; threadIdx++ {
+		work <- threadIdx
+	}
+	close(work)
+	wg.Wait()
+
+	// Report the error of the earliest failing partition so results are deterministic
+	for _, err := range errs {
 		if err != nil {
-			return fmt.Errorf("failed to decode thread %d: %w", threadIdx, err)
+			return err
 		}
 	}
+	mergePartitionMetrics(metrics, partitionMetrics)
 
-	// Wrap output with size limiter to match original file size exactly
-	limitedOutput := &limitedWriter{
-		inner:     output,
-		remaining: int64(header.OriginalFileSize),
-	}
+	return nil
+}
 
-	// Reconstruct the JPEG
-	jpegWriter, err := NewJpegWriter(header, limitedOutput)
+// decodePartition decodes the segment data of a single thread partition,
+// recording its statistics in metrics if it is not nil
+func decodePartition(header *LeptonHeader, images []*BlockBasedImage, segmentData []byte, threadIdx int, metrics *Metrics, progress *progressTracker) (err error) {
+	defer recoverPanic(&err)
+	handoff := &header.ThreadHandoffs[threadIdx]
+
+	decoder, err := NewLeptonDecoder(bytes.NewReader(segmentData), header.JpegHeader)
 	if err != nil {
-		return fmt.Errorf("failed to create JPEG writer: %w", err)
+		return fmt.Errorf("failed to create decoder for thread %d: %w", threadIdx, err)
+	}
+	decoder.progress = progress
+	if metrics != nil {
+		defer metrics.startWorker()()
+		decoder.boolReader.metrics = metrics
 	}
 
-	if err := jpegWriter.WriteJpeg(images); err != nil {
-		return fmt.Errorf("failed to write JPEG: %w", err)
+	err = decoder.DecodeRowRange(images, handoff.LumaYStart, handoff.LumaYEnd, handoff.LastDC,
+		header.RecoveryInfo.MaxDpos, header.RecoveryInfo.EarlyEofEncountered)
+	if err != nil {
+		return fmt.Errorf("failed to decode thread %d: %w", threadIdx, err)
 	}
+	progress.partitionDone()
 
 	return nil
 }
@@ -0,0 +1,633 @@
+package lepton
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// leptonFooterSize is the size of the file size footer at the end of a Lepton file
+const leptonFooterSize = 4
+
+// streamQueueLength is the number of demultiplexed blocks that can be queued
+// for the partition being written before reading of the input pauses
+const streamQueueLength = 4
+
+// streamOutputAhead is the number of bytes of JPEG data that a partition decoded
+// ahead of its turn may hold back before it waits for the partitions before it
+const streamOutputAhead = 64 << 10
+
+// errStreamAborted is returned by the goroutines of a streaming decode once
+// one of the others has failed
+var errStreamAborted = errors.New("streaming decode aborted")
+
+// DecodeStreaming decodes a Lepton file like DecodeWithOptions, but writes the
+// JPEG while the input is still being read. Baseline images are reconstructed
+// one MCU row at a time from a sliding window of blocks.
+//
+// The partitions are decoded in order by up to MaxProcessorThreads goroutines.
+// A partition decoded ahead of its turn holds back about 64KB of JPEG data
+// before it waits, so the decoded data stays bounded to a few MCU rows per
+// goroutine plus the model state. Partitions are interleaved in the input, so
+// the input of the partitions that are not being written is held back instead,
+// which is compressed and at most the size of the file. The windows, the held
+// back JPEG data and the held back input all count towards MaxBlockMemory.
+//
+// Progressive, arithmetic coded and truncated images need all coefficients
+// before the scan data can be written and are decoded like DecodeWithOptions.
+// A nil opts uses CompatLeptonVectorRead.
+func DecodeStreaming(input io.Reader, output io.Writer, opts *Options) error {
+	return DecodeStreamingContext(context.Background(), input, output, opts)
+}
+
+// DecodeStreamingContext is like DecodeStreaming but stops with the error of
+// ctx once it is cancelled, see DecodeContext. Reading of the input is not
+// interrupted, only the decoding.
+func DecodeStreamingContext(ctx context.Context, input io.Reader, output io.Writer, opts *Options) (err error) {
+	defer recoverPanic(&err)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if opts == nil {
+		opts = CompatLeptonVectorRead()
+	}
+
+	header, err := ReadLeptonHeaderWithOptions(input, opts)
+	if err != nil {
+		return fmt.Errorf("failed to read Lepton header: %w", err)
+	}
+
+	if err := readCompletionMarker(input); err != nil {
+		return err
+	}
+
+	progress := newProgressTracker(ctx, opts.Progress, header.JpegHeader, len(header.ThreadHandoffs))
+	if header.JpegType == JpegTypeProgressive || header.JpegHeader.Arithmetic || header.RecoveryInfo.EarlyEofEncountered {
+		return decodeBuffered(header, input, output, opts, progress)
+	}
+
+	// Every partition being decoded keeps two MCU rows of blocks, and all but
+	// the one being written may hold back some JPEG data. What the limit leaves
+	// is for the input of the partitions that are not being written.
+	threads := opts.processorThreads(len(header.ThreadHandoffs))
+	windowBlocks := uint64(0)
+	for i := 0; i < header.JpegHeader.Cmpc; i++ {
+		ci := &header.JpegHeader.CmpInfo[i]
+		windowBlocks += 2 * uint64(ci.Sfv) * uint64(ci.Bch)
+	}
+	windowBlocks *= uint64(threads)
+	heldBack := uint64(threads-1) * streamOutputAhead
+	if err := opts.checkBlockMemory(windowBlocks, heldBack); err != nil {
+		return err
+	}
+	inputLimit := int64(-1)
+	if opts.MaxBlockMemory != 0 {
+		inputLimit = int64(opts.MaxBlockMemory - blockMemory(windowBlocks) - heldBack)
+	}
+
+	// Wrap output with size limiter to match original file size exactly
+	limitedOutput := &limitedWriter{
+		inner:     output,
+		remaining: int64(header.OriginalFileSize),
+	}
+
+	jpegWriter, err := NewJpegWriter(header, limitedOutput)
+	if err != nil {
+		return fmt.Errorf("failed to create JPEG writer: %w", err)
+	}
+
+	if err := jpegWriter.writeJpegPrefix(); err != nil {
+		return fmt.Errorf("failed to write JPEG: %w", err)
+	}
+	if err := jpegWriter.writeBaselineHeader(); err != nil {
+		return fmt.Errorf("failed to write JPEG: %w", err)
+	}
+
+	lastSegmentSlack, _, err := decodePartitionsStreaming(header, input, limitedOutput, opts, inputLimit, progress)
+	if err != nil {
+		return err
+	}
+
+	if err := jpegWriter.writeBaselineTrailer(len(header.ThreadHandoffs) > 1, lastSegmentSlack); err != nil {
+		return fmt.Errorf("failed to write JPEG: %w", err)
+	}
+
+	return limitedOutput.checkLength(false, opts.AcceptShortOutput)
+}
+
+// streamStats records the most data that a streaming decode held back at once
+type streamStats struct {
+	peakInput  int64 // demultiplexed input not yet read by its partition
+	peakOutput int64 // JPEG data of partitions waiting for their turn
+}
+
+// decodePartitionsStreaming demultiplexes the segment data from input while the
+// partitions are decoded in order by a bounded pool of goroutines, each writing
+// its JPEG data to output once the partitions before it are written. It returns
+// the slack of the last segment. At most inputLimit bytes of input are held
+// back, unless it is negative. The statistics of all partitions are added to
+// opts.Metrics if it is not nil. Decoded rows and partitions are reported to progress.
+func decodePartitionsStreaming(header *LeptonHeader, input io.Reader, output io.Writer, opts *Options, inputLimit int64, progress *progressTracker) (int, streamStats, error) {
+	numPartitions := len(header.ThreadHandoffs)
+	partitionMetrics := newPartitionMetrics(opts.Metrics, numPartitions)
+
+	queues := newPartitionQueues(numPartitions, inputLimit)
+	out := newPartitionOutput(output, numPartitions, queues)
+
+	var failOnce sync.Once
+	var firstErr error
+	fail := func(err error) {
+		failOnce.Do(func() {
+			firstErr = err
+			queues.abort()
+			out.abort()
+		})
+	}
+
+	// The partitions are taken in order, so the one being written has always
+	// been started
+	work := make(chan int, numPartitions)
+	for threadIdx := 0; threadIdx < numPartitions; threadIdx++ {
+		work <- threadIdx
+	}
+	close(work)
+
+	slack := make([]int, numPartitions)
+	var wg sync.WaitGroup
+	for w := 0; w < opts.processorThreads(numPartitions); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for threadIdx := range work {
+				reader := &partitionReader{queues: queues, partition: threadIdx}
+				var m *Metrics
+				if partitionMetrics != nil {
+					m = &partitionMetrics[threadIdx]
+				}
+				var err error
+				slack[threadIdx], err = decodePartitionStreaming(header, reader, out, threadIdx, m, progress)
+				if err == nil {
+					err = out.finish(threadIdx)
+				}
+				if err == nil {
+					progress.partitionDone()
+				} else {
+					fail(err)
+				}
+
+				// The decoder can stop before it has read all of its data, so
+				// drop the rest to keep it from being held back
+				queues.discard(threadIdx)
+			}
+		}()
+	}
+
+	footer := &footerReader{reader: input}
+	if err := demultiplexStream(footer, queues); err != nil {
+		fail(err)
+	} else if err := header.checkFooter(footer.pending, int(footer.read)); err != nil {
+		fail(err)
+	}
+	wg.Wait()
+
+	stats := streamStats{peakInput: queues.peak, peakOutput: out.peak}
+	if firstErr != nil {
+		return 0, stats, firstErr
+	}
+	mergePartitionMetrics(opts.Metrics, partitionMetrics)
+
+	return slack[numPartitions-1], stats, nil
+}
+
+// decodePartitionStreaming decodes a single thread partition and writes its scan
+// data after each MCU row. It returns the slack of the partition's segment.
+// Statistics are recorded in metrics if it is not nil.
+func decodePartitionStreaming(header *LeptonHeader, reader io.Reader, out *partitionOutput, threadIdx int, metrics *Metrics, progress *progressTracker) (_ int, err error) {
+	defer recoverPanic(&err)
+	handoff := &header.ThreadHandoffs[threadIdx]
+	jpegHeader := header.JpegHeader
+	numPartitions := len(header.ThreadHandoffs)
+
+	// Keep the MCU row being decoded and the one above it for the neighbor context
+	images := make([]*BlockBasedImage, jpegHeader.Cmpc)
+	rowsPerMcu := make([]uint32, jpegHeader.Cmpc)
+	for i := range images {
+		ci := &jpegHeader.CmpInfo[i]
+		rowsPerMcu[i] = ci.Bcv / jpegHeader.Mcuv
+		if rowsPerMcu[i] == 0 {
+			rowsPerMcu[i] = 1
+		}
+		images[i] = NewBlockBasedImageWindow(ci, &jpegHeader.CmpInfo[0], 2*rowsPerMcu[i])
+	}
+
+	decoder, err := NewLeptonDecoder(reader, jpegHeader)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create decoder for thread %d: %w", threadIdx, err)
+	}
+	decoder.progress = progress
+	if metrics != nil {
+		defer metrics.startWorker()()
+		decoder.boolReader.metrics = metrics
+	}
+
+	writer, err := NewJpegWriter(header, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create JPEG writer for thread %d: %w", threadIdx, err)
+	}
+
+	writer.bitWriter.ResetFromOverhang(handoff.OverhangByte, uint32(handoff.NumOverhangBits))
+	writer.unsegmentedScan = numPartitions == 1
+	for i := 0; i < jpegHeader.Cmpc && i < len(handoff.LastDC); i++ {
+		writer.lastDC[i] = handoff.LastDC[i]
+	}
+
+	nonInterleaved := len(jpegHeader.ScanComponentOrder) == 1
+	scanCmp := 0
+	mcuYStart := handoff.LumaYStart / rowsPerMcu[0]
+	if nonInterleaved {
+		scanCmp = jpegHeader.ScanComponentOrder[0]
+		writer.seekRestartInterval(int(mcuYStart * rowsPerMcu[scanCmp] * jpegHeader.CmpInfo[scanCmp].Bch))
+	} else {
+		writer.seekRestartInterval(int(mcuYStart * jpegHeader.Mcuh))
+	}
+
+	// Scan data beyond the segment size is part of the next segment.
+	// Older single partition files may not record the segment size.
+	limit := int64(handoff.SegmentSize)
+	if numPartitions == 1 && handoff.SegmentSize == 0 {
+		limit = -1
+	}
+	generated := 0
+	emit := func(data []byte) error {
+		generated += len(data)
+		if limit >= 0 {
+			if int64(len(data)) > limit {
+				data = data[:limit]
+			}
+			limit -= int64(len(data))
+		}
+		if len(data) == 0 {
+			return nil
+		}
+		return out.write(threadIdx, data)
+	}
+
+	writeMcuRow := func(mcuRow uint32) error {
+		if nonInterleaved {
+			ci := &jpegHeader.CmpInfo[scanCmp]
+			startDpos := mcuRow * rowsPerMcu[scanCmp] * ci.Bch
+			endDpos := startDpos + rowsPerMcu[scanCmp]*ci.Bch
+			if endDpos > ci.Bc {
+				endDpos = ci.Bc
+			}
+			if err := writer.writeScanDposRange(images, scanCmp, startDpos, endDpos); err != nil {
+				return err
+			}
+		} else if mcuRow < jpegHeader.Mcuv {
+			if err := writer.writeScanMcuRange(images, mcuRow, mcuRow+1); err != nil {
+				return err
+			}
+		}
+		return emit(writer.bitWriter.TakeWholeBytes())
+	}
+
+	err = decoder.decodeRows(images, handoff.LumaYStart, handoff.LumaYEnd,
+		header.RecoveryInfo.MaxDpos, false, writeMcuRow)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode thread %d: %w", threadIdx, err)
+	}
+
+	// The bits of a partial last byte are in the overhang of the next partition
+	if threadIdx == numPartitions-1 {
+		padBit := byte(0xFF)
+		if header.RecoveryInfo.PadBit != nil {
+			padBit = *header.RecoveryInfo.PadBit
+		}
+		writer.bitWriter.Pad(padBit)
+	}
+	if err := emit(writer.bitWriter.DetachBuffer()); err != nil {
+		return 0, err
+	}
+
+	return int(handoff.SegmentSize) - generated, nil
+}
+
+// demultiplexStream reads the multiplexed segment data from input and queues each
+// block for its partition. The queues are closed when the data ends.
+func demultiplexStream(input *footerReader, queues *partitionQueues) error {
+	defer queues.close()
+
+	reader := bufio.NewReader(input)
+	for {
+		header, err := reader.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read segment data: %w", err)
+		}
+
+		partitionID := int(header & 0x0f)
+		var blockLen int
+
+		if header < 16 {
+			// Variable length: next 2 bytes are length - 1
+			var length [2]byte
+			if _, err := io.ReadFull(reader, length[:]); err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					return nil
+				}
+				return fmt.Errorf("failed to read segment data: %w", err)
+			}
+			blockLen = (int(length[1]) << 8) + int(length[0]) + 1
+		} else {
+			// Fixed length encoded in header
+			flags := (header >> 4) & 3
+			blockLen = 1024 << (2 * flags)
+		}
+
+		data := make([]byte, blockLen)
+		n, err := io.ReadFull(reader, data)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("failed to read segment data: %w", err)
+		}
+
+		if partitionID < len(queues.blocks) && n > 0 {
+			if err := queues.push(partitionID, data[:n]); err != nil {
+				return err
+			}
+		}
+
+		if n < blockLen {
+			return nil
+		}
+	}
+}
+
+// footerReader reads everything except the file size footer from a Lepton file.
+// Once it has returned io.EOF, pending holds the footer.
+type footerReader struct {
+	reader  io.Reader
+	pending []byte
+	chunk   [4096]byte
+	eof     bool
+	read    int64 // bytes returned, not counting the footer
+}
+
+func (f *footerReader) Read(p []byte) (int, error) {
+	for len(f.pending) <= leptonFooterSize {
+		if f.eof {
+			if len(f.pending) < leptonFooterSize {
+				return 0, ErrExitCode(ExitCodeBadLeptonFile, "missing file size footer")
+			}
+			return 0, io.EOF
+		}
+
+		n, err := f.reader.Read(f.chunk[:])
+		f.pending = append(f.pending, f.chunk[:n]...)
+		if err == io.EOF {
+			f.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, f.pending[:len(f.pending)-leptonFooterSize])
+	f.pending = f.pending[n:]
+	f.read += int64(n)
+	return n, nil
+}
+
+// partitionQueues holds the demultiplexed input of every partition until its
+// decoder reads it. Only the queue of the partition being written is limited to
+// a few blocks: the decoders of later partitions may be waiting for their turn
+// to write, and their input is interleaved with that of the partition being
+// written. At most limit bytes are held, unless it is negative.
+type partitionQueues struct {
+	mu        sync.Mutex
+	cond      sync.Cond
+	blocks    [][][]byte
+	discarded []bool
+	current   int // the partition being written
+	closed    bool
+	aborted   bool
+	held      int64
+	peak      int64
+	limit     int64
+}
+
+func newPartitionQueues(numPartitions int, limit int64) *partitionQueues {
+	q := &partitionQueues{
+		blocks:    make([][][]byte, numPartitions),
+		discarded: make([]bool, numPartitions),
+		limit:     limit,
+	}
+	q.cond.L = &q.mu
+	return q
+}
+
+// push queues a block of input for a partition, waiting while the queue of the
+// partition being written is full
+func (q *partitionQueues) push(partition int, data []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for partition == q.current && !q.discarded[partition] && len(q.blocks[partition]) >= streamQueueLength && !q.aborted {
+		q.cond.Wait()
+	}
+	if q.aborted {
+		return errStreamAborted
+	}
+	if q.discarded[partition] {
+		return nil
+	}
+
+	q.blocks[partition] = append(q.blocks[partition], data)
+	q.held += int64(len(data))
+	if q.held > q.peak {
+		q.peak = q.held
+	}
+	if q.limit >= 0 && q.held > q.limit {
+		return ErrExitCode(ExitCodeOutOfMemory,
+			fmt.Sprintf("streaming decode holds back more than %d bytes of input", q.limit))
+	}
+	q.cond.Broadcast()
+	return nil
+}
+
+// pop returns the next block of input of a partition, waiting for it to arrive.
+// It returns io.EOF once the input has ended.
+func (q *partitionQueues) pop(partition int) ([]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.blocks[partition]) == 0 && !q.closed && !q.aborted {
+		q.cond.Wait()
+	}
+	if q.aborted {
+		return nil, errStreamAborted
+	}
+	if len(q.blocks[partition]) == 0 {
+		return nil, io.EOF
+	}
+
+	data := q.blocks[partition][0]
+	q.blocks[partition][0] = nil
+	q.blocks[partition] = q.blocks[partition][1:]
+	q.held -= int64(len(data))
+	q.cond.Broadcast()
+	return data, nil
+}
+
+// discard drops the input of a partition whose decoder has stopped, including
+// any that is still to come
+func (q *partitionQueues) discard(partition int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, data := range q.blocks[partition] {
+		q.held -= int64(len(data))
+	}
+	q.blocks[partition] = nil
+	q.discarded[partition] = true
+	q.cond.Broadcast()
+}
+
+// setCurrent records the partition being written
+func (q *partitionQueues) setCurrent(partition int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.current = partition
+	q.cond.Broadcast()
+}
+
+// close marks the end of the input
+func (q *partitionQueues) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// abort makes every waiting and later call fail with errStreamAborted
+func (q *partitionQueues) abort() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.aborted = true
+	q.cond.Broadcast()
+}
+
+// partitionReader provides the demultiplexed data of one partition to its decoder
+type partitionReader struct {
+	queues    *partitionQueues
+	partition int
+	data      []byte
+}
+
+func (r *partitionReader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		data, err := r.queues.pop(r.partition)
+		if err != nil {
+			return 0, err
+		}
+		r.data = data
+	}
+
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// partitionOutput writes the scan data of the partitions in order. Data of the
+// partition currently being written goes straight to the output. A later
+// partition buffers its data until all partitions before it have finished,
+// but waits once it holds streamOutputAhead bytes. It can wait without
+// stalling the partition being written, see partitionQueues.
+type partitionOutput struct {
+	mu       sync.Mutex
+	cond     sync.Cond
+	output   io.Writer
+	queues   *partitionQueues
+	current  int
+	buffered []bytes.Buffer
+	finished []bool
+	aborted  bool
+	held     int64
+	peak     int64
+}
+
+func newPartitionOutput(output io.Writer, numPartitions int, queues *partitionQueues) *partitionOutput {
+	o := &partitionOutput{
+		output:   output,
+		queues:   queues,
+		buffered: make([]bytes.Buffer, numPartitions),
+		finished: make([]bool, numPartitions),
+	}
+	o.cond.L = &o.mu
+	return o
+}
+
+// write writes or buffers scan data of a partition, waiting while a partition
+// that is not being written holds streamOutputAhead bytes
+func (o *partitionOutput) write(threadIdx int, data []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for threadIdx != o.current && o.buffered[threadIdx].Len() >= streamOutputAhead && !o.aborted {
+		o.cond.Wait()
+	}
+	if o.aborted {
+		return errStreamAborted
+	}
+
+	if threadIdx == o.current {
+		_, err := o.output.Write(data)
+		return err
+	}
+
+	o.buffered[threadIdx].Write(data)
+	o.held += int64(len(data))
+	if o.held > o.peak {
+		o.peak = o.held
+	}
+	return nil
+}
+
+// finish marks a partition as complete and writes the buffered data of the
+// partitions that follow it
+func (o *partitionOutput) finish(threadIdx int) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.finished[threadIdx] = true
+	for o.current < len(o.finished) && o.finished[o.current] {
+		o.current++
+		if o.current < len(o.buffered) {
+			o.held -= int64(o.buffered[o.current].Len())
+			if _, err := o.output.Write(o.buffered[o.current].Bytes()); err != nil {
+				return err
+			}
+			o.buffered[o.current] = bytes.Buffer{}
+		}
+	}
+	o.queues.setCurrent(o.current)
+	o.cond.Broadcast()
+
+	return nil
+}
+
+// abort makes every waiting and later write fail with errStreamAborted
+func (o *partitionOutput) abort() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.aborted = true
+	o.cond.Broadcast()
+}
@@ -2,8 +2,21 @@ package lepton
 
 import (
 	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -103,6 +116,7 @@ func TestDecodeBaselineImages(t *testing.T) {
 		"pixelated",
 		"truncate4",
 	}
+	shortOutput := map[string]bool{"zeros_in_dqt_tables": true}
 
 	imagesDir := "../rust/images"
 
@@ -131,11 +145,15 @@ func TestDecodeBaselineImages(t *testing.T) {
 				t.Fatalf("Failed to read Lepton file: %v", err)
 			}
 
-			// Decode
-			decodedJpeg, err := DecodeLeptonBytes(leptonData)
-			if err != nil {
+			// Decode, accepting the short output of files that record a
+			// larger size than they decode to
+			opts := CompatLeptonVectorRead()
+			opts.AcceptShortOutput = shortOutput[tc]
+			var decoded bytes.Buffer
+			if err := DecodeWithOptions(bytes.NewReader(leptonData), &decoded, opts); err != nil {
 				t.Fatalf("Failed to decode Lepton: %v", err)
 			}
+			decodedJpeg := decoded.Bytes()
 
 			// Compare
 			if len(decodedJpeg) != len(originalJpeg) {
@@ -221,6 +239,889 @@ func TestDecodeProgressiveImages(t *testing.T) {
 	}
 }
 
+// TestDecodeThreadCounts tests that multi-partition files decode identically
+// regardless of how many partitions are decoded concurrently
+func TestDecodeThreadCounts(t *testing.T) {
+	imagesDir := "../rust/images"
+	leptonPath := filepath.Join(imagesDir, "iphonecity.lep")
+	jpegPath := filepath.Join(imagesDir, "iphonecity.jpg")
+
+	originalJpeg, err := os.ReadFile(jpegPath)
+	if err != nil {
+		t.Fatalf("Failed to read original JPEG: %v", err)
+	}
+
+	leptonData, err := os.ReadFile(leptonPath)
+	if err != nil {
+		t.Fatalf("Failed to read Lepton file: %v", err)
+	}
+
+	for _, threads := range []int{1, 2, 3, 8, 16} {
+		var output bytes.Buffer
+		if err := DecodeLeptonWithThreads(bytes.NewReader(leptonData), &output, threads); err != nil {
+			t.Fatalf("Failed to decode Lepton with %d threads: %v", threads, err)
+		}
+
+		if !bytes.Equal(output.Bytes(), originalJpeg) {
+			t.Errorf("Decoded output with %d threads does not match original", threads)
+		}
+	}
+}
+
+// TestDecodeStreaming tests that the streaming decoder reproduces the original
+// JPEG for baseline, progressive and truncated images
+func TestDecodeStreaming(t *testing.T) {
+	testCases := []string{
+		"android",
+		"androidcrop",
+		"androidprogressive",
+		"colorswap",
+		"gray2sf",
+		"grayscale",
+		"iphone",
+		"iphonecity",
+		"iphonecity_with_1MGarbage",
+		"iphonecrop",
+		"iphonecrop2",
+		"narrowrst",
+		"nofsync",
+		"slrhills",
+		"tiny",
+		"trailingrst",
+		"trailingrst2",
+		"eof_and_trailingrst",
+		"pixelated",
+		"truncate4",
+	}
+
+	imagesDir := "../rust/images"
+
+	for _, tc := range testCases {
+		t.Run(tc, func(t *testing.T) {
+			originalJpeg, err := os.ReadFile(filepath.Join(imagesDir, tc+".jpg"))
+			if err != nil {
+				t.Fatalf("Failed to read original JPEG: %v", err)
+			}
+
+			leptonData, err := os.ReadFile(filepath.Join(imagesDir, tc+".lep"))
+			if err != nil {
+				t.Fatalf("Failed to read Lepton file: %v", err)
+			}
+
+			var output bytes.Buffer
+			if err := DecodeStreaming(bytes.NewReader(leptonData), &output, nil); err != nil {
+				t.Fatalf("Failed to decode Lepton: %v", err)
+			}
+
+			if !bytes.Equal(output.Bytes(), originalJpeg) {
+				t.Errorf("Streaming decode does not match original (%d bytes, expected %d)",
+					output.Len(), len(originalJpeg))
+			}
+		})
+	}
+}
+
+// lockedBuffer is a bytes.Buffer that can be written and measured concurrently
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Len()
+}
+
+// chunkedReader returns its data in small reads and records how much output
+// had been written when the input was exhausted
+type chunkedReader struct {
+	data         []byte
+	output       *lockedBuffer
+	writtenAtEOF int
+	exhausted    bool
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		if !r.exhausted {
+			r.exhausted = true
+			r.writtenAtEOF = r.output.Len()
+		}
+		return 0, io.EOF
+	}
+	n := copy(p[:min(len(p), 1024)], r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// TestDecodeStreamingIncremental tests that JPEG data is written before the
+// whole Lepton file has been read
+func TestDecodeStreamingIncremental(t *testing.T) {
+	originalJpeg, err := os.ReadFile("../rust/images/iphone.jpg")
+	if err != nil {
+		t.Fatalf("Failed to read original JPEG: %v", err)
+	}
+
+	opts := CompatLeptonVectorWrite()
+	opts.MaxPartitions = 1
+	var leptonData bytes.Buffer
+	if err := EncodeWithOptions(bytes.NewReader(originalJpeg), &leptonData, opts); err != nil {
+		t.Fatalf("Failed to encode to Lepton: %v", err)
+	}
+
+	var output lockedBuffer
+	reader := &chunkedReader{data: leptonData.Bytes(), output: &output}
+	if err := DecodeStreaming(reader, &output, nil); err != nil {
+		t.Fatalf("Failed to decode Lepton: %v", err)
+	}
+
+	if !bytes.Equal(output.buf.Bytes(), originalJpeg) {
+		t.Fatal("Streaming decode does not match original")
+	}
+
+	if reader.writtenAtEOF < len(originalJpeg)/2 {
+		t.Errorf("Only %d of %d bytes were written before the input ended",
+			reader.writtenAtEOF, len(originalJpeg))
+	}
+
+	// Waiting partitions hold back their compressed input rather than their
+	// JPEG data, and the pool of goroutines bounds the JPEG data held back
+	opts.MaxPartitions = 4
+	leptonData.Reset()
+	if err := EncodeWithOptions(bytes.NewReader(originalJpeg), &leptonData, opts); err != nil {
+		t.Fatalf("Failed to encode to Lepton: %v", err)
+	}
+	decodeScan := func(threads int, inputLimit int64) (streamStats, error) {
+		input := bytes.NewReader(leptonData.Bytes())
+		header, err := ReadLeptonHeader(input)
+		if err != nil {
+			t.Fatalf("ReadLeptonHeader failed: %v", err)
+		}
+		if err := readCompletionMarker(input); err != nil {
+			t.Fatalf("readCompletionMarker failed: %v", err)
+		}
+		if len(header.ThreadHandoffs) != 4 {
+			t.Fatalf("Expected 4 partitions, got %d", len(header.ThreadHandoffs))
+		}
+		decodeOpts := CompatLeptonVectorRead()
+		decodeOpts.MaxProcessorThreads = uint32(threads)
+		_, stats, err := decodePartitionsStreaming(header, input, io.Discard, decodeOpts, inputLimit, nil)
+		return stats, err
+	}
+
+	header, err := ReadLeptonHeader(bytes.NewReader(leptonData.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadLeptonHeader failed: %v", err)
+	}
+	laterScanData := int64(0)
+	for _, handoff := range header.ThreadHandoffs[1:] {
+		laterScanData += int64(handoff.SegmentSize)
+	}
+
+	for _, threads := range []int{1, 4} {
+		stats, err := decodeScan(threads, -1)
+		if err != nil {
+			t.Fatalf("%d threads: decodePartitionsStreaming failed: %v", threads, err)
+		}
+		if threads == 1 && stats.peakOutput != 0 {
+			t.Errorf("1 thread: held back %d bytes of JPEG data", stats.peakOutput)
+		}
+		if maxOutput := int64(threads-1) * 2 * streamOutputAhead; stats.peakOutput > maxOutput {
+			t.Errorf("%d threads: held back %d bytes of JPEG data, expected at most %d",
+				threads, stats.peakOutput, maxOutput)
+		}
+		if held := stats.peakInput + stats.peakOutput; held >= laterScanData {
+			t.Errorf("%d threads: held back %d bytes, not less than the %d bytes of scan data of later partitions",
+				threads, held, laterScanData)
+		}
+
+		_, err = decodeScan(threads, stats.peakInput/2)
+		expectExitCode(t, err, ExitCodeOutOfMemory)
+
+		decodeOpts := CompatLeptonVectorRead()
+		decodeOpts.MaxProcessorThreads = uint32(threads)
+		var streamed bytes.Buffer
+		if err := DecodeStreaming(bytes.NewReader(leptonData.Bytes()), &streamed, decodeOpts); err != nil {
+			t.Fatalf("%d threads: DecodeStreaming failed: %v", threads, err)
+		}
+		if !bytes.Equal(streamed.Bytes(), originalJpeg) {
+			t.Errorf("%d threads: streaming decode does not match original", threads)
+		}
+	}
+}
+
+// TestDecodeWithOptions tests decoding files produced by the C++ scalar and
+// vector builds, which need matching options. Matches Rust's
+// verify_decode_scalar_overflow and verify_16bitmath tests.
+func TestDecodeWithOptions(t *testing.T) {
+	noDC16 := CompatLeptonVectorRead()
+	noDC16.Use16BitDCEstimate = false
+
+	testCases := []struct {
+		name   string
+		lepton string
+		jpeg   string
+		opts   *Options
+	}{
+		{"scalar", "mathoverflow_scalar", "mathoverflow_scalar", CompatLeptonScalarRead()},
+		{"vector16", "mathoverflow_16", "mathoverflow", CompatLeptonVectorRead()},
+		{"vector32", "mathoverflow_32", "mathoverflow", noDC16},
+	}
+
+	imagesDir := "../rust/images"
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			originalJpeg, err := os.ReadFile(filepath.Join(imagesDir, tc.jpeg+".jpg"))
+			if err != nil {
+				t.Fatalf("Failed to read original JPEG: %v", err)
+			}
+
+			leptonData, err := os.ReadFile(filepath.Join(imagesDir, tc.lepton+".lep"))
+			if err != nil {
+				t.Fatalf("Failed to read Lepton file: %v", err)
+			}
+
+			var output bytes.Buffer
+			if err := DecodeWithOptions(bytes.NewReader(leptonData), &output, tc.opts); err != nil {
+				t.Fatalf("Failed to decode Lepton: %v", err)
+			}
+
+			if !bytes.Equal(output.Bytes(), originalJpeg) {
+				t.Errorf("Decoded output does not match original: decoded %d bytes, original %d bytes",
+					output.Len(), len(originalJpeg))
+			}
+		})
+	}
+
+	// Limits in the options must be enforced
+	leptonData, err := os.ReadFile(filepath.Join(imagesDir, "iphone.lep"))
+	if err != nil {
+		t.Fatalf("Failed to read Lepton file: %v", err)
+	}
+
+	small := CompatLeptonVectorRead()
+	small.MaxJpegWidth = 64
+	err = DecodeWithOptions(bytes.NewReader(leptonData), io.Discard, small)
+	expectExitCode(t, err, ExitCodeUnsupportedJpeg)
+
+	small = CompatLeptonVectorRead()
+	small.MaxJpegFileSize = 1024
+	err = DecodeWithOptions(bytes.NewReader(leptonData), io.Discard, small)
+	expectExitCode(t, err, ExitCodeBadLeptonFile)
+}
+
+// TestDecodeContext tests that both decoders report progress and stop once
+// their context is cancelled
+func TestDecodeContext(t *testing.T) {
+	originalJpeg, err := os.ReadFile("../rust/images/iphonecity.jpg")
+	if err != nil {
+		t.Fatalf("Failed to read original JPEG: %v", err)
+	}
+	leptonData, err := os.ReadFile("../rust/images/iphonecity.lep")
+	if err != nil {
+		t.Fatalf("Failed to read Lepton file: %v", err)
+	}
+
+	decoders := []struct {
+		name   string
+		decode func(context.Context, io.Reader, io.Writer, *Options) error
+	}{
+		{"buffered", DecodeContext},
+		{"streaming", DecodeStreamingContext},
+	}
+
+	for _, d := range decoders {
+		t.Run(d.name, func(t *testing.T) {
+			var last Progress
+			opts := CompatLeptonVectorRead()
+			opts.Progress = func(p Progress) { last = p }
+
+			var output bytes.Buffer
+			if err := d.decode(context.Background(), bytes.NewReader(leptonData), &output, opts); err != nil {
+				t.Fatalf("Decode failed: %v", err)
+			}
+			if !bytes.Equal(output.Bytes(), originalJpeg) {
+				t.Errorf("Decoded output does not match original")
+			}
+			if last.Rows == 0 || last.Rows != last.TotalRows || last.Partitions != last.TotalPartitions {
+				t.Errorf("Decode finished with progress %+v", last)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			err := d.decode(ctx, bytes.NewReader(leptonData), io.Discard, opts)
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("Expected context.Canceled, got %v", err)
+			}
+
+			ctx, cancel = context.WithCancel(context.Background())
+			defer cancel()
+			opts.Progress = func(p Progress) {
+				if p.Rows == 10 {
+					cancel()
+				}
+			}
+			err = d.decode(ctx, bytes.NewReader(leptonData), io.Discard, opts)
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("Expected context.Canceled, got %v", err)
+			}
+		})
+	}
+
+	// Cancelling once all rows are decoded stops the JPEG writer
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := CompatLeptonVectorRead()
+	opts.Progress = func(p Progress) {
+		if p.Partitions == p.TotalPartitions {
+			cancel()
+		}
+	}
+	var output bytes.Buffer
+	err = DecodeContext(ctx, bytes.NewReader(leptonData), &output, opts)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if output.Len() == 0 || output.Len() >= len(originalJpeg) {
+		t.Errorf("Writer stopped after %d of %d bytes", output.Len(), len(originalJpeg))
+	}
+}
+
+// TestDecodeOutputLength tests that the file size footer and the original
+// file size are checked against what was read and written
+func TestDecodeOutputLength(t *testing.T) {
+	imagesDir := "../rust/images"
+	originalJpeg, err := os.ReadFile(filepath.Join(imagesDir, "iphone.jpg"))
+	if err != nil {
+		t.Fatalf("Failed to read original JPEG: %v", err)
+	}
+	leptonData, err := os.ReadFile(filepath.Join(imagesDir, "iphone.lep"))
+	if err != nil {
+		t.Fatalf("Failed to read Lepton file: %v", err)
+	}
+
+	patch := func(offset int, delta int32) []byte {
+		patched := append([]byte{}, leptonData...)
+		v := binary.LittleEndian.Uint32(patched[offset:])
+		binary.LittleEndian.PutUint32(patched[offset:], uint32(int32(v)+delta))
+		return patched
+	}
+	footer := len(leptonData) - 4
+
+	testCases := []struct {
+		name   string
+		lepton []byte
+	}{
+		{"footer_too_small", patch(footer, -1)},
+		{"footer_too_large", patch(footer, 1)},
+		{"original_size_too_small", patch(20, -1)},
+		{"original_size_too_large", patch(20, 1)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := DecodeWithOptions(bytes.NewReader(tc.lepton), io.Discard, nil)
+			expectExitCode(t, err, ExitCodeVerificationLengthMismatch)
+			err = DecodeStreaming(bytes.NewReader(tc.lepton), io.Discard, nil)
+			expectExitCode(t, err, ExitCodeVerificationLengthMismatch)
+		})
+	}
+
+	// Only a larger original size is accepted with AcceptShortOutput
+	opts := CompatLeptonVectorRead()
+	opts.AcceptShortOutput = true
+	var output bytes.Buffer
+	if err := DecodeWithOptions(bytes.NewReader(patch(20, 1)), &output, opts); err != nil {
+		t.Errorf("Decode with AcceptShortOutput failed: %v", err)
+	} else if !bytes.Equal(output.Bytes(), originalJpeg) {
+		t.Errorf("Decoded output does not match original")
+	}
+	err = DecodeWithOptions(bytes.NewReader(patch(20, -1)), io.Discard, opts)
+	expectExitCode(t, err, ExitCodeVerificationLengthMismatch)
+
+	// This file records a size larger than the JPEG it decodes to
+	jpeg, err := os.ReadFile(filepath.Join(imagesDir, "zeros_in_dqt_tables.jpg"))
+	if err != nil {
+		t.Fatalf("Failed to read original JPEG: %v", err)
+	}
+	lepton, err := os.ReadFile(filepath.Join(imagesDir, "zeros_in_dqt_tables.lep"))
+	if err != nil {
+		t.Fatalf("Failed to read Lepton file: %v", err)
+	}
+	_, err = DecodeLeptonBytes(lepton)
+	expectExitCode(t, err, ExitCodeVerificationLengthMismatch)
+	output.Reset()
+	if err := DecodeWithOptions(bytes.NewReader(lepton), &output, opts); err != nil {
+		t.Errorf("Decode with AcceptShortOutput failed: %v", err)
+	} else if !bytes.Equal(output.Bytes(), jpeg) {
+		t.Errorf("Decoded output does not match original")
+	}
+}
+
+// fuzzOptions limits opts so that fuzzed files cannot make the coders
+// allocate more than a few megabytes
+func fuzzOptions(opts *Options) *Options {
+	opts.MaxJpegPixels = 1 << 20
+	opts.MaxBlockMemory = 16 << 20
+	opts.MaxDecompressedHeaderSize = 1 << 20
+	opts.MaxDecodePartitions = 16
+	opts.MaxJpegFileSize = 1 << 20
+	return opts
+}
+
+// expectNoPanic fails the test if err is a panic recovered by an entry point
+func expectNoPanic(t *testing.T, err error) {
+	t.Helper()
+	if lepErr, ok := IsLeptonError(err); ok && strings.HasPrefix(lepErr.Message, "panic:") {
+		t.Fatal(err)
+	}
+}
+
+// TestDecodeImage checks that the pixels of DecodeImage are within rounding
+// of those image/jpeg decodes from the original JPEG
+func TestDecodeImage(t *testing.T) {
+	testCases := []struct {
+		name string
+		jpeg func() []byte
+	}{
+		{"android", nil},
+		{"grayscale", nil},
+		{"iphoneprogressive", nil},
+		{"colorswap", nil},
+		{"411", func() []byte { return buildSampledJpeg(131, 213, [][2]int{{4, 1}, {1, 1}, {1, 1}}, 0, false) }},
+		{"420", func() []byte { return buildSampledJpeg(131, 213, [][2]int{{2, 2}, {1, 1}, {1, 1}}, 0, false) }},
+	}
+	samplingOpts := CompatLeptonVectorWrite()
+	samplingOpts.AllowSamplingBeyondTwo = true
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var jpegData, leptonData []byte
+			var err error
+			if tc.jpeg == nil {
+				if jpegData, err = os.ReadFile(filepath.Join("../rust/images", tc.name+".jpg")); err != nil {
+					t.Fatalf("Failed to read original JPEG: %v", err)
+				}
+				if leptonData, err = os.ReadFile(filepath.Join("../rust/images", tc.name+".lep")); err != nil {
+					t.Fatalf("Failed to read Lepton file: %v", err)
+				}
+			} else {
+				jpegData = tc.jpeg()
+				if leptonData, err = EncodeVerifyWithOptions(jpegData, samplingOpts); err != nil {
+					t.Fatalf("EncodeVerify failed: %v", err)
+				}
+			}
+
+			want, err := jpeg.Decode(bytes.NewReader(jpegData))
+			if err != nil {
+				t.Fatalf("image/jpeg failed: %v", err)
+			}
+			got, format, err := image.Decode(bytes.NewReader(leptonData))
+			if err != nil {
+				t.Fatalf("image.Decode failed: %v", err)
+			}
+			if format != "lepton" {
+				t.Errorf("format = %q, want lepton", format)
+			}
+			if got.Bounds() != want.Bounds() {
+				t.Fatalf("bounds = %v, want %v", got.Bounds(), want.Bounds())
+			}
+
+			config, _, err := image.DecodeConfig(bytes.NewReader(leptonData))
+			if err != nil {
+				t.Fatalf("image.DecodeConfig failed: %v", err)
+			}
+			if config.Width != got.Bounds().Dx() || config.Height != got.Bounds().Dy() || config.ColorModel != got.ColorModel() {
+				t.Errorf("config %+v does not match the image", config)
+			}
+
+			maxDiff := 0
+			compare := func(a, b uint8) {
+				maxDiff = max(maxDiff, absInt(int(a)-int(b)))
+			}
+			bounds := got.Bounds()
+			switch want := want.(type) {
+			case *image.Gray:
+				got, ok := got.(*image.Gray)
+				if !ok {
+					t.Fatalf("got %T, want *image.Gray", got)
+				}
+				for y := 0; y < bounds.Dy(); y++ {
+					for x := 0; x < bounds.Dx(); x++ {
+						compare(got.GrayAt(x, y).Y, want.GrayAt(x, y).Y)
+					}
+				}
+			case *image.YCbCr:
+				got, ok := got.(*image.YCbCr)
+				if !ok || got.SubsampleRatio != want.SubsampleRatio {
+					t.Fatalf("got %T, want *image.YCbCr with ratio %v", got, want.SubsampleRatio)
+				}
+				for y := 0; y < bounds.Dy(); y++ {
+					for x := 0; x < bounds.Dx(); x++ {
+						compare(got.Y[got.YOffset(x, y)], want.Y[want.YOffset(x, y)])
+						compare(got.Cb[got.COffset(x, y)], want.Cb[want.COffset(x, y)])
+						compare(got.Cr[got.COffset(x, y)], want.Cr[want.COffset(x, y)])
+					}
+				}
+			}
+			if maxDiff > 1 {
+				t.Errorf("pixels differ by up to %d from image/jpeg", maxDiff)
+			}
+		})
+	}
+
+	// image.YCbCr has no ratio for 3x1 sampling, so chroma is upsampled
+	t.Run("3x1", func(t *testing.T) {
+		leptonData, err := EncodeVerifyWithOptions(buildSampledJpeg(75, 37, [][2]int{{3, 1}, {1, 1}, {1, 1}}, 0, false), samplingOpts)
+		if err != nil {
+			t.Fatalf("EncodeVerify failed: %v", err)
+		}
+		img, err := DecodeImage(bytes.NewReader(leptonData))
+		if err != nil {
+			t.Fatalf("DecodeImage failed: %v", err)
+		}
+		ycbcr, ok := img.(*image.YCbCr)
+		if !ok || ycbcr.SubsampleRatio != image.YCbCrSubsampleRatio444 || img.Bounds() != image.Rect(0, 0, 75, 37) {
+			t.Fatalf("got %T with bounds %v, want a 4:4:4 *image.YCbCr of 75x37", img, img.Bounds())
+		}
+		for x := 0; x < 75; x++ {
+			if ycbcr.Cb[x] != ycbcr.Cb[x/3*3] {
+				t.Fatalf("chroma sample %d differs from the one it was upsampled from", x)
+			}
+		}
+	})
+}
+
+// TestDecodeThumbnail checks that thumbnail pixels are close to the average
+// of the pixels of the full image that they cover
+func TestDecodeThumbnail(t *testing.T) {
+	luma := func(img image.Image, x, y int) int {
+		if gray, ok := img.(*image.Gray); ok {
+			return int(gray.GrayAt(x, y).Y)
+		}
+		return int(img.(*image.YCbCr).YCbCrAt(x, y).Y)
+	}
+
+	for _, name := range []string{"android", "grayscale", "iphoneprogressive"} {
+		leptonData, err := os.ReadFile(filepath.Join("../rust/images", name+".lep"))
+		if err != nil {
+			t.Fatalf("Failed to read Lepton file: %v", err)
+		}
+		full, err := DecodeImage(bytes.NewReader(leptonData))
+		if err != nil {
+			t.Fatalf("%s: DecodeImage failed: %v", name, err)
+		}
+
+		for _, scale := range []int{2, 4, 8} {
+			thumb, err := DecodeThumbnail(bytes.NewReader(leptonData), scale)
+			if err != nil {
+				t.Fatalf("%s 1/%d: DecodeThumbnail failed: %v", name, scale, err)
+			}
+			if reflect.TypeOf(thumb) != reflect.TypeOf(full) {
+				t.Errorf("%s 1/%d: got %T, want %T", name, scale, thumb, full)
+			}
+			bounds := thumb.Bounds()
+			fullBounds := full.Bounds()
+			if bounds.Dx() != (fullBounds.Dx()+scale-1)/scale || bounds.Dy() != (fullBounds.Dy()+scale-1)/scale {
+				t.Fatalf("%s 1/%d: bounds %v for an image of %v", name, scale, bounds, fullBounds)
+			}
+
+			diff := 0
+			for y := 0; y < bounds.Dy(); y++ {
+				for x := 0; x < bounds.Dx(); x++ {
+					area := image.Rect(x*scale, y*scale, (x+1)*scale, (y+1)*scale).Intersect(fullBounds)
+					sum := 0
+					for fy := area.Min.Y; fy < area.Max.Y; fy++ {
+						for fx := area.Min.X; fx < area.Max.X; fx++ {
+							sum += luma(full, fx, fy)
+						}
+					}
+					diff += absInt(luma(thumb, x, y) - sum/(area.Dx()*area.Dy()))
+				}
+			}
+			if mean := float64(diff) / float64(bounds.Dx()*bounds.Dy()); mean > 2 {
+				t.Errorf("%s 1/%d: thumbnail differs from the image by %.2f on average", name, scale, mean)
+			}
+		}
+	}
+
+	_, err := DecodeThumbnail(bytes.NewReader(nil), 3)
+	expectExitCode(t, err, ExitCodeSyntaxError)
+}
+
+// TestReadInfo checks that the info of a JPEG and of its Lepton file agree,
+// and that it only needs their headers
+func TestReadInfo(t *testing.T) {
+	for _, name := range []string{"android", "iphoneprogressive", "gray2sf", "androidprogressive_garbage"} {
+		jpegData, err := os.ReadFile(filepath.Join("../rust/images", name+".jpg"))
+		if err != nil {
+			t.Fatalf("Failed to read original JPEG: %v", err)
+		}
+		leptonPath := filepath.Join("../rust/images", name+".lep")
+		leptonData, err := os.ReadFile(leptonPath)
+		if err != nil {
+			t.Fatalf("Failed to read Lepton file: %v", err)
+		}
+		header, err := ReadLeptonHeader(bytes.NewReader(leptonData))
+		if err != nil {
+			t.Fatalf("%s: ReadLeptonHeader failed: %v", name, err)
+		}
+
+		// Half of the JPEG and the Lepton data up to the compressed header
+		jpegInfo, err := ReadInfo(bytes.NewReader(jpegData[:len(jpegData)/2]))
+		if err != nil {
+			t.Fatalf("%s: ReadInfo of JPEG failed: %v", name, err)
+		}
+		leptonInfo, err := ReadInfo(bytes.NewReader(leptonData[:28+header.CompressedHeaderSize]))
+		if err != nil {
+			t.Fatalf("%s: ReadInfo of Lepton file failed: %v", name, err)
+		}
+		statInfo, err := Stat(leptonPath)
+		if err != nil {
+			t.Fatalf("%s: Stat failed: %v", name, err)
+		}
+
+		if jpegInfo.Format != "jpeg" || leptonInfo.Format != "lepton" {
+			t.Errorf("%s: formats %q and %q", name, jpegInfo.Format, leptonInfo.Format)
+		}
+		if !reflect.DeepEqual(statInfo, leptonInfo) {
+			t.Errorf("%s: Stat gave %+v, ReadInfo %+v", name, statInfo, leptonInfo)
+		}
+		if leptonInfo.OriginalFileSize != uint32(len(jpegData)) || leptonInfo.Partitions != len(header.ThreadHandoffs) ||
+			leptonInfo.Version != LeptonVersion || leptonInfo.GarbageSize == 0 {
+			t.Errorf("%s: Lepton info %+v for a JPEG of %d bytes", name, leptonInfo, len(jpegData))
+		}
+
+		// Only the fields of the frame are known for both
+		frame := *leptonInfo
+		frame.Format = "jpeg"
+		frame.Version, frame.OriginalFileSize, frame.Partitions, frame.GarbageSize, frame.Truncated = 0, 0, 0, 0, false
+		if !reflect.DeepEqual(*jpegInfo, frame) {
+			t.Errorf("%s: JPEG info %+v, Lepton info %+v", name, jpegInfo, leptonInfo)
+		}
+	}
+
+	_, err := Stat(filepath.Join("../rust/images", "missing.lep"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat of a missing file: %v", err)
+	}
+}
+
+// TestReadMetadata checks that the metadata segments of a JPEG, and of an
+// image after its EOI marker, are found in the header of its Lepton file
+func TestReadMetadata(t *testing.T) {
+	segment := func(marker byte, body string) []byte {
+		return append([]byte{0xFF, marker, byte((len(body) + 2) >> 8), byte(len(body) + 2)}, body...)
+	}
+
+	original, err := os.ReadFile("../rust/images/tiny.jpg")
+	if err != nil {
+		t.Fatalf("Failed to read original JPEG: %v", err)
+	}
+
+	// The ICC chunks are out of order, which is allowed
+	var jpegData []byte
+	jpegData = append(jpegData, SOI[:]...)
+	jpegData = append(jpegData, segment(MarkerAPP1, "Exif\x00\x00MM\x00\x2a")...)
+	jpegData = append(jpegData, segment(MarkerAPP1, "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>")...)
+	jpegData = append(jpegData, segment(MarkerAPP2, "ICC_PROFILE\x00\x02\x02second")...)
+	jpegData = append(jpegData, segment(MarkerAPP2, "ICC_PROFILE\x00\x01\x02first ")...)
+	jpegData = append(jpegData, segment(MarkerAPP2, "MPF\x00II\x2a\x00")...)
+	jpegData = append(jpegData, original[2:]...)
+	jpegData = append(jpegData, segment(MarkerCOM, "not a comment, trailing data")...)
+	jpegData = append(jpegData, SOI[:]...)
+	jpegData = append(jpegData, segment(MarkerAPP1, "Exif\x00\x00II\x2a\x00")...)
+	jpegData = append(jpegData, segment(MarkerSOS, "\x01\x01\x00\x00\x3f\x00")...)
+	jpegData = append(jpegData, 0x12, 0xFF, 0x00, 0x34, 0xFF, 0xD9)
+
+	leptonData, err := EncodeVerify(jpegData)
+	if err != nil {
+		t.Fatalf("EncodeVerify failed: %v", err)
+	}
+	header, err := ReadLeptonHeader(bytes.NewReader(leptonData))
+	if err != nil {
+		t.Fatalf("ReadLeptonHeader failed: %v", err)
+	}
+
+	md, err := ReadMetadata(bytes.NewReader(leptonData[:28+header.CompressedHeaderSize]))
+	if err != nil {
+		t.Fatalf("ReadMetadata failed: %v", err)
+	}
+	if string(md.Exif) != "MM\x00\x2a" || string(md.XMP) != "<x:xmpmeta/>" || string(md.MPF) != "II\x2a\x00" {
+		t.Errorf("Exif %q, XMP %q, MPF %q", md.Exif, md.XMP, md.MPF)
+	}
+	if string(md.ICCProfile) != "first second" {
+		t.Errorf("ICC profile %q", md.ICCProfile)
+	}
+	if len(md.Comments) != 0 {
+		t.Errorf("trailing data taken for comments: %q", md.Comments)
+	}
+	if len(md.Segments) < 5 || md.Segments[3].Marker != MarkerAPP2 {
+		t.Errorf("segments %+v", md.Segments)
+	}
+	if len(md.Embedded) != 1 || string(md.Embedded[0].Exif) != "II\x2a\x00" {
+		t.Fatalf("embedded %+v", md.Embedded)
+	}
+
+	// A missing ICC chunk leaves the profile out
+	missing := &Metadata{}
+	missing.addSegments(append(segment(MarkerAPP2, "ICC_PROFILE\x00\x01\x02first "), segment(MarkerCOM, "comment")...), false)
+	if missing.ICCProfile != nil || len(missing.Comments) != 1 || string(missing.Comments[0]) != "comment" {
+		t.Errorf("ICC profile %q, comments %q", missing.ICCProfile, missing.Comments)
+	}
+}
+
+// TestRewriteMetadata checks that rewriting the metadata of a Lepton file
+// keeps its partition data and decodes to the JPEG with the new segments
+func TestRewriteMetadata(t *testing.T) {
+	leptonData, err := os.ReadFile("../rust/images/android.lep")
+	if err != nil {
+		t.Fatalf("Failed to read Lepton file: %v", err)
+	}
+	original, err := os.ReadFile("../rust/images/android.jpg")
+	if err != nil {
+		t.Fatalf("Failed to read original JPEG: %v", err)
+	}
+
+	// Replace the Exif segment by a comment
+	var rewritten bytes.Buffer
+	err = RewriteMetadata(bytes.NewReader(leptonData), &rewritten, func(segments []MetadataSegment) []MetadataSegment {
+		if len(segments) != 1 || segments[0].Marker != MarkerAPP1 {
+			t.Errorf("segments %+v", segments)
+		}
+		return []MetadataSegment{{Marker: MarkerCOM, Data: []byte("no location")}}
+	})
+	if err != nil {
+		t.Fatalf("RewriteMetadata failed: %v", err)
+	}
+
+	exifEnd := 4 + int(binary.BigEndian.Uint16(original[4:]))
+	expected := append(append([]byte(nil), SOI[:]...), 0xFF, MarkerCOM, 0x00, 0x0D)
+	expected = append(append(expected, "no location"...), original[exifEnd:]...)
+
+	decoded, err := DecodeLeptonBytes(rewritten.Bytes())
+	if err != nil {
+		t.Fatalf("DecodeLeptonBytes failed: %v", err)
+	}
+	if !bytes.Equal(decoded, expected) {
+		t.Errorf("decoded %d bytes, expected %d", len(decoded), len(expected))
+	}
+
+	var streamed bytes.Buffer
+	if err := DecodeStreaming(bytes.NewReader(rewritten.Bytes()), &streamed, nil); err != nil {
+		t.Fatalf("DecodeStreaming failed: %v", err)
+	}
+	if !bytes.Equal(streamed.Bytes(), expected) {
+		t.Errorf("streamed %d bytes, expected %d", streamed.Len(), len(expected))
+	}
+
+	md, err := ReadMetadata(bytes.NewReader(rewritten.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadMetadata failed: %v", err)
+	}
+	if md.Exif != nil || len(md.Comments) != 1 || string(md.Comments[0]) != "no location" {
+		t.Errorf("Exif %q, comments %q", md.Exif, md.Comments)
+	}
+
+	// The partition data is copied as it is
+	before, err := ReadLeptonHeader(bytes.NewReader(leptonData))
+	if err != nil {
+		t.Fatalf("ReadLeptonHeader failed: %v", err)
+	}
+	after, err := ReadLeptonHeader(bytes.NewReader(rewritten.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadLeptonHeader failed: %v", err)
+	}
+	if !bytes.Equal(leptonData[28+before.CompressedHeaderSize:len(leptonData)-4],
+		rewritten.Bytes()[28+after.CompressedHeaderSize:rewritten.Len()-4]) {
+		t.Error("partition data changed")
+	}
+
+	// Keeping the segments gives back the original JPEG
+	leptonData, err = os.ReadFile("../rust/images/iphoneprogressive.lep")
+	if err != nil {
+		t.Fatalf("Failed to read Lepton file: %v", err)
+	}
+	original, err = os.ReadFile("../rust/images/iphoneprogressive.jpg")
+	if err != nil {
+		t.Fatalf("Failed to read original JPEG: %v", err)
+	}
+	rewritten.Reset()
+	keep := func(segments []MetadataSegment) []MetadataSegment { return segments }
+	if err := RewriteMetadata(bytes.NewReader(leptonData), &rewritten, keep); err != nil {
+		t.Fatalf("RewriteMetadata failed: %v", err)
+	}
+	decoded, err = DecodeLeptonBytes(rewritten.Bytes())
+	if err != nil {
+		t.Fatalf("DecodeLeptonBytes failed: %v", err)
+	}
+	if !bytes.Equal(decoded, original) {
+		t.Errorf("decoded %d bytes, expected %d", len(decoded), len(original))
+	}
+
+	// Only APPn and COM segments can be written
+	sof := func([]MetadataSegment) []MetadataSegment {
+		return []MetadataSegment{{Marker: MarkerSOF0}}
+	}
+	err = RewriteMetadata(bytes.NewReader(leptonData), io.Discard, sof)
+	expectExitCode(t, err, ExitCodeSyntaxError)
+}
+
+// TestRecoverPanic checks that a panic turns into an AssertionFailure that
+// names where it happened
+func TestRecoverPanic(t *testing.T) {
+	var table []int
+	index := func() (err error) {
+		defer recoverPanic(&err)
+		return NewLeptonError(ExitCodeBadLeptonFile, strconv.Itoa(table[1]))
+	}
+
+	err := index()
+	expectExitCode(t, err, ExitCodeAssertionFailure)
+	if !strings.Contains(err.Error(), "index out of range") || !strings.Contains(err.Error(), "decode_test.go:") {
+		t.Errorf("panic message lacks its cause or location: %v", err)
+	}
+}
+
+// FuzzDecodeLepton checks that no Lepton file makes the decoders panic
+func FuzzDecodeLepton(f *testing.F) {
+	for _, name := range []string{"colorswap", "gray2sf", "tiny", "nofsync", "truncate4"} {
+		data, err := os.ReadFile(filepath.Join("../rust/images", name+".lep"))
+		if err != nil {
+			f.Fatalf("Failed to read Lepton file: %v", err)
+		}
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		opts := fuzzOptions(CompatLeptonVectorRead())
+		expectNoPanic(t, DecodeWithOptions(bytes.NewReader(data), io.Discard, opts))
+		expectNoPanic(t, DecodeStreaming(bytes.NewReader(data), io.Discard, opts))
+		_, err := DumpLepton(data, true, opts)
+		expectNoPanic(t, err)
+	})
+}
+
+// expectExitCode fails the test unless err is a LeptonError with the given code
+func expectExitCode(t *testing.T, err error, code ExitCode) {
+	t.Helper()
+	lepErr, ok := IsLeptonError(err)
+	if !ok {
+		t.Errorf("Expected %s error, got %v", code, err)
+		return
+	}
+	if lepErr.Code != code {
+		t.Errorf("Expected %s error, got %s", code, lepErr)
+	}
+}
+
 // TestDecodeLeptonHeader tests parsing of Lepton headers
 func TestDecodeLeptonHeader(t *testing.T) {
 	imagesDir := "../rust/images"
@@ -259,6 +1160,175 @@ func TestDecodeLeptonHeader(t *testing.T) {
 	t.Logf("Thread count: %d", header.ThreadCount)
 }
 
+// TestDecodeLimits tests that the resource limits of the options are enforced
+// before anything is allocated for a file that exceeds them
+func TestDecodeLimits(t *testing.T) {
+	imagesDir := "../rust/images"
+	read := func(name string) []byte {
+		data, err := os.ReadFile(filepath.Join(imagesDir, name))
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", name, err)
+		}
+		return data
+	}
+	iphone := read("iphone.lep")
+	iphonecity := read("iphonecity.lep")
+	garbage := read("iphonecity_with_16KGarbage.lep")
+
+	testCases := []struct {
+		name   string
+		lepton []byte
+		limit  func(*Options)
+		code   ExitCode
+	}{
+		{"compressed_header", iphone, func(o *Options) { o.MaxCompressedHeaderSize = 16 }, ExitCodeBadLeptonFile},
+		{"decompressed_header", iphone, func(o *Options) { o.MaxDecompressedHeaderSize = 64 }, ExitCodeOutOfMemory},
+		{"pixels", iphone, func(o *Options) { o.MaxJpegPixels = 1000 }, ExitCodeOutOfMemory},
+		{"block_memory", iphone, func(o *Options) { o.MaxBlockMemory = 1024 }, ExitCodeOutOfMemory},
+		{"garbage", garbage, func(o *Options) { o.MaxGarbageSize = 1024 }, ExitCodeOutOfMemory},
+		{"partitions", iphonecity, func(o *Options) { o.MaxDecodePartitions = 4 }, ExitCodeOutOfMemory},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := CompatLeptonVectorRead()
+			tc.limit(opts)
+			err := DecodeWithOptions(bytes.NewReader(tc.lepton), io.Discard, opts)
+			expectExitCode(t, err, tc.code)
+			err = DecodeStreaming(bytes.NewReader(tc.lepton), io.Discard, opts)
+			expectExitCode(t, err, tc.code)
+		})
+	}
+
+	// Files within the limits decode as before
+	opts := CompatLeptonVectorRead()
+	opts.MaxDecodePartitions = 8
+	opts.MaxGarbageSize = 1 << 20
+	opts.MaxJpegPixels = 4000 * 4000
+	opts.MaxDecompressedHeaderSize = 1 << 20
+	opts.MaxBlockMemory = 1 << 30
+	for _, name := range []string{"iphone", "iphonecity", "iphonecity_with_16KGarbage"} {
+		jpeg := read(name + ".jpg")
+		var output bytes.Buffer
+		if err := DecodeWithOptions(bytes.NewReader(read(name+".lep")), &output, opts); err != nil {
+			t.Errorf("%s: decode failed: %v", name, err)
+		} else if !bytes.Equal(output.Bytes(), jpeg) {
+			t.Errorf("%s: decoded output does not match original", name)
+		}
+	}
+
+	// A small header that decompresses to 64 MB stops at the limit
+	var bomb bytes.Buffer
+	zw := zlib.NewWriter(&bomb)
+	zw.Write(make([]byte, 64<<20))
+	zw.Close()
+	file := append([]byte{}, iphone[:24]...)
+	file = binary.LittleEndian.AppendUint32(file, uint32(bomb.Len()))
+	file = append(file, bomb.Bytes()...)
+	opts = CompatLeptonVectorRead()
+	opts.MaxDecompressedHeaderSize = 1 << 20
+	_, err := ReadLeptonHeaderWithOptions(bytes.NewReader(file), opts)
+	expectExitCode(t, err, ExitCodeOutOfMemory)
+
+	// A file that claims a large compressed header but ends after the fixed
+	// header only allocates for the bytes that are there
+	file = append([]byte{}, iphone[:24]...)
+	file = binary.LittleEndian.AppendUint32(file, CompatLeptonVectorRead().MaxJpegFileSize)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = ReadLeptonHeader(bytes.NewReader(file))
+	runtime.ReadMemStats(&after)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected a short read, got %v", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("allocated %d bytes for a 28 byte file", allocated)
+	}
+
+	// Counts in the header are checked against its size before allocating
+	header := NewLeptonHeader()
+	err = header.parseDecompressedHeader([]byte{'C', 'R', 'S', 0xFF, 0xFF, 0xFF, 0xFF}, opts)
+	expectExitCode(t, err, ExitCodeBadLeptonFile)
+}
+
+// TestDump tests that a JPEG and its Lepton file are described alike, and
+// that a JPEG which cannot be read is still described up to its first scan
+func TestDump(t *testing.T) {
+	imagesDir := "../rust/images"
+
+	for _, name := range []string{"iphone", "iphoneprogressive"} {
+		t.Run(name, func(t *testing.T) {
+			jpeg, err := os.ReadFile(filepath.Join(imagesDir, name+".jpg"))
+			if err != nil {
+				t.Fatalf("Failed to read original JPEG: %v", err)
+			}
+			var leptonData bytes.Buffer
+			if err := Encode(bytes.NewReader(jpeg), &leptonData); err != nil {
+				t.Fatalf("Failed to encode to Lepton: %v", err)
+			}
+
+			jpegDump, err := DumpJpeg(jpeg, true, nil)
+			if err != nil {
+				t.Fatalf("DumpJpeg failed: %v", err)
+			}
+			leptonDump, err := DumpLepton(leptonData.Bytes(), true, nil)
+			if err != nil {
+				t.Fatalf("DumpLepton failed: %v", err)
+			}
+
+			if len(jpegDump.Scans) == 0 || len(jpegDump.HuffmanTables) == 0 || len(jpegDump.QuantizationTables) == 0 {
+				t.Fatalf("Dump is missing scans or tables: %+v", jpegDump)
+			}
+			if jpegDump.Width != leptonDump.Width || jpegDump.Height != leptonDump.Height || jpegDump.JpegType != leptonDump.JpegType {
+				t.Errorf("Frame differs: %dx%d %s vs %dx%d %s", jpegDump.Width, jpegDump.Height, jpegDump.JpegType,
+					leptonDump.Width, leptonDump.Height, leptonDump.JpegType)
+			}
+			if !reflect.DeepEqual(jpegDump.Components, leptonDump.Components) {
+				t.Errorf("Components differ: %+v vs %+v", jpegDump.Components, leptonDump.Components)
+			}
+			if !reflect.DeepEqual(jpegDump.Scans, leptonDump.Scans) {
+				t.Errorf("Scans differ: %+v vs %+v", jpegDump.Scans, leptonDump.Scans)
+			}
+			if !reflect.DeepEqual(jpegDump.HuffmanTables, leptonDump.HuffmanTables) {
+				t.Error("Huffman tables differ")
+			}
+			if !reflect.DeepEqual(jpegDump.QuantizationTables, leptonDump.QuantizationTables) {
+				t.Error("Quantization tables differ")
+			}
+			if !reflect.DeepEqual(jpegDump.Coefficients, leptonDump.Coefficients) {
+				t.Error("Coefficients differ")
+			}
+			if leptonDump.Lepton == nil || leptonDump.Lepton.OriginalFileSize != uint32(len(jpeg)) {
+				t.Errorf("Lepton fields missing or wrong: %+v", leptonDump.Lepton)
+			}
+
+			if err := leptonDump.WriteText(io.Discard); err != nil {
+				t.Errorf("WriteText failed: %v", err)
+			}
+			if _, err := json.Marshal(jpegDump); err != nil {
+				t.Errorf("JSON encoding failed: %v", err)
+			}
+		})
+	}
+
+	t.Run("unsupported", func(t *testing.T) {
+		jpeg, err := os.ReadFile(filepath.Join(imagesDir, "arithmetic.jpg"))
+		if err != nil {
+			t.Fatalf("Failed to read original JPEG: %v", err)
+		}
+
+		// A DC scan that also claims AC coefficients
+		sos := bytes.Index(jpeg, []byte{0xFF, MarkerSOS})
+		jpeg[sos+5+2*int(jpeg[sos+4])+1] = 62
+
+		dump, err := DumpJpeg(jpeg, false, nil)
+		expectExitCode(t, err, ExitCodeUnsupportedJpeg)
+		if dump == nil || dump.Error == "" || len(dump.Scans) != 1 || len(dump.QuantizationTables) != 2 {
+			t.Errorf("Partial dump is incomplete: %+v", dump)
+		}
+	})
+}
+
 // TestBranch tests the Branch probability tracking
 func TestBranch(t *testing.T) {
 	b := NewBranch()
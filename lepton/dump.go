@@ -0,0 +1,545 @@
+package lepton
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Dump describes the structure of a JPEG file as the parser sees it, either
+// read directly from the JPEG or from the header of a Lepton file. It is meant
+// for triaging files that fail to compress and can be printed with WriteText
+// or marshalled with encoding/json.
+type Dump struct {
+	Format              string                  `json:"format"` // "jpeg" or "lepton"
+	JpegType            string                  `json:"jpegType"`
+	Width               uint32                  `json:"width"`
+	Height              uint32                  `json:"height"`
+	McuWidth            uint32                  `json:"mcuWidth"`
+	McuHeight           uint32                  `json:"mcuHeight"`
+	Mcuh                uint32                  `json:"mcuh"`
+	Mcuv                uint32                  `json:"mcuv"`
+	MaxSfh              uint32                  `json:"maxSfh"`
+	MaxSfv              uint32                  `json:"maxSfv"`
+	Components          []DumpComponent         `json:"components"`
+	Segments            []DumpSegment           `json:"segments"`
+	QuantizationTables  []DumpQuantizationTable `json:"quantizationTables"`
+	HuffmanTables       []DumpHuffmanTable      `json:"huffmanTables"`
+	Scans               []DumpScan              `json:"scans"`
+	PadBit              *uint8                  `json:"padBit"`
+	PrefixGarbageLength int                     `json:"prefixGarbageLength"`
+	GarbageLength       int                     `json:"garbageLength"`
+	EarlyEOF            bool                    `json:"earlyEof"`
+	ExplicitZeroRuns    int                     `json:"explicitZeroRuns"` // blocks that end with ZRL symbols
+	Lepton              *DumpLeptonInfo         `json:"lepton,omitempty"`
+	Coefficients        [][][64]int16           `json:"coefficients,omitempty"` // per component and block, in zigzag order
+	Error               string                  `json:"error,omitempty"`
+}
+
+// DumpComponent describes a color component of the frame
+type DumpComponent struct {
+	ID          uint8  `json:"id"`
+	Sfh         uint32 `json:"sfh"`
+	Sfv         uint32 `json:"sfv"`
+	QTable      uint8  `json:"qTable"`
+	BlockWidth  uint32 `json:"blockWidth"`
+	BlockHeight uint32 `json:"blockHeight"`
+}
+
+// DumpSegment describes a marker segment of the JPEG header
+type DumpSegment struct {
+	Marker string `json:"marker"`
+	Offset int    `json:"offset"` // position of the marker within the header
+	Length int    `json:"length"` // size including the marker
+}
+
+// DumpQuantizationTable is a quantization table as defined by a DQT segment
+type DumpQuantizationTable struct {
+	Index     uint8      `json:"index"`
+	Precision uint8      `json:"precision"` // 0 for 8-bit and 1 for 16-bit values
+	Values    [64]uint16 `json:"values"`    // in zigzag order
+}
+
+// DumpHuffmanTable is a Huffman table as defined by a DHT segment
+type DumpHuffmanTable struct {
+	Class   string    `json:"class"` // "DC" or "AC"
+	Index   uint8     `json:"index"`
+	Counts  [16]uint8 `json:"counts"` // number of codes of each length from 1 to 16 bits
+	Symbols []uint8   `json:"symbols"`
+	Valid   bool      `json:"valid"` // false if the codes do not fit in the code space
+}
+
+// DumpScan describes a scan as defined by an SOS segment
+type DumpScan struct {
+	Components      []DumpScanComponent `json:"components"`
+	Ss              uint8               `json:"ss"`
+	Se              uint8               `json:"se"`
+	Ah              uint8               `json:"ah"`
+	Al              uint8               `json:"al"`
+	RestartInterval uint16              `json:"restartInterval"`
+}
+
+// DumpScanComponent is a component of a scan and its Huffman tables
+type DumpScanComponent struct {
+	ID      uint8 `json:"id"`
+	DCTable uint8 `json:"dcTable"`
+	ACTable uint8 `json:"acTable"`
+}
+
+// DumpLeptonInfo describes the fields specific to a Lepton file
+type DumpLeptonInfo struct {
+	Version            uint8           `json:"version"`
+	EncoderVersion     uint32          `json:"encoderVersion"`
+	GitRevision        uint32          `json:"gitRevision"`
+	OriginalFileSize   uint32          `json:"originalFileSize"`
+	Use16BitDCEstimate bool            `json:"use16BitDcEstimate"`
+	Use16BitAdvPredict bool            `json:"use16BitAdvPredict"`
+	Partitions         []DumpPartition `json:"partitions"`
+	RestartCounts      []uint32        `json:"restartCounts,omitempty"`
+	RestartErrors      []int           `json:"restartErrors,omitempty"`
+}
+
+// DumpPartition describes a partition of the Lepton data that is decoded on its own
+type DumpPartition struct {
+	LumaYStart      uint32               `json:"lumaYStart"`
+	LumaYEnd        uint32               `json:"lumaYEnd"`
+	SegmentSize     uint32               `json:"segmentSize"`
+	OverhangByte    uint8                `json:"overhangByte"`
+	NumOverhangBits uint8                `json:"numOverhangBits"`
+	LastDC          [MaxComponents]int16 `json:"lastDc"`
+}
+
+// DumpJpeg reads a JPEG file and describes its structure. With all set the
+// coefficients of every block are included. If the file cannot be read the
+// returned Dump still describes the headers up to the first scan, alongside
+// the error.
+func DumpJpeg(data []byte, all bool, opts *Options) (dump *Dump, err error) {
+	if opts == nil {
+		opts = CompatLeptonVectorWrite()
+	}
+
+	dump = &Dump{Format: "jpeg"}
+	defer dump.recordError(&err)
+	defer recoverPanic(&err)
+
+	result, err := ReadJpegFileWithOptions(bytes.NewReader(data), opts)
+	if err != nil {
+		dump.Error = err.Error()
+		if soi := bytes.Index(data, SOI[:]); soi >= 0 {
+			dump.addHeaderSegments(data[soi:], true)
+		}
+		return dump, err
+	}
+
+	dump.addJpegHeader(result.Header)
+	dump.addHeaderSegments(result.RawHeader, false)
+	dump.PadBit = result.PadBit
+	dump.PrefixGarbageLength = len(result.PrefixGarbage)
+	dump.GarbageLength = len(result.GarbageData)
+	dump.EarlyEOF = result.EarlyEOF
+	dump.ExplicitZeroRuns = result.ExplicitZeroRuns.Len()
+
+	if all {
+		dump.addCoefficients(result.ImageData)
+	}
+
+	return dump, nil
+}
+
+// recordError stores the error a dump ends with if it was not recorded yet,
+// such as a recovered panic
+func (d *Dump) recordError(err *error) {
+	if *err != nil && d.Error == "" {
+		d.Error = (*err).Error()
+	}
+}
+
+// DumpLepton reads a Lepton file and describes the structure of the JPEG it
+// contains along with the Lepton specific fields. With all set the partitions
+// are decoded and the coefficients of every block are included.
+func DumpLepton(data []byte, all bool, opts *Options) (dump *Dump, err error) {
+	if opts == nil {
+		opts = CompatLeptonVectorRead()
+	}
+
+	dump = &Dump{Format: "lepton"}
+	defer dump.recordError(&err)
+	defer recoverPanic(&err)
+
+	reader := bytes.NewReader(data)
+	header, err := ReadLeptonHeaderWithOptions(reader, opts)
+	if err != nil {
+		dump.Error = err.Error()
+		return dump, err
+	}
+
+	dump.addJpegHeader(header.JpegHeader)
+	dump.addHeaderSegments(header.RawJpegHeader, false)
+	dump.PadBit = header.RecoveryInfo.PadBit
+	dump.PrefixGarbageLength = len(header.RecoveryInfo.PrefixGarbage)
+	dump.GarbageLength = len(header.RecoveryInfo.GarbageData)
+	dump.EarlyEOF = header.RecoveryInfo.EarlyEofEncountered
+	dump.ExplicitZeroRuns = header.RecoveryInfo.ExplicitZeroRuns.Len()
+	dump.Lepton = &DumpLeptonInfo{
+		Version:            header.Version,
+		EncoderVersion:     header.EncoderVersion,
+		GitRevision:        header.GitRevision,
+		OriginalFileSize:   header.OriginalFileSize,
+		Use16BitDCEstimate: header.Use16BitDCEstimate,
+		Use16BitAdvPredict: header.Use16BitAdvPredict,
+		RestartCounts:      header.RecoveryInfo.RestartCounts,
+		RestartErrors:      header.RecoveryInfo.RestartErrors,
+	}
+	for _, handoff := range header.ThreadHandoffs {
+		dump.Lepton.Partitions = append(dump.Lepton.Partitions, DumpPartition{
+			LumaYStart:      handoff.LumaYStart,
+			LumaYEnd:        handoff.LumaYEnd,
+			SegmentSize:     handoff.SegmentSize,
+			OverhangByte:    handoff.OverhangByte,
+			NumOverhangBits: handoff.NumOverhangBits,
+			LastDC:          handoff.LastDC,
+		})
+	}
+
+	if all {
+		if err := readCompletionMarker(reader); err != nil {
+			dump.Error = err.Error()
+			return dump, err
+		}
+		images, err := decodeImages(header, reader, opts, nil)
+		if err != nil {
+			dump.Error = err.Error()
+			return dump, err
+		}
+		dump.addCoefficients(images)
+	}
+
+	return dump, nil
+}
+
+// jpegTypeName describes the coding process of the frame, e.g. "baseline"
+// or "progressive arithmetic"
+func jpegTypeName(header *JpegHeader) string {
+	var name string
+	switch header.JpegType {
+	case JpegTypeSequential:
+		name = "baseline"
+	case JpegTypeProgressive:
+		name = "progressive"
+	default:
+		name = "unknown"
+	}
+	if header.Arithmetic {
+		// SOF9 is extended sequential, not baseline
+		if header.JpegType == JpegTypeSequential {
+			name = "sequential"
+		}
+		name += " arithmetic"
+	}
+	return name
+}
+
+// addJpegHeader fills in the frame and component information
+func (d *Dump) addJpegHeader(header *JpegHeader) {
+	d.JpegType = jpegTypeName(header)
+	d.Width = header.Width
+	d.Height = header.Height
+	d.McuWidth = header.McuWidth
+	d.McuHeight = header.McuHeight
+	d.Mcuh = header.Mcuh
+	d.Mcuv = header.Mcuv
+	d.MaxSfh = header.MaxSfh
+	d.MaxSfv = header.MaxSfv
+
+	for i := 0; i < header.Cmpc; i++ {
+		ci := &header.CmpInfo[i]
+		d.Components = append(d.Components, DumpComponent{
+			ID:          ci.Jid,
+			Sfh:         ci.Sfh,
+			Sfv:         ci.Sfv,
+			QTable:      ci.QTableIndex,
+			BlockWidth:  ci.Bch,
+			BlockHeight: ci.Bcv,
+		})
+	}
+}
+
+// addHeaderSegments lists the marker segments of a raw JPEG header along with
+// the tables and scans they define. The raw header of a Lepton file has no SOI
+// marker. With stopAtScan the walk ends after the first SOS segment, since
+// scan data follows it in a JPEG file.
+func (d *Dump) addHeaderSegments(data []byte, stopAtScan bool) {
+	restartInterval := uint16(0)
+	pos := 0
+	for pos+2 <= len(data) {
+		if data[pos] != 0xFF {
+			pos++
+			continue
+		}
+
+		marker := data[pos+1]
+		if marker == 0xFF {
+			// Fill byte
+			pos++
+			continue
+		}
+		if marker == MarkerSOI || marker == MarkerEOI || (marker >= MarkerRST0 && marker <= MarkerRST7) {
+			d.Segments = append(d.Segments, DumpSegment{Marker: markerName(marker), Offset: pos, Length: 2})
+			pos += 2
+			continue
+		}
+
+		if pos+4 > len(data) {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := min(pos+2+length, len(data))
+		body := data[min(pos+4, end):end]
+		d.Segments = append(d.Segments, DumpSegment{Marker: markerName(marker), Offset: pos, Length: end - pos})
+
+		switch marker {
+		case MarkerDQT:
+			d.addQuantizationTables(body)
+		case MarkerDHT:
+			d.addHuffmanTables(body)
+		case MarkerDRI:
+			if len(body) >= 2 {
+				restartInterval = binary.BigEndian.Uint16(body)
+			}
+		case MarkerSOS:
+			d.addScan(body, restartInterval)
+			if stopAtScan {
+				return
+			}
+		}
+
+		pos = end
+	}
+}
+
+// addQuantizationTables adds the tables defined by the body of a DQT segment
+func (d *Dump) addQuantizationTables(body []byte) {
+	for len(body) > 0 {
+		table := DumpQuantizationTable{Index: body[0] & 0x0F, Precision: body[0] >> 4}
+		size := 64
+		if table.Precision != 0 {
+			size = 128
+		}
+		if len(body) < 1+size {
+			return
+		}
+		for i := 0; i < 64; i++ {
+			if table.Precision != 0 {
+				table.Values[i] = binary.BigEndian.Uint16(body[1+2*i:])
+			} else {
+				table.Values[i] = uint16(body[1+i])
+			}
+		}
+		d.QuantizationTables = append(d.QuantizationTables, table)
+		body = body[1+size:]
+	}
+}
+
+// addHuffmanTables adds the tables defined by the body of a DHT segment
+func (d *Dump) addHuffmanTables(body []byte) {
+	for len(body) >= 17 {
+		table := DumpHuffmanTable{Class: "DC", Index: body[0] & 0x0F}
+		if body[0]>>4 != 0 {
+			table.Class = "AC"
+		}
+
+		var huffmanTable HuffmanTable
+		count := 0
+		for i := 0; i < 16; i++ {
+			table.Counts[i] = body[1+i]
+			huffmanTable.NumCodes[i+1] = body[1+i]
+			count += int(body[1+i])
+		}
+		if len(body) < 17+count {
+			return
+		}
+		table.Symbols = append([]uint8{}, body[17:17+count]...)
+		table.Valid = huffmanTable.IsValid()
+
+		d.HuffmanTables = append(d.HuffmanTables, table)
+		body = body[17+count:]
+	}
+}
+
+// addScan adds the scan defined by the body of an SOS segment
+func (d *Dump) addScan(body []byte, restartInterval uint16) {
+	if len(body) < 1 || len(body) < 1+2*int(body[0])+3 {
+		return
+	}
+
+	scan := DumpScan{RestartInterval: restartInterval}
+	n := int(body[0])
+	for i := 0; i < n; i++ {
+		scan.Components = append(scan.Components, DumpScanComponent{
+			ID:      body[1+2*i],
+			DCTable: body[2+2*i] >> 4,
+			ACTable: body[2+2*i] & 0x0F,
+		})
+	}
+	scan.Ss = body[1+2*n]
+	scan.Se = body[2+2*n]
+	scan.Ah = body[3+2*n] >> 4
+	scan.Al = body[3+2*n] & 0x0F
+	d.Scans = append(d.Scans, scan)
+}
+
+// addCoefficients adds the coefficients of every block of every component
+func (d *Dump) addCoefficients(images []*BlockBasedImage) {
+	for _, image := range images {
+		total := image.GetBlockWidth() * image.GetOriginalHeight()
+		blocks := make([][64]int16, total)
+		for dpos := uint32(0); dpos < total; dpos++ {
+			block := image.GetBlock(dpos)
+			for i := 0; i < 64; i++ {
+				blocks[dpos][i] = block.GetTransposedFromZigzag(i)
+			}
+		}
+		d.Coefficients = append(d.Coefficients, blocks)
+	}
+}
+
+// markerName returns the conventional name of a JPEG marker
+func markerName(marker byte) string {
+	switch {
+	case marker == MarkerSOI:
+		return "SOI"
+	case marker == MarkerEOI:
+		return "EOI"
+	case marker == MarkerSOS:
+		return "SOS"
+	case marker == MarkerDQT:
+		return "DQT"
+	case marker == MarkerDHT:
+		return "DHT"
+	case marker == MarkerDRI:
+		return "DRI"
+	case marker == MarkerCOM:
+		return "COM"
+	case marker == 0xCC:
+		return "DAC"
+	case marker >= MarkerRST0 && marker <= MarkerRST7:
+		return fmt.Sprintf("RST%d", marker-MarkerRST0)
+	case marker >= MarkerAPP0 && marker <= 0xEF:
+		return fmt.Sprintf("APP%d", marker-MarkerAPP0)
+	case marker >= MarkerSOF0 && marker <= 0xCF:
+		return fmt.Sprintf("SOF%d", marker-MarkerSOF0)
+	default:
+		return fmt.Sprintf("0x%02X", marker)
+	}
+}
+
+// WriteText writes the dump in human-readable form
+func (d *Dump) WriteText(w io.Writer) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "format: %s\n", d.Format)
+	if d.Error != "" {
+		fmt.Fprintf(&b, "error: %s\n", d.Error)
+	}
+	if d.JpegType != "" {
+		fmt.Fprintf(&b, "type: %s\n", d.JpegType)
+		fmt.Fprintf(&b, "size: %dx%d, MCU %dx%d pixels, %dx%d MCUs, max sampling %dx%d\n",
+			d.Width, d.Height, d.McuWidth, d.McuHeight, d.Mcuh, d.Mcuv, d.MaxSfh, d.MaxSfv)
+	}
+
+	if len(d.Components) > 0 {
+		b.WriteString("components:\n")
+		for i, c := range d.Components {
+			fmt.Fprintf(&b, "  %d: id=%d sampling=%dx%d qtable=%d blocks=%dx%d\n",
+				i, c.ID, c.Sfh, c.Sfv, c.QTable, c.BlockWidth, c.BlockHeight)
+		}
+	}
+
+	b.WriteString("segments:\n")
+	for _, s := range d.Segments {
+		fmt.Fprintf(&b, "  %08x %-5s length=%d\n", s.Offset, s.Marker, s.Length)
+	}
+
+	b.WriteString("quantization tables:\n")
+	for _, q := range d.QuantizationTables {
+		fmt.Fprintf(&b, "  %d (%d-bit): %s\n", q.Index, 8*(q.Precision+1), joinInts(q.Values[:]))
+	}
+
+	b.WriteString("huffman tables:\n")
+	for _, h := range d.HuffmanTables {
+		valid := ""
+		if !h.Valid {
+			valid = " (invalid)"
+		}
+		fmt.Fprintf(&b, "  %s%d%s: counts=%s symbols=%s\n", h.Class, h.Index, valid, joinInts(h.Counts[:]), joinInts(h.Symbols))
+	}
+
+	b.WriteString("scans:\n")
+	for i, s := range d.Scans {
+		components := make([]string, len(s.Components))
+		for j, c := range s.Components {
+			components[j] = fmt.Sprintf("%d(dc%d,ac%d)", c.ID, c.DCTable, c.ACTable)
+		}
+		fmt.Fprintf(&b, "  %d: components=%s ss=%d se=%d ah=%d al=%d restart=%d\n",
+			i, strings.Join(components, ","), s.Ss, s.Se, s.Ah, s.Al, s.RestartInterval)
+	}
+
+	if d.PadBit != nil {
+		fmt.Fprintf(&b, "pad bit: %d\n", *d.PadBit)
+	} else {
+		b.WriteString("pad bit: none\n")
+	}
+	fmt.Fprintf(&b, "prefix garbage: %d bytes\n", d.PrefixGarbageLength)
+	fmt.Fprintf(&b, "garbage: %d bytes\n", d.GarbageLength)
+	fmt.Fprintf(&b, "early EOF: %v\n", d.EarlyEOF)
+	fmt.Fprintf(&b, "blocks with explicit zero runs: %d\n", d.ExplicitZeroRuns)
+
+	if l := d.Lepton; l != nil {
+		fmt.Fprintf(&b, "lepton version: %d, encoder version %d, git revision %08x\n", l.Version, l.EncoderVersion, l.GitRevision)
+		fmt.Fprintf(&b, "original file size: %d\n", l.OriginalFileSize)
+		fmt.Fprintf(&b, "16-bit DC estimate: %v, 16-bit advanced prediction: %v\n", l.Use16BitDCEstimate, l.Use16BitAdvPredict)
+		b.WriteString("partitions:\n")
+		for i, p := range l.Partitions {
+			fmt.Fprintf(&b, "  %d: luma rows %d-%d, %d bytes, overhang %d bits of %02x, last DC %s\n",
+				i, p.LumaYStart, p.LumaYEnd, p.SegmentSize, p.NumOverhangBits, p.OverhangByte, joinInts(p.LastDC[:]))
+		}
+		if len(l.RestartCounts) > 0 {
+			fmt.Fprintf(&b, "restart counts: %s\n", joinInts(l.RestartCounts))
+		}
+		if len(l.RestartErrors) > 0 {
+			fmt.Fprintf(&b, "restart errors: %s\n", joinInts(l.RestartErrors))
+		}
+	}
+
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return err
+	}
+
+	// The coefficients can be large, so they are written one block at a time
+	for i, blocks := range d.Coefficients {
+		if _, err := fmt.Fprintf(w, "component %d\n", i); err != nil {
+			return err
+		}
+		for dpos := range blocks {
+			if _, err := fmt.Fprintf(w, "dpos=%d %s\n", dpos, joinInts(blocks[dpos][:])); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// joinInts formats a list of integers separated by commas
+func joinInts[T uint8 | uint16 | int16 | uint32 | int](values []T) string {
+	var b strings.Builder
+	for i, v := range values {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprint(&b, v)
+	}
+	return b.String()
+}
@@ -3,22 +3,84 @@ package lepton
 import (
 	"bytes"
 	"compress/zlib"
+	"context"
 	"encoding/binary"
+	"fmt"
 	"io"
+	"sort"
+	"sync"
 )
 
 // Encode compresses a JPEG image to Lepton format
 func Encode(reader io.Reader, writer io.Writer) error {
-	// Read all JPEG data (needed for header size)
-	jpegData, err := io.ReadAll(reader)
-	if err != nil {
-		return err
+	return EncodeWithOptions(reader, writer, nil)
+}
+
+// EncodeWithOptions compresses a JPEG image to Lepton format using the given
+// options. A nil opts uses CompatLeptonVectorWrite.
+func EncodeWithOptions(reader io.Reader, writer io.Writer, opts *Options) error {
+	_, err := EncodeStream(reader, writer, opts)
+	return err
+}
+
+// EncodeStream is like EncodeWithOptions but also returns the number of bytes
+// of reader that make up the JPEG. With StopReadingAtEOI this compresses a
+// JPEG embedded in a larger stream: reading stops at the EOI marker and
+// reader is left positioned right after it, see ReadJpegFileWithOptions.
+func EncodeStream(reader io.Reader, writer io.Writer, opts *Options) (int64, error) {
+	return encodeStream(context.Background(), reader, writer, opts)
+}
+
+// EncodeContext is like EncodeWithOptions but stops with the error of ctx once
+// it is cancelled. Cancellation is checked after every row of blocks that is
+// coded, so the work for a large image can be abandoned early.
+func EncodeContext(ctx context.Context, reader io.Reader, writer io.Writer, opts *Options) error {
+	_, err := encodeStream(ctx, reader, writer, opts)
+	return err
+}
+
+// encodeStream implements EncodeStream and EncodeContext
+func encodeStream(ctx context.Context, reader io.Reader, writer io.Writer, opts *Options) (_ int64, err error) {
+	defer recoverPanic(&err)
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if opts == nil {
+		opts = CompatLeptonVectorWrite()
+	}
+
+	rewind := func(read, used int64) error { return nil }
+	if opts.StopReadingAtEOI {
+		reader, rewind = newStopAtEOIReader(reader)
 	}
 
-	// Parse the JPEG
-	jpegResult, err := ReadJpegFile(bytes.NewReader(jpegData))
+	// Parse the JPEG, reading at most one byte past the size limit so that
+	// oversized files are detected without buffering them entirely. The input
+	// is kept until it is known whether the result needs to be verified.
+	// Data following a JPEG that stops at EOI may be read ahead up to the limit.
+	limited := &io.LimitedReader{R: reader, N: int64(opts.MaxJpegFileSize) + 1}
+	var original bytes.Buffer
+	jpegResult, err := readJpegFile(io.TeeReader(limited, &original), opts)
+	if (limited.N == 0 && (err != nil || !opts.StopReadingAtEOI)) || (err == nil && jpegResult.BytesRead > int64(opts.MaxJpegFileSize)) {
+		return 0, NewLeptonError(ExitCodeUnsupportedJpeg, "file is too large to encode, increase MaxJpegFileSize")
+	}
 	if err != nil {
-		return err
+		return 0, err
+	}
+	jpegFileSize := jpegResult.BytesRead
+	if err := rewind(int64(original.Len()), jpegFileSize); err != nil {
+		return 0, err
+	}
+
+	// A truncated progressive scan ends in the middle of a symbol that the
+	// decoder can only recreate if the coefficients read past the end happen
+	// to encode the same way, so those files are verified before they are written.
+	// So are arithmetic coded files, which only come out the same if they were
+	// terminated and padded the way libjpeg does it.
+	verifyTruncated := jpegResult.EarlyEOF && jpegResult.Header.JpegType == JpegTypeProgressive
+	verify := verifyTruncated || jpegResult.Header.Arithmetic
+	if !verify {
+		original = bytes.Buffer{}
 	}
 
 	// Create quantization tables
@@ -28,94 +90,288 @@ func Encode(reader io.Reader, writer io.Writer) error {
 		quantizationTables[i] = NewQuantizationTables(jpegResult.Header.QTables[qtIdx])
 	}
 
-	// Calculate luma height for encoding
-	lumaHeight := jpegResult.Header.CmpInfo[0].Bcv
-
-	// Create a single thread handoff for the entire image
-	handoff := ThreadHandoff{
-		LumaYStart:      0,
-		LumaYEnd:        lumaHeight,
-		SegmentSize:     0, // Will be filled in after encoding
-		OverhangByte:    0,
-		NumOverhangBits: 0,
-	}
+	// Split the scan into partitions that can be encoded independently
+	handoffs := splitRowHandoffsToThreads(buildThreadHandoffs(jpegResult), int(opts.MaxPartitions))
 
 	// Set up header flags
-	jpegResult.Header.Use16BitDCEstimate = true
-	jpegResult.Header.Use16BitAdvPredict = true
+	jpegResult.Header.Use16BitDCEstimate = opts.Use16BitDCEstimate
+	jpegResult.Header.Use16BitAdvPredict = opts.Use16BitAdvPredict
 
-	// Encode the image data to a buffer first so we know the size
-	var encodedData bytes.Buffer
-	encoder, err := NewLeptonEncoder(&encodedData, jpegResult.Header)
+	// Encode each partition with its own model into a separate buffer
+	progress := newProgressTracker(ctx, opts.Progress, jpegResult.Header, len(handoffs))
+	partitionData, err := encodePartitions(jpegResult, quantizationTables, handoffs, opts.processorThreads(len(handoffs)), opts.Metrics, progress)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	if err := encoder.EncodeRowRange(
-		quantizationTables,
-		jpegResult.ImageData,
-		0,
-		lumaHeight,
-	); err != nil {
-		return err
-	}
+	// Interleave the partition streams into the multiplexed format
+	multiplexedData := multiplexPartitions(partitionData)
 
-	if err := encoder.Finish(); err != nil {
-		return err
+	output := writer
+	var leptonData bytes.Buffer
+	if verify {
+		output = &leptonData
 	}
 
-	// Now multiplex the encoded data (for single thread, simple format)
-	multiplexedData := multiplexSingleThread(encodedData.Bytes())
-
 	// Write Lepton header (includes CMP marker)
-	headerSize, compressedHeaderSize, err := writeLeptonHeader(writer, jpegResult, []ThreadHandoff{handoff}, len(jpegData))
+	headerSize, compressedHeaderSize, err := writeLeptonHeader(output, jpegResult, handoffs, int(jpegFileSize))
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	// Write the multiplexed data
-	if _, err := writer.Write(multiplexedData); err != nil {
-		return err
+	if _, err := output.Write(multiplexedData); err != nil {
+		return 0, err
 	}
 
 	// Write final file size
 	// Total size = 28 (fixed header) + compressed header + 3 (CMP) + multiplexed data + 4 (footer)
 	finalSize := uint32(28 + compressedHeaderSize + 3 + len(multiplexedData) + 4)
 	_ = headerSize // unused but kept for clarity
-	if err := binary.Write(writer, binary.LittleEndian, finalSize); err != nil {
-		return err
+	if err := binary.Write(output, binary.LittleEndian, finalSize); err != nil {
+		return 0, err
+	}
+
+	if verify {
+		var decoded bytes.Buffer
+		if err := DecodeContext(ctx, bytes.NewReader(leptonData.Bytes()), &decoded, nil); err != nil {
+			return 0, err
+		}
+		if !bytes.Equal(decoded.Bytes(), original.Bytes()[:jpegFileSize]) {
+			if !verifyTruncated {
+				return 0, NewLeptonError(ExitCodeUnsupportedJpeg, "arithmetic coded image cannot be recreated")
+			}
+			return 0, NewLeptonError(ExitCodeUnsupportedJpeg, "truncated progressive image cannot be recreated")
+		}
+		if _, err := writer.Write(leptonData.Bytes()); err != nil {
+			return 0, err
+		}
 	}
 
-	return nil
+	return jpegFileSize, nil
 }
 
-// multiplexSingleThread wraps encoded data in the multiplexer format for a single thread
-func multiplexSingleThread(data []byte) []byte {
-	var result bytes.Buffer
+// encodePartitions encodes the thread handoffs on a pool of maxThreads
+// goroutines, each partition with its own model, and returns the encoded
+// stream of each partition in order. The statistics of all partitions are
+// added to metrics if it is not nil. Coded rows and partitions are reported
+// to progress, which also ends the encode once its context is cancelled.
+func encodePartitions(jpegResult *JpegReadResult, quantizationTables []*QuantizationTables, handoffs []ThreadHandoff, maxThreads int, metrics *Metrics, progress *progressTracker) ([][]byte, error) {
+	results := make([][]byte, len(handoffs))
+	errs := make([]error, len(handoffs))
+	partitionMetrics := newPartitionMetrics(metrics, len(handoffs))
+
+	encodePartition := func(i int) (err error) {
+		defer recoverPanic(&err)
+		var encodedData bytes.Buffer
+		encoder, err := NewLeptonEncoder(&encodedData, jpegResult.Header)
+		if err != nil {
+			return err
+		}
+		encoder.progress = progress
+		if partitionMetrics != nil {
+			defer partitionMetrics[i].startWorker()()
+			encoder.boolWriter.metrics = &partitionMetrics[i]
+		}
+
+		// The last partition runs to the end of the image
+		lumaYEnd := handoffs[i].LumaYEnd
+		if i == len(handoffs)-1 {
+			lumaYEnd = jpegResult.Header.CmpInfo[0].Bcv
+		}
+
+		if err := encoder.EncodeRowRange(
+			quantizationTables,
+			jpegResult.ImageData,
+			handoffs[i].LumaYStart,
+			lumaYEnd,
+			jpegResult.MaxDPos,
+			jpegResult.EarlyEOF,
+		); err != nil {
+			return fmt.Errorf("failed to encode thread %d: %w", i, err)
+		}
+
+		if err := encoder.Finish(); err != nil {
+			return err
+		}
+
+		results[i] = encodedData.Bytes()
+		progress.partitionDone()
+		return nil
+	}
+
+	work := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < maxThreads; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				errs[i] = encodePartition(i)
+			}
+		}()
+	}
+
+	for i := range handoffs {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	mergePartitionMetrics(metrics, partitionMetrics)
+
+	return results, nil
+}
+
+// buildThreadHandoffs converts the per-MCU-row partitions recorded while
+// reading the JPEG into thread handoffs with their segment sizes
+func buildThreadHandoffs(jpegResult *JpegReadResult) []ThreadHandoff {
+	partitions := jpegResult.Partitions
+	if len(partitions) == 0 {
+		// Nothing was recorded, so cover the whole image with one handoff
+		return []ThreadHandoff{{
+			LumaYStart: 0,
+			LumaYEnd:   jpegResult.Header.CmpInfo[0].Bcv,
+		}}
+	}
 
-	// For single-thread encoding, we wrap data in variable-length blocks
-	// Header byte format: lower 4 bits = thread ID (0), upper 4 bits = 0 for variable length
-	// Followed by 2 bytes little-endian length-1
-	pos := 0
-	for pos < len(data) {
-		// Use blocks of up to 65536 bytes
-		blockSize := len(data) - pos
-		if blockSize > 65536 {
-			blockSize = 65536
+	handoffs := make([]ThreadHandoff, len(partitions))
+	for i, p := range partitions {
+		// Each segment runs to the start of the next one, the last to the end of the scan
+		end := jpegResult.EndScanPosition
+		if i+1 < len(partitions) {
+			end = partitions[i+1].Position
 		}
+		segmentSize := end - p.Position
+		if segmentSize < 0 {
+			segmentSize = 0
+		}
+
+		handoffs[i] = ThreadHandoff{
+			LumaYStart:      p.LumaYStart,
+			LumaYEnd:        p.LumaYEnd,
+			SegmentSize:     uint32(segmentSize),
+			OverhangByte:    p.OverhangByte,
+			NumOverhangBits: p.NumOverhangBits,
+			LastDC:          p.LastDC,
+		}
+	}
+
+	return handoffs
+}
+
+// combineThreadRanges merges the consecutive handoffs from..to into a single handoff
+func combineThreadRanges(handoffs []ThreadHandoff, from, to int) ThreadHandoff {
+	var segmentSize uint32
+	for i := from; i <= to; i++ {
+		segmentSize += handoffs[i].SegmentSize
+	}
+
+	return ThreadHandoff{
+		LumaYStart:      handoffs[from].LumaYStart,
+		LumaYEnd:        handoffs[to].LumaYEnd,
+		SegmentSize:     segmentSize,
+		OverhangByte:    handoffs[from].OverhangByte,
+		NumOverhangBits: handoffs[from].NumOverhangBits,
+		LastDC:          handoffs[from].LastDC,
+	}
+}
+
+// splitRowHandoffsToThreads groups the per-row handoffs into at most
+// maxThreads evenly sized partitions
+func splitRowHandoffsToThreads(handoffs []ThreadHandoff, maxThreads int) []ThreadHandoff {
+	numRows := len(handoffs)
+	framebufferByteSize := int(combineThreadRanges(handoffs, 0, numRows-1).SegmentSize)
+	numThreads := getNumberOfThreadsForEncoding(numRows, framebufferByteSize, maxThreads)
 
-		// Write header byte (thread 0, variable length)
-		result.WriteByte(0)
+	if numThreads == 1 {
+		return []ThreadHandoff{combineThreadRanges(handoffs, 0, numRows-1)}
+	}
+
+	// rowsPerThread is a floating point value to ensure equal splits
+	rowsPerThread := float32(numRows) / float32(numThreads)
+
+	selected := make([]ThreadHandoff, 0, numThreads)
+	beginning := 0
+	for i := 0; i < numThreads; i++ {
+		end := numRows - 1
+		if i < numThreads-1 {
+			end = int(rowsPerThread * float32(i+1))
+		}
+		selected = append(selected, combineThreadRanges(handoffs, beginning, end))
+		beginning = end + 1
+	}
+
+	return selected
+}
+
+// getNumberOfThreadsForEncoding picks the partition count based on the number
+// of rows and the size of the scan, so small images are not split needlessly.
+// There is always at least one partition, even if maxThreads is zero.
+func getNumberOfThreadsForEncoding(numRows, framebufferByteSize, maxThreads int) int {
+	numThreads := max(min(maxThreads, MaxThreadsSupportedByLeptonFormat), 1)
+
+	if numRows/2 < numThreads {
+		numThreads = max(numRows/2, 1)
+	}
+
+	if framebufferByteSize < SmallFileBytesPerEncodingThread {
+		numThreads = 1
+	} else if framebufferByteSize < SmallFileBytesPerEncodingThread*2 {
+		numThreads = min(2, numThreads)
+	} else if framebufferByteSize < SmallFileBytesPerEncodingThread*4 {
+		numThreads = min(4, numThreads)
+	}
 
-		// Write length-1 in little endian
-		lenMinus1 := uint16(blockSize - 1)
-		result.WriteByte(byte(lenMinus1 & 0xff))
-		result.WriteByte(byte(lenMinus1 >> 8))
+	return numThreads
+}
 
-		// Write data
-		result.Write(data[pos : pos+blockSize])
+// multiplexPartitions interleaves the encoded partition streams round-robin
+// in blocks of up to 64KB, each tagged with its partition id
+func multiplexPartitions(partitions [][]byte) []byte {
+	var result bytes.Buffer
 
-		pos += blockSize
+	const maxBlockSize = 65536
+	offsets := make([]int, len(partitions))
+
+	for remaining := true; remaining; {
+		remaining = false
+		for tid, data := range partitions {
+			pos := offsets[tid]
+			if pos >= len(data) {
+				continue
+			}
+
+			blockSize := len(data) - pos
+			if blockSize > maxBlockSize {
+				blockSize = maxBlockSize
+			}
+
+			// Header byte: lower 4 bits = partition id. Full 64KB blocks use the
+			// fixed length encoding in the upper bits, otherwise the next
+			// 2 bytes are length-1 in little endian
+			if blockSize == maxBlockSize {
+				result.WriteByte(byte(tid) | 3<<4)
+			} else {
+				lenMinus1 := uint16(blockSize - 1)
+				result.WriteByte(byte(tid))
+				result.WriteByte(byte(lenMinus1 & 0xff))
+				result.WriteByte(byte(lenMinus1 >> 8))
+			}
+
+			result.Write(data[pos : pos+blockSize])
+
+			offsets[tid] = pos + blockSize
+			if offsets[tid] < len(data) {
+				remaining = true
+			}
+		}
 	}
 
 	return result.Bytes()
@@ -161,6 +417,52 @@ func writeLeptonHeader(writer io.Writer, result *JpegReadResult, handoffs []Thre
 		}
 	}
 
+	// CRS marker + number of RST markers in the scan, needed when some restart
+	// intervals have no marker or when trailing markers follow the scan
+	if result.MissingRestarts || result.TrailingRestarts > 0 {
+		headerData.Write(LeptonHeaderJpgRestartsMarker[:])
+		binary.Write(&headerData, binary.LittleEndian, uint32(1))
+		binary.Write(&headerData, binary.LittleEndian, result.RestartCount)
+	}
+
+	// FRS marker + number of RST markers that follow the scan
+	if result.TrailingRestarts > 0 {
+		headerData.Write(LeptonHeaderJpgRestartErrorsMarker[:])
+		binary.Write(&headerData, binary.LittleEndian, uint32(1))
+		headerData.WriteByte(byte(result.TrailingRestarts))
+	}
+
+	// EEE marker + how far the scans of a truncated image reach and the last
+	// position that is coded for each component
+	if result.EarlyEOF {
+		headerData.Write(LeptonHeaderEarlyEofMarker[:])
+		binary.Write(&headerData, binary.LittleEndian, result.MaxCmp)
+		binary.Write(&headerData, binary.LittleEndian, result.MaxBpos)
+		binary.Write(&headerData, binary.LittleEndian, uint32(result.MaxSah))
+		for i := 0; i < MaxComponents; i++ {
+			binary.Write(&headerData, binary.LittleEndian, result.MaxDPos[i])
+		}
+	}
+
+	// ZRL marker + blocks that end with explicit zero runs, ordered by
+	// component and block position
+	if result.ExplicitZeroRuns.Len() > 0 {
+		headerData.Write(LeptonHeaderZeroRunMarker[:])
+		binary.Write(&headerData, binary.LittleEndian, uint32(result.ExplicitZeroRuns.Len()))
+		for cmp, blocks := range result.ExplicitZeroRuns {
+			positions := make([]uint32, 0, len(blocks))
+			for dpos := range blocks {
+				positions = append(positions, dpos)
+			}
+			sort.Slice(positions, func(i, j int) bool { return positions[i] < positions[j] })
+			for _, dpos := range positions {
+				headerData.WriteByte(byte(cmp))
+				binary.Write(&headerData, binary.LittleEndian, dpos)
+				headerData.WriteByte(blocks[dpos])
+			}
+		}
+	}
+
 	// GRB marker + garbage data (always include EOI if no garbage)
 	garbage := result.GarbageData
 	if len(garbage) == 0 {
@@ -170,6 +472,13 @@ func writeLeptonHeader(writer io.Writer, result *JpegReadResult, handoffs []Thre
 	binary.Write(&headerData, binary.LittleEndian, uint32(len(garbage)))
 	headerData.Write(garbage)
 
+	// PGR marker + data that preceded the SOI marker
+	if len(result.PrefixGarbage) > 0 {
+		headerData.Write(LeptonHeaderPrefixGarbageMarker[:])
+		binary.Write(&headerData, binary.LittleEndian, uint32(len(result.PrefixGarbage)))
+		headerData.Write(result.PrefixGarbage)
+	}
+
 	// Compress the header
 	var compressedHeader bytes.Buffer
 	zlibWriter := zlib.NewWriter(&compressedHeader)
@@ -205,8 +514,15 @@ func writeLeptonHeader(writer io.Writer, result *JpegReadResult, handoffs []Thre
 	// Bytes 10-13: Uncompressed header size
 	binary.LittleEndian.PutUint32(fixedHeader[10:14], uint32(headerData.Len()))
 
-	// Byte 14: Flags (0x83 = 0x80 | 0x01 | 0x02 for both 16-bit options)
-	fixedHeader[14] = 0x83
+	// Byte 14: Flags (0x80 = flags present, 0x01 = 16-bit DC estimate, 0x02 = 16-bit adv predict)
+	flags := byte(0x80)
+	if result.Header.Use16BitDCEstimate {
+		flags |= 0x01
+	}
+	if result.Header.Use16BitAdvPredict {
+		flags |= 0x02
+	}
+	fixedHeader[14] = flags
 
 	// Byte 15: Encoder version
 	fixedHeader[15] = 0x01
@@ -251,20 +567,37 @@ func (w *countingWriter) Write(p []byte) (int, error) {
 
 // EncodeVerify encodes JPEG to Lepton and verifies by decoding back
 func EncodeVerify(jpegData []byte) ([]byte, error) {
-	var leptonData bytes.Buffer
+	return EncodeVerifyWithOptions(jpegData, nil)
+}
+
+// EncodeVerifyWithOptions is like EncodeVerify but encodes and decodes using
+// the given options. A nil opts uses CompatLeptonVectorWrite. Only the encode
+// is recorded in opts.Metrics and reported to opts.Progress.
+func EncodeVerifyWithOptions(jpegData []byte, opts *Options) ([]byte, error) {
+	if opts == nil {
+		opts = CompatLeptonVectorWrite()
+	}
 
-	if err := Encode(bytes.NewReader(jpegData), &leptonData); err != nil {
+	var leptonData bytes.Buffer
+	if err := EncodeWithOptions(bytes.NewReader(jpegData), &leptonData, opts); err != nil {
 		return nil, err
 	}
 
-	// Verify by decoding
-	decoded, err := DecodeLeptonBytes(leptonData.Bytes())
-	if err != nil {
+	// Verify by decoding, without counting the decode in the metrics
+	decodeOpts := *opts
+	decodeOpts.Metrics = nil
+	decodeOpts.Progress = nil
+	var decoded bytes.Buffer
+	if err := DecodeWithOptions(bytes.NewReader(leptonData.Bytes()), &decoded, &decodeOpts); err != nil {
 		return nil, err
 	}
 
 	// Compare
-	if !bytes.Equal(jpegData, decoded) {
+	if decoded.Len() != len(jpegData) {
+		return nil, NewLeptonError(ExitCodeVerificationLengthMismatch,
+			fmt.Sprintf("verification failed: decoded %d bytes, expected %d", decoded.Len(), len(jpegData)))
+	}
+	if !bytes.Equal(jpegData, decoded.Bytes()) {
 		return nil, NewLeptonError(ExitCodeVerificationContentMismatch, "verification failed")
 	}
 
@@ -1,9 +1,16 @@
 package lepton
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -208,6 +215,7 @@ func TestEncodeVerify(t *testing.T) {
 		"tiny",
 		"android",
 		"iphone",
+		"truncatedzerorun",
 	}
 
 	imagesDir := "../rust/images"
@@ -238,6 +246,953 @@ func TestEncodeVerify(t *testing.T) {
 	}
 }
 
+// TestEncodeMultiplePartitions tests that large images are split into
+// several partitions and still roundtrip
+func TestEncodeMultiplePartitions(t *testing.T) {
+	testCases := []struct {
+		name    string
+		threads int
+	}{
+		{"iphonecity", 8},
+		{"slrhills", 8},
+		{"iphonecrop", 4},
+		{"truncate4", 2},
+	}
+
+	imagesDir := "../rust/images"
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			jpegPath := filepath.Join(imagesDir, tc.name+".jpg")
+
+			if _, err := os.Stat(jpegPath); os.IsNotExist(err) {
+				t.Fatalf("JPEG file not found: %s", jpegPath)
+			}
+
+			originalJpeg, err := os.ReadFile(jpegPath)
+			if err != nil {
+				t.Fatalf("Failed to read original JPEG: %v", err)
+			}
+
+			var leptonData bytes.Buffer
+			if err := Encode(bytes.NewReader(originalJpeg), &leptonData); err != nil {
+				t.Fatalf("Failed to encode to Lepton: %v", err)
+			}
+
+			header, err := ReadLeptonHeader(bytes.NewReader(leptonData.Bytes()))
+			if err != nil {
+				t.Fatalf("Failed to read Lepton header: %v", err)
+			}
+			if len(header.ThreadHandoffs) != tc.threads {
+				t.Errorf("Thread count: got %d, expected %d", len(header.ThreadHandoffs), tc.threads)
+			}
+
+			decodedJpeg, err := DecodeLeptonBytes(leptonData.Bytes())
+			if err != nil {
+				t.Fatalf("Failed to decode Lepton: %v", err)
+			}
+
+			if !bytes.Equal(decodedJpeg, originalJpeg) {
+				t.Errorf("Roundtrip mismatch: decoded %d bytes, original %d bytes",
+					len(decodedJpeg), len(originalJpeg))
+			}
+		})
+	}
+}
+
+// TestEncodeWithOptions tests that the encoder honours the options
+func TestEncodeWithOptions(t *testing.T) {
+	imagesDir := "../rust/images"
+
+	readImage := func(name string) []byte {
+		data, err := os.ReadFile(filepath.Join(imagesDir, name+".jpg"))
+		if err != nil {
+			t.Fatalf("Failed to read original JPEG: %v", err)
+		}
+		return data
+	}
+
+	roundtrip := func(t *testing.T, jpeg []byte, encodeOpts, decodeOpts *Options) []byte {
+		var leptonData bytes.Buffer
+		if err := EncodeWithOptions(bytes.NewReader(jpeg), &leptonData, encodeOpts); err != nil {
+			t.Fatalf("Failed to encode to Lepton: %v", err)
+		}
+
+		var output bytes.Buffer
+		if err := DecodeWithOptions(bytes.NewReader(leptonData.Bytes()), &output, decodeOpts); err != nil {
+			t.Fatalf("Failed to decode Lepton: %v", err)
+		}
+		return output.Bytes()
+	}
+
+	t.Run("scalar", func(t *testing.T) {
+		original := readImage("mathoverflow")
+		opts := CompatLeptonVectorWrite()
+		opts.Use16BitDCEstimate = false
+		opts.Use16BitAdvPredict = false
+
+		if !bytes.Equal(roundtrip(t, original, opts, CompatLeptonVectorRead()), original) {
+			t.Error("Roundtrip with 32-bit math does not match original")
+		}
+	})
+
+	t.Run("single_partition", func(t *testing.T) {
+		original := readImage("iphonecity")
+		opts := CompatLeptonVectorWrite()
+		opts.MaxPartitions = 1
+		opts.MaxProcessorThreads = 1
+
+		var leptonData bytes.Buffer
+		if err := EncodeWithOptions(bytes.NewReader(original), &leptonData, opts); err != nil {
+			t.Fatalf("Failed to encode to Lepton: %v", err)
+		}
+		if threads := leptonData.Bytes()[4]; threads != 1 {
+			t.Errorf("Thread count: got %d, expected 1", threads)
+		}
+	})
+
+	t.Run("four_components", func(t *testing.T) {
+		original := readImage("fourcolorchannels")
+		opts := CompatLeptonVectorWrite()
+		opts.AllowFourComponents = true
+
+		if !bytes.Equal(roundtrip(t, original, opts, nil), original) {
+			t.Error("Roundtrip of the CMYK image does not match original")
+		}
+	})
+
+	t.Run("zero_partitions", func(t *testing.T) {
+		original := readImage("iphonecity")
+		opts := CompatLeptonVectorWrite()
+		opts.MaxPartitions = 0
+
+		if !bytes.Equal(roundtrip(t, original, opts, nil), original) {
+			t.Error("Roundtrip with MaxPartitions 0 does not match original")
+		}
+	})
+
+	t.Run("stop_reading_at_eoi", func(t *testing.T) {
+		original := readImage("iphone")
+		withTrailer := append(append([]byte{}, original...), []byte("trailing data")...)
+		opts := CompatLeptonVectorWrite()
+		opts.StopReadingAtEOI = true
+
+		if !bytes.Equal(roundtrip(t, withTrailer, opts, nil), original) {
+			t.Error("Roundtrip does not match the JPEG before the trailing data")
+		}
+	})
+
+	t.Run("stop_reading_at_eoi_stream", func(t *testing.T) {
+		opts := CompatLeptonVectorWrite()
+		opts.StopReadingAtEOI = true
+
+		// Several images back to back, as in an MJPEG stream
+		images := [][]byte{readImage("iphone"), readImage("iphoneprogressive"), readImage("tiny")}
+		var stream []byte
+		for _, image := range images {
+			stream = append(stream, image...)
+		}
+		stream = append(stream, []byte("trailing data")...)
+
+		readers := map[string]func() io.Reader{
+			"seeker":     func() io.Reader { return bytes.NewReader(stream) },
+			"not_seeker": func() io.Reader { return bufio.NewReader(bytes.NewBuffer(stream)) },
+			"pipe": func() io.Reader {
+				// An *os.File that cannot seek
+				r, w, err := os.Pipe()
+				if err != nil {
+					t.Fatalf("Failed to create pipe: %v", err)
+				}
+				t.Cleanup(func() { r.Close() })
+				go func() {
+					w.Write(stream)
+					w.Close()
+				}()
+				return r
+			},
+		}
+		for name, newReader := range readers {
+			t.Run(name, func(t *testing.T) {
+				reader := newReader()
+				for i, image := range images {
+					var leptonData bytes.Buffer
+					n, err := EncodeStream(reader, &leptonData, opts)
+					if err != nil {
+						t.Fatalf("Image %d: EncodeStream failed: %v", i, err)
+					}
+					if n != int64(len(image)) {
+						t.Errorf("Image %d: consumed %d bytes, expected %d", i, n, len(image))
+					}
+
+					decoded, err := DecodeLeptonBytes(leptonData.Bytes())
+					if err != nil {
+						t.Fatalf("Image %d: DecodeLeptonBytes failed: %v", i, err)
+					}
+					if !bytes.Equal(decoded, image) {
+						t.Errorf("Image %d: roundtrip mismatch", i)
+					}
+				}
+
+				rest, err := io.ReadAll(reader)
+				if err != nil {
+					t.Fatalf("Failed to read the rest of the stream: %v", err)
+				}
+				if string(rest) != "trailing data" {
+					t.Errorf("Reader left at %q, expected the trailing data", rest)
+				}
+			})
+		}
+	})
+
+	rejections := []struct {
+		name   string
+		image  string
+		modify func(*Options)
+		code   ExitCode
+	}{
+		{"progressive", "androidprogressive", func(o *Options) { o.Progressive = false }, ExitCodeProgressiveUnsupported},
+		{"width", "iphone", func(o *Options) { o.MaxJpegWidth = 64 }, ExitCodeUnsupportedJpeg},
+		{"height", "iphone", func(o *Options) { o.MaxJpegHeight = 64 }, ExitCodeUnsupportedJpeg},
+		{"file_size", "iphone", func(o *Options) { o.MaxJpegFileSize = 1000 }, ExitCodeUnsupportedJpeg},
+		{"truncated", "truncate4", func(o *Options) { o.StopReadingAtEOI = true }, ExitCodeShortRead},
+		{"four_components", "fourcolorchannels", func(o *Options) {}, ExitCodeUnsupported4Colors},
+	}
+
+	for _, tc := range rejections {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := CompatLeptonVectorWrite()
+			tc.modify(opts)
+
+			err := EncodeWithOptions(bytes.NewReader(readImage(tc.image)), io.Discard, opts)
+			expectExitCode(t, err, tc.code)
+		})
+	}
+}
+
+// removeRestartMarkers returns a copy of jpeg without the RST markers that
+// follow the first keep markers of the last scan
+func removeRestartMarkers(jpeg []byte, keep int) []byte {
+	sos := bytes.LastIndex(jpeg, []byte{0xFF, MarkerSOS})
+	result := append([]byte{}, jpeg[:sos]...)
+	seen := 0
+	for i := sos; i < len(jpeg); i++ {
+		if i+1 < len(jpeg) && jpeg[i] == 0xFF && jpeg[i+1] >= MarkerRST0 && jpeg[i+1] <= MarkerRST7 {
+			seen++
+			if seen > keep {
+				i++
+				continue
+			}
+		}
+		result = append(result, jpeg[i])
+	}
+	return result
+}
+
+// TestEncodeRestartMarkers tests that scans with restart intervals that end
+// without an RST marker, and RST markers after the scan, roundtrip through
+// the CRS and FRS sections
+func TestEncodeRestartMarkers(t *testing.T) {
+	imagesDir := "../rust/images"
+
+	readImage := func(name string) []byte {
+		data, err := os.ReadFile(filepath.Join(imagesDir, name+".jpg"))
+		if err != nil {
+			t.Fatalf("Failed to read original JPEG: %v", err)
+		}
+		return data
+	}
+
+	iphonecrop := readImage("iphonecrop")
+	eoi := bytes.LastIndex(iphonecrop, EOI[:])
+	withTrailer := func(trailer ...byte) []byte {
+		result := append([]byte{}, iphonecrop[:eoi]...)
+		result = append(result, trailer...)
+		return append(result, iphonecrop[eoi:]...)
+	}
+
+	testCases := []struct {
+		name          string
+		jpeg          []byte
+		restartCounts []uint32
+		restartErrors []int
+	}{
+		{"narrowrst", readImage("narrowrst"), []uint32{94}, nil},
+		{"nofsync", readImage("nofsync"), []uint32{1}, nil},
+		{"trailingrst", readImage("trailingrst"), []uint32{152}, []int{2}},
+		{"trailingrst_missing_in_jpg", readImage("trailingrst_missing_in_jpg"), []uint32{152}, []int{1}},
+		{"no_markers", removeRestartMarkers(iphonecrop, 0), []uint32{0}, nil},
+		{"missing_markers", removeRestartMarkers(iphonecrop, 10), []uint32{10}, nil},
+		{"trailing_markers", withTrailer(0xFF, 0xD3, 0xFF, 0xD4), []uint32{27}, []int{2}},
+		{"misnumbered_trailing_marker", withTrailer(0xFF, 0xD5), nil, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var leptonData bytes.Buffer
+			if err := Encode(bytes.NewReader(tc.jpeg), &leptonData); err != nil {
+				t.Fatalf("Failed to encode to Lepton: %v", err)
+			}
+
+			header, err := ReadLeptonHeader(bytes.NewReader(leptonData.Bytes()))
+			if err != nil {
+				t.Fatalf("Failed to read Lepton header: %v", err)
+			}
+			if fmt.Sprint(header.RecoveryInfo.RestartCounts) != fmt.Sprint(tc.restartCounts) {
+				t.Errorf("Restart counts: got %v, expected %v", header.RecoveryInfo.RestartCounts, tc.restartCounts)
+			}
+			if fmt.Sprint(header.RecoveryInfo.RestartErrors) != fmt.Sprint(tc.restartErrors) {
+				t.Errorf("Restart errors: got %v, expected %v", header.RecoveryInfo.RestartErrors, tc.restartErrors)
+			}
+
+			decodedJpeg, err := DecodeLeptonBytes(leptonData.Bytes())
+			if err != nil {
+				t.Fatalf("Failed to decode Lepton: %v", err)
+			}
+			if !bytes.Equal(decodedJpeg, tc.jpeg) {
+				t.Error("Roundtrip does not match original")
+			}
+		})
+	}
+
+	// An RST marker within a restart interval can't be represented
+	_, err := EncodeVerify(readImage("roundtripfail"))
+	expectExitCode(t, err, ExitCodeInvalidResetCode)
+}
+
+// TestEncodeTruncated tests that JPEGs cut off at various points are stored
+// with an EEE section and roundtrip
+func TestEncodeTruncated(t *testing.T) {
+	imagesDir := "../rust/images"
+
+	readImage := func(name string) []byte {
+		data, err := os.ReadFile(filepath.Join(imagesDir, name+".jpg"))
+		if err != nil {
+			t.Fatalf("Failed to read original JPEG: %v", err)
+		}
+		return data
+	}
+	cut := func(data []byte, numerator, denominator int) []byte {
+		return data[:len(data)*numerator/denominator]
+	}
+
+	iphone := readImage("iphone")
+	narrowrst := readImage("narrowrst")
+	iphoneprogressive := readImage("iphoneprogressive")
+	androidprogressive := readImage("androidprogressive")
+	fourcolorchannels := readImage("fourcolorchannels")
+	arithmeticSequential := readImage("arithmetic_sequential_restarts")
+	arithmeticProgressive := readImage("arithmetic_progressive_gray")
+
+	// Position of the SOS marker of the second progressive scan
+	secondScan := bytes.Index(iphoneprogressive, []byte{0xFF, MarkerSOS})
+	secondScan += bytes.Index(iphoneprogressive[secondScan+2:], []byte{0xFF, MarkerSOS}) + 2
+
+	testCases := []struct {
+		name     string
+		jpeg     []byte
+		earlyEOF bool
+	}{
+		{"truncatedzerorun", readImage("truncatedzerorun"), true},
+		{"baseline_quarter", cut(iphone, 1, 4), true},
+		{"baseline_half", cut(iphone, 1, 2), true},
+		{"baseline_near_end", iphone[:len(iphone)-10], true},
+		{"baseline_narrow_restart_intervals", cut(narrowrst, 1, 2), true},
+		{"baseline_cmyk", cut(fourcolorchannels, 1, 2), true},
+		{"progressive_first_scan", cut(iphoneprogressive, 1, 10), true},
+		{"progressive_quarter", cut(iphoneprogressive, 1, 4), true},
+		{"progressive_refinement", cut(androidprogressive, 9, 20), true},
+		{"progressive_between_scans", iphoneprogressive[:secondScan+5], false},
+		{"arithmetic_sequential", cut(arithmeticSequential, 1, 2), true},
+		{"arithmetic_progressive", cut(arithmeticProgressive, 1, 2), true},
+	}
+
+	// Allow the CMYK image
+	cmykOpts := CompatLeptonVectorWrite()
+	cmykOpts.AllowFourComponents = true
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			leptonData, err := EncodeVerifyWithOptions(tc.jpeg, cmykOpts)
+			if err != nil {
+				t.Fatalf("EncodeVerify failed: %v", err)
+			}
+
+			header, err := ReadLeptonHeader(bytes.NewReader(leptonData))
+			if err != nil {
+				t.Fatalf("Failed to read Lepton header: %v", err)
+			}
+			if header.RecoveryInfo.EarlyEofEncountered != tc.earlyEOF {
+				t.Errorf("Early EOF: got %v, expected %v", header.RecoveryInfo.EarlyEofEncountered, tc.earlyEOF)
+			}
+		})
+	}
+
+	// Files without an EOI marker are rejected when reading stops at EOI
+	opts := CompatLeptonVectorWrite()
+	opts.StopReadingAtEOI = true
+	err := EncodeWithOptions(bytes.NewReader(cut(iphoneprogressive, 1, 4)), io.Discard, opts)
+	expectExitCode(t, err, ExitCodeShortRead)
+}
+
+// TestEncodePrefixGarbage tests that data preceding the SOI marker is stored
+// in the PGR section and restored when decoding
+func TestEncodePrefixGarbage(t *testing.T) {
+	imagesDir := "../rust/images"
+
+	prefix := []byte("--boundary\r\nContent-Type: image/jpeg\r\n\r\n\xff\x00")
+
+	for _, name := range []string{"iphone", "iphoneprogressive"} {
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join(imagesDir, name+".jpg"))
+			if err != nil {
+				t.Fatalf("Failed to read original JPEG: %v", err)
+			}
+			jpeg := append(append([]byte{}, prefix...), data...)
+
+			// Rejected unless the options allow enough prefix data
+			err = Encode(bytes.NewReader(jpeg), io.Discard)
+			expectExitCode(t, err, ExitCodeUnsupportedJpeg)
+
+			opts := CompatLeptonVectorWrite()
+			opts.MaxPrefixGarbage = uint32(len(prefix)) - 1
+			err = EncodeWithOptions(bytes.NewReader(jpeg), io.Discard, opts)
+			expectExitCode(t, err, ExitCodeUnsupportedJpeg)
+
+			opts.MaxPrefixGarbage = uint32(len(prefix))
+			var leptonData bytes.Buffer
+			if err := EncodeWithOptions(bytes.NewReader(jpeg), &leptonData, opts); err != nil {
+				t.Fatalf("EncodeWithOptions failed: %v", err)
+			}
+
+			header, err := ReadLeptonHeader(bytes.NewReader(leptonData.Bytes()))
+			if err != nil {
+				t.Fatalf("Failed to read Lepton header: %v", err)
+			}
+			if !bytes.Equal(header.RecoveryInfo.PrefixGarbage, prefix) {
+				t.Errorf("PGR section: got %q, expected %q", header.RecoveryInfo.PrefixGarbage, prefix)
+			}
+
+			decoded, err := DecodeLeptonBytes(leptonData.Bytes())
+			if err != nil {
+				t.Fatalf("DecodeLeptonBytes failed: %v", err)
+			}
+			if !bytes.Equal(decoded, jpeg) {
+				t.Errorf("Roundtrip mismatch: got %d bytes, expected %d", len(decoded), len(jpeg))
+			}
+		})
+	}
+}
+
+// TestEncodeMetrics tests that the decoder records the same statistics per
+// model component as the encoder, and that they add up to the coded size
+func TestEncodeMetrics(t *testing.T) {
+	imagesDir := "../rust/images"
+
+	for _, name := range []string{"iphonecity", "iphoneprogressive"} {
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join(imagesDir, name+".jpg"))
+			if err != nil {
+				t.Fatalf("Failed to read original JPEG: %v", err)
+			}
+
+			encodeOpts := CompatLeptonVectorWrite()
+			encodeOpts.Metrics = &Metrics{}
+			leptonData, err := EncodeVerifyWithOptions(data, encodeOpts)
+			if err != nil {
+				t.Fatalf("EncodeVerifyWithOptions failed: %v", err)
+			}
+			encoded := encodeOpts.Metrics
+
+			// The coded partitions make up almost all of the file
+			compressedBytes := encoded.TotalCompressedBits() / 8
+			if compressedBytes > int64(len(leptonData)) || compressedBytes < int64(len(leptonData))*9/10 {
+				t.Errorf("Compressed bits add up to %d bytes, file is %d bytes", compressedBytes, len(leptonData))
+			}
+			for _, cmp := range []ModelComponent{ModelComponentCoefExp, ModelComponentDCExp, ModelComponentEdgeExp, ModelComponentNonZero7x7Count} {
+				if encoded.Components[cmp].TotalBits == 0 {
+					t.Errorf("No bits recorded for %v", cmp)
+				}
+			}
+
+			decodeOpts := CompatLeptonVectorRead()
+			decodeOpts.Metrics = &Metrics{}
+			if err := DecodeWithOptions(bytes.NewReader(leptonData), io.Discard, decodeOpts); err != nil {
+				t.Fatalf("DecodeWithOptions failed: %v", err)
+			}
+			if err := DecodeStreaming(bytes.NewReader(leptonData), io.Discard, decodeOpts); err != nil {
+				t.Fatalf("DecodeStreaming failed: %v", err)
+			}
+
+			// Both decodes were added to the same metrics
+			for cmp := ModelComponent(0); cmp < NumModelComponents; cmp++ {
+				got, expected := decodeOpts.Metrics.Components[cmp], encoded.Components[cmp]
+				if got.TotalBits != 2*expected.TotalBits || got.TotalCompressed != 2*expected.TotalCompressed {
+					t.Errorf("%v: decoded %+v, expected twice %+v", cmp, got, expected)
+				}
+			}
+		})
+	}
+}
+
+// TestEncodeContext tests that progress is reported and that a cancelled
+// context stops the encode
+func TestEncodeContext(t *testing.T) {
+	data, err := os.ReadFile("../rust/images/iphone.jpg")
+	if err != nil {
+		t.Fatalf("Failed to read original JPEG: %v", err)
+	}
+
+	var reports []Progress
+	opts := CompatLeptonVectorWrite()
+	opts.MaxPartitions = 4
+	opts.Progress = func(p Progress) { reports = append(reports, p) }
+
+	var leptonData bytes.Buffer
+	if err := EncodeContext(context.Background(), bytes.NewReader(data), &leptonData, opts); err != nil {
+		t.Fatalf("EncodeContext failed: %v", err)
+	}
+	decoded, err := DecodeLeptonBytes(leptonData.Bytes())
+	if err != nil {
+		t.Fatalf("DecodeLeptonBytes failed: %v", err)
+	}
+	if !bytes.Equal(decoded, data) {
+		t.Errorf("Roundtrip mismatch")
+	}
+
+	if len(reports) == 0 {
+		t.Fatalf("No progress reported")
+	}
+	last := reports[len(reports)-1]
+	if last.Rows != last.TotalRows || last.Partitions != last.TotalPartitions || last.TotalPartitions != 4 {
+		t.Errorf("Encode finished with progress %+v", last)
+	}
+	if len(reports) != last.TotalRows+last.TotalPartitions {
+		t.Errorf("Got %d reports for %+v", len(reports), last)
+	}
+
+	// A context that is already cancelled does not start the encode
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var output bytes.Buffer
+	err = EncodeContext(ctx, bytes.NewReader(data), &output, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	// Cancelling while rows are coded stops all partitions without output
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	rows := 0
+	opts.Progress = func(p Progress) {
+		rows = p.Rows
+		if p.Rows == 10 {
+			cancel()
+		}
+	}
+	err = EncodeContext(ctx, bytes.NewReader(data), &output, opts)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if rows != 10 || output.Len() != 0 {
+		t.Errorf("Encode went on after cancel: %d rows reported, %d bytes written", rows, output.Len())
+	}
+}
+
+// TestEncodeSamplingFactors tests round trips of images with sampling factors
+// up to 4, including layouts where the luma factors are not a multiple of the
+// chroma factors
+func TestEncodeSamplingFactors(t *testing.T) {
+	testCases := []struct {
+		name            string
+		sampling        [][2]int // horizontal and vertical factor of each component
+		restartInterval int
+	}{
+		{"411", [][2]int{{4, 1}, {1, 1}, {1, 1}}, 0},
+		{"410", [][2]int{{4, 2}, {1, 1}, {1, 1}}, 0},
+		{"vertical_411", [][2]int{{1, 4}, {1, 1}, {1, 1}}, 0},
+		{"3x1", [][2]int{{3, 1}, {1, 1}, {1, 1}}, 0},
+		{"3x2", [][2]int{{3, 2}, {1, 1}, {1, 1}}, 0},
+		{"4x1_2x1", [][2]int{{4, 1}, {2, 1}, {2, 1}}, 0},
+		{"3x3_chroma_1x1", [][2]int{{3, 3}, {1, 1}}, 0},
+		{"411_restarts", [][2]int{{4, 1}, {1, 1}, {1, 1}}, 3},
+		{"grayscale_4x4", [][2]int{{4, 4}}, 0},
+	}
+	opts := CompatLeptonVectorWrite()
+	opts.AllowSamplingBeyondTwo = true
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Sizes that are not a multiple of the MCU size leave partial MCUs
+			for _, size := range [][2]int{{75, 37}, {131, 213}} {
+				jpeg := buildSampledJpeg(size[0], size[1], tc.sampling, tc.restartInterval, false)
+
+				// Other Lepton implementations cannot read these files
+				_, err := EncodeVerify(jpeg)
+				expectExitCode(t, err, ExitCodeSamplingBeyondTwoUnsupported)
+
+				leptonData, err := EncodeVerifyWithOptions(jpeg, opts)
+				if err != nil {
+					t.Fatalf("%dx%d: EncodeVerify failed: %v", size[0], size[1], err)
+				}
+
+				var streamed bytes.Buffer
+				if err := DecodeStreaming(bytes.NewReader(leptonData), &streamed, nil); err != nil {
+					t.Fatalf("%dx%d: DecodeStreaming failed: %v", size[0], size[1], err)
+				}
+				if !bytes.Equal(streamed.Bytes(), jpeg) {
+					t.Errorf("%dx%d: streaming roundtrip mismatch", size[0], size[1])
+				}
+
+				// Truncated files stop in the middle of an MCU
+				if _, err := EncodeVerifyWithOptions(jpeg[:len(jpeg)*2/3], opts); err != nil {
+					t.Errorf("%dx%d: EncodeVerify of truncated file failed: %v", size[0], size[1], err)
+				}
+			}
+		})
+	}
+	// Factors outside 1 to 4 are not valid JPEG, nor are interleaved scans
+	// of more than 10 blocks per MCU
+	_, err := EncodeVerifyWithOptions(buildSampledJpeg(75, 37, [][2]int{{5, 1}, {1, 1}, {1, 1}}, 0, false), opts)
+	expectExitCode(t, err, ExitCodeUnsupportedJpeg)
+	_, err = EncodeVerifyWithOptions(buildSampledJpeg(75, 37, [][2]int{{4, 4}, {1, 1}, {1, 1}}, 0, false), opts)
+	expectExitCode(t, err, ExitCodeUnsupportedJpeg)
+}
+
+// TestEncodeExplicitZeroRuns tests that blocks whose trailing zeros are coded
+// with ZRL symbols are recorded in the ZRL section and written back exactly
+func TestEncodeExplicitZeroRuns(t *testing.T) {
+	for _, restartInterval := range []int{0, 5} {
+		jpeg := buildSampledJpeg(131, 213, [][2]int{{2, 2}, {1, 1}, {1, 1}}, restartInterval, true)
+
+		// Other Lepton implementations cannot read the ZRL section
+		_, err := EncodeVerify(jpeg)
+		expectExitCode(t, err, ExitCodeUnsupportedJpeg)
+
+		opts := CompatLeptonVectorWrite()
+		opts.AllowExplicitZeroRuns = true
+		result, err := ReadJpegFileWithOptions(bytes.NewReader(jpeg), opts)
+		if err != nil {
+			t.Fatalf("ReadJpegFileWithOptions failed: %v", err)
+		}
+		if result.ExplicitZeroRuns.Len() == 0 {
+			t.Fatal("Expected blocks with explicit zero runs")
+		}
+
+		opts.MaxPartitions = 4
+		leptonData, err := EncodeVerifyWithOptions(jpeg, opts)
+		if err != nil {
+			t.Fatalf("EncodeVerify failed: %v", err)
+		}
+
+		header, err := ReadLeptonHeader(bytes.NewReader(leptonData))
+		if err != nil {
+			t.Fatalf("Failed to read Lepton header: %v", err)
+		}
+		if !reflect.DeepEqual(header.RecoveryInfo.ExplicitZeroRuns, result.ExplicitZeroRuns) {
+			t.Error("ZRL section does not match the blocks that were read")
+		}
+
+		var streamed bytes.Buffer
+		if err := DecodeStreaming(bytes.NewReader(leptonData), &streamed, nil); err != nil {
+			t.Fatalf("DecodeStreaming failed: %v", err)
+		}
+		if !bytes.Equal(streamed.Bytes(), jpeg) {
+			t.Errorf("Restart interval %d: streaming roundtrip mismatch", restartInterval)
+		}
+
+		if _, err := EncodeVerifyWithOptions(jpeg[:len(jpeg)/2], opts); err != nil {
+			t.Errorf("Restart interval %d: EncodeVerify of truncated file failed: %v", restartInterval, err)
+		}
+	}
+}
+
+// buildSampledJpeg writes a baseline JPEG with the given sampling factors and
+// pseudo-random coefficients. It is written independently of JpegWriter so
+// that the MCU order of both can be checked against each other. Every
+// component uses one DC table with 4-bit codes for all categories and one AC
+// table with 8-bit codes for all symbols. With explicitZeroRuns some blocks
+// code their trailing zeros with ZRLs before the EOB.
+func buildSampledJpeg(width, height int, sampling [][2]int, restartInterval int, explicitZeroRuns bool) []byte {
+	var out bytes.Buffer
+	segment := func(marker byte, body ...byte) {
+		out.Write([]byte{0xFF, marker, byte((len(body) + 2) >> 8), byte(len(body) + 2)})
+		out.Write(body)
+	}
+
+	out.Write(SOI[:])
+
+	dqt := []byte{0}
+	for i := 0; i < 64; i++ {
+		dqt = append(dqt, byte(2+i/4))
+	}
+	segment(MarkerDQT, dqt...)
+
+	maxH, maxV := 1, 1
+	for _, s := range sampling {
+		maxH, maxV = max(maxH, s[0]), max(maxV, s[1])
+	}
+	sof := []byte{8, byte(height >> 8), byte(height), byte(width >> 8), byte(width), byte(len(sampling))}
+	for i, s := range sampling {
+		sof = append(sof, byte(i+1), byte(s[0]<<4|s[1]), 0)
+	}
+	segment(MarkerSOF0, sof...)
+
+	dht := []byte{0x00, 0, 0, 0, 12}
+	dht = append(dht, make([]byte, 12)...)
+	for i := 0; i < 12; i++ {
+		dht = append(dht, byte(i))
+	}
+	acSymbols := []byte{0x00} // EOB
+	for run := 0; run < 16; run++ {
+		for size := 1; size <= 10; size++ {
+			acSymbols = append(acSymbols, byte(run<<4|size))
+		}
+	}
+	acSymbols = append(acSymbols, 0xF0) // ZRL
+	dht = append(dht, 0x10, 0, 0, 0, 0, 0, 0, 0, byte(len(acSymbols)))
+	dht = append(dht, make([]byte, 8)...)
+	dht = append(dht, acSymbols...)
+	segment(MarkerDHT, dht...)
+
+	if restartInterval > 0 {
+		segment(MarkerDRI, byte(restartInterval>>8), byte(restartInterval))
+	}
+
+	sos := []byte{byte(len(sampling))}
+	for i := range sampling {
+		sos = append(sos, byte(i+1), 0x00)
+	}
+	sos = append(sos, 0, 63, 0)
+	segment(MarkerSOS, sos...)
+
+	// Bit writer with byte stuffing
+	var acc, numBits uint32
+	putBits := func(value, n uint32) {
+		for i := int(n) - 1; i >= 0; i-- {
+			acc = acc<<1 | (value>>uint(i))&1
+			numBits++
+			if numBits == 8 {
+				out.WriteByte(byte(acc))
+				if byte(acc) == 0xFF {
+					out.WriteByte(0)
+				}
+				acc, numBits = 0, 0
+			}
+		}
+	}
+	padToByte := func() {
+		for numBits != 0 {
+			putBits(1, 1)
+		}
+	}
+	// putCoef writes a Huffman code followed by the category bits of v
+	putCoef := func(code, codeBits uint32, v int) {
+		size := uint32(0)
+		for abs := v; abs != 0; abs /= 2 {
+			size++
+		}
+		if v < 0 {
+			v += 1<<size - 1
+		}
+		putBits(code+size, codeBits)
+		putBits(uint32(v), size)
+	}
+
+	rng := uint32(12345)
+	random := func(n int) int {
+		rng = rng*1103515245 + 12345
+		return int(rng>>16) % n
+	}
+
+	// The codes are the index of the symbol in the table, since all codes
+	// of a table have the same length
+	lastDC := make([]int, len(sampling))
+	writeBlock := func(cmp int) {
+		dc := random(201) - 100
+		putCoef(0, 4, dc-lastDC[cmp])
+		lastDC[cmp] = dc
+
+		run := 0
+		for k := 1; k < 64; k++ {
+			v := 0
+			if random(k+2) == 0 {
+				v = random(2*(64-k)+1) - (64 - k)
+			}
+			if v == 0 {
+				run++
+				continue
+			}
+			for ; run >= 16; run -= 16 {
+				putBits(161, 8) // ZRL
+			}
+			putCoef(uint32(run*10), 8, v)
+			run = 0
+		}
+		for explicitZeroRuns && run >= 16 && random(2) == 0 {
+			putBits(161, 8) // ZRL
+			run -= 16
+		}
+		if run > 0 {
+			putBits(0, 8) // EOB
+		}
+	}
+
+	// A single component scan is not interleaved and has one block per MCU
+	mcusX := (width + 8*maxH - 1) / (8 * maxH)
+	mcusY := (height + 8*maxV - 1) / (8 * maxV)
+	if len(sampling) == 1 {
+		mcusX, mcusY = (width+7)/8, (height+7)/8
+	}
+
+	for mcu := 0; mcu < mcusX*mcusY; mcu++ {
+		if restartInterval > 0 && mcu > 0 && mcu%restartInterval == 0 {
+			padToByte()
+			out.Write([]byte{0xFF, MarkerRST0 + byte((mcu/restartInterval-1)%8)})
+			for i := range lastDC {
+				lastDC[i] = 0
+			}
+		}
+		if len(sampling) == 1 {
+			writeBlock(0)
+			continue
+		}
+		for cmp, s := range sampling {
+			for i := 0; i < s[0]*s[1]; i++ {
+				writeBlock(cmp)
+			}
+		}
+	}
+	padToByte()
+	out.Write([]byte{0xFF, MarkerEOI})
+
+	return out.Bytes()
+}
+
+// TestEncodeArithmetic tests that arithmetic coded JPEGs are decoded to the
+// same coefficients as their Huffman coded source and recreated exactly
+func TestEncodeArithmetic(t *testing.T) {
+	imagesDir := "../rust/images"
+
+	readImage := func(name string) []byte {
+		data, err := os.ReadFile(filepath.Join(imagesDir, name+".jpg"))
+		if err != nil {
+			t.Fatalf("Failed to read original JPEG: %v", err)
+		}
+		return data
+	}
+
+	// arithmetic_sequential_restarts is androidcropoptions transcoded to SOF9
+	// with a restart marker after each MCU row, and arithmetic_progressive_gray
+	// is gray2sf transcoded to SOF10 with a restart interval of 9 blocks
+	for _, tc := range []struct{ name, source string }{
+		{"arithmetic", ""},
+		{"arithmetic_sequential_restarts", "androidcropoptions"},
+		{"arithmetic_progressive_gray", "gray2sf"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			jpeg := readImage(tc.name)
+
+			if tc.source != "" {
+				arithmetic, err := ReadJpegBytes(jpeg)
+				if err != nil {
+					t.Fatalf("ReadJpegBytes failed: %v", err)
+				}
+				huffman, err := ReadJpegBytes(readImage(tc.source))
+				if err != nil {
+					t.Fatalf("ReadJpegBytes of %s failed: %v", tc.source, err)
+				}
+				for cmp := range huffman.ImageData {
+					for dpos := uint32(0); dpos < huffman.Header.CmpInfo[cmp].Bc; dpos++ {
+						if *arithmetic.ImageData[cmp].GetBlock(dpos) != *huffman.ImageData[cmp].GetBlock(dpos) {
+							t.Fatalf("Component %d block %d differs from %s", cmp, dpos, tc.source)
+						}
+					}
+				}
+			}
+
+			leptonData, err := EncodeVerify(jpeg)
+			if err != nil {
+				t.Fatalf("EncodeVerify failed: %v", err)
+			}
+
+			var streamed bytes.Buffer
+			if err := DecodeStreaming(bytes.NewReader(leptonData), &streamed, nil); err != nil {
+				t.Fatalf("DecodeStreaming failed: %v", err)
+			}
+			if !bytes.Equal(streamed.Bytes(), jpeg) {
+				t.Error("Streaming roundtrip mismatch")
+			}
+		})
+	}
+
+	// A DAC segment with an AC conditioning value of 0 is not valid
+	jpeg := readImage("arithmetic_sequential_restarts")
+	dac := bytes.Index(jpeg, []byte{0xFF, MarkerDAC})
+	if dac < 0 || jpeg[dac+6] != 0x10 {
+		t.Fatal("Expected the DAC segment to start with AC table 0")
+	}
+	jpeg[dac+7] = 0
+	_, err := EncodeVerify(jpeg)
+	expectExitCode(t, err, ExitCodeUnsupportedJpeg)
+}
+
+// TestEncodeFrameTypes tests that 8 bit extended sequential frames are
+// accepted and that 12 bit, lossless and hierarchical frames are rejected
+// with UnsupportedJpeg instead of being misread
+func TestEncodeFrameTypes(t *testing.T) {
+	original, err := os.ReadFile(filepath.Join("../rust/images", "tiny.jpg"))
+	if err != nil {
+		t.Fatalf("Failed to read original JPEG: %v", err)
+	}
+	sof := bytes.Index(original, []byte{0xFF, MarkerSOF0})
+
+	withFrame := func(marker, precision byte) []byte {
+		jpeg := append([]byte{}, original...)
+		jpeg[sof+1] = marker
+		jpeg[sof+4] = precision
+		return jpeg
+	}
+
+	extended := withFrame(MarkerSOF1, 8)
+	leptonData, err := EncodeVerify(extended)
+	if err != nil {
+		t.Fatalf("EncodeVerify of 8 bit SOF1 failed: %v", err)
+	}
+	decoded, err := DecodeLeptonBytes(leptonData)
+	if err != nil || !bytes.Equal(decoded, extended) {
+		t.Errorf("8 bit SOF1 roundtrip mismatch: %v", err)
+	}
+
+	testCases := []struct {
+		name      string
+		marker    byte
+		precision byte
+		message   string
+	}{
+		{"12_bit_extended", MarkerSOF1, 12, "12 bit sample precision"},
+		{"12_bit_progressive", MarkerSOF2, 12, "12 bit sample precision"},
+		{"lossless", MarkerSOF3, 8, "lossless"},
+		{"hierarchical", MarkerSOF5, 8, "hierarchical"},
+		{"lossless_arithmetic", MarkerSOF11, 8, "lossless"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			jpeg := withFrame(tc.marker, tc.precision)
+			_, err := EncodeVerify(jpeg)
+			expectExitCode(t, err, ExitCodeUnsupportedJpeg)
+			if err != nil && !strings.Contains(err.Error(), tc.message) {
+				t.Errorf("Error %q does not mention %q", err, tc.message)
+			}
+
+			// The header stored in a Lepton file is checked the same way
+			sos := bytes.Index(jpeg, []byte{0xFF, MarkerSOS})
+			_, _, err = parseJpegHeaderWithOptions(jpeg[2:sos+2+int(jpeg[sos+3])], CompatLeptonVectorRead())
+			expectExitCode(t, err, ExitCodeUnsupportedJpeg)
+		})
+	}
+}
+
 // TestEncodeCompareWithRust tests that our encoding produces output that can be decoded
 // and matches the original JPEG
 func TestEncodeCompareWithRust(t *testing.T) {
@@ -307,6 +1262,37 @@ func TestEncodeCompareWithRust(t *testing.T) {
 	}
 }
 
+// FuzzEncode checks that no JPEG file makes the encoder panic, and that
+// whatever it compresses decodes without a panic as well
+func FuzzEncode(f *testing.F) {
+	for _, name := range []string{"tiny", "colorswap", "nofsync", "mismatch_encode", "arithmetic_progressive_gray"} {
+		data, err := os.ReadFile(filepath.Join("../rust/images", name+".jpg"))
+		if err != nil {
+			f.Fatalf("Failed to read original JPEG: %v", err)
+		}
+		f.Add(data)
+	}
+	f.Add(buildSampledJpeg(75, 37, [][2]int{{4, 1}, {1, 1}, {1, 1}}, 3, true))
+
+	// Exercise the format extensions as well
+	opts := fuzzOptions(CompatLeptonVectorWrite())
+	opts.AllowFourComponents = true
+	opts.AllowExplicitZeroRuns = true
+	opts.AllowSamplingBeyondTwo = true
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var leptonData bytes.Buffer
+		err := EncodeWithOptions(bytes.NewReader(data), &leptonData, opts)
+		expectNoPanic(t, err)
+		if err == nil {
+			_, err = DecodeLeptonBytes(leptonData.Bytes())
+			expectNoPanic(t, err)
+		}
+		_, err = DumpJpeg(data, true, opts)
+		expectNoPanic(t, err)
+	})
+}
+
 // TestVPXBoolWriterRoundtrip tests that VPXBoolWriter produces data
 // that VPXBoolReader can decode correctly
 func TestVPXBoolWriterRoundtrip(t *testing.T) {
@@ -320,13 +1306,13 @@ func TestVPXBoolWriterRoundtrip(t *testing.T) {
 
 	// Create a branch and write some bits
 	branch := NewBranch()
-	if err := writer.PutBit(true, &branch); err != nil {
+	if err := writer.PutBit(true, &branch, ModelComponentDummy); err != nil {
 		t.Fatalf("Failed to write bit: %v", err)
 	}
-	if err := writer.PutBit(false, &branch); err != nil {
+	if err := writer.PutBit(false, &branch, ModelComponentDummy); err != nil {
 		t.Fatalf("Failed to write bit: %v", err)
 	}
-	if err := writer.PutBit(true, &branch); err != nil {
+	if err := writer.PutBit(true, &branch, ModelComponentDummy); err != nil {
 		t.Fatalf("Failed to write bit: %v", err)
 	}
 
@@ -342,7 +1328,7 @@ func TestVPXBoolWriterRoundtrip(t *testing.T) {
 
 	branch2 := NewBranch()
 
-	bit1, err := reader.GetBit(&branch2)
+	bit1, err := reader.GetBit(&branch2, ModelComponentDummy)
 	if err != nil {
 		t.Fatalf("Failed to read bit: %v", err)
 	}
@@ -350,7 +1336,7 @@ func TestVPXBoolWriterRoundtrip(t *testing.T) {
 		t.Error("Expected true, got false")
 	}
 
-	bit2, err := reader.GetBit(&branch2)
+	bit2, err := reader.GetBit(&branch2, ModelComponentDummy)
 	if err != nil {
 		t.Fatalf("Failed to read bit: %v", err)
 	}
@@ -358,7 +1344,7 @@ func TestVPXBoolWriterRoundtrip(t *testing.T) {
 		t.Error("Expected false, got true")
 	}
 
-	bit3, err := reader.GetBit(&branch2)
+	bit3, err := reader.GetBit(&branch2, ModelComponentDummy)
 	if err != nil {
 		t.Fatalf("Failed to read bit: %v", err)
 	}
@@ -385,7 +1371,7 @@ func TestVPXBoolWriterGridRoundtrip(t *testing.T) {
 				branches[i] = NewBranch()
 			}
 
-			if err := writer.PutGrid(val, branches); err != nil {
+			if err := writer.PutGrid(val, branches, ModelComponentDummy); err != nil {
 				t.Fatalf("Failed to write grid: %v", err)
 			}
 
@@ -404,7 +1390,7 @@ func TestVPXBoolWriterGridRoundtrip(t *testing.T) {
 				branches2[i] = NewBranch()
 			}
 
-			readVal, err := reader.GetGrid(branches2)
+			readVal, err := reader.GetGrid(branches2, ModelComponentDummy)
 			if err != nil {
 				t.Fatalf("Failed to read grid: %v", err)
 			}
@@ -3,6 +3,9 @@ package lepton
 import (
 	"errors"
 	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
 )
 
 // ExitCode represents categorized error codes
@@ -113,6 +116,40 @@ func IsLeptonError(err error) (*LeptonError, bool) {
 	return nil, false
 }
 
+// recoverPanic turns a panic into an ExitCodeAssertionFailure error in *err,
+// with the functions that were running when it happened in the message. Every
+// entry point and worker goroutine defers it, so that malformed input can
+// never crash the process.
+func recoverPanic(err *error) {
+	if r := recover(); r != nil {
+		*err = ErrExitCode(ExitCodeAssertionFailure, fmt.Sprintf("panic: %v [%s]", r, panicLocation()))
+	}
+}
+
+// panicLocation describes the innermost frames of the stack of a panic that is
+// being recovered, skipping the frames of the runtime
+func panicLocation() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+
+	var location []string
+	panicking := false
+	for len(location) < 4 {
+		frame, more := frames.Next()
+		switch {
+		case frame.Function == "runtime.gopanic":
+			panicking = true
+		case panicking && !strings.HasPrefix(frame.Function, "runtime."):
+			name := frame.Function[strings.LastIndex(frame.Function, "/")+1:]
+			location = append(location, fmt.Sprintf("%s %s:%d", name, filepath.Base(frame.File), frame.Line))
+		}
+		if !more {
+			break
+		}
+	}
+	return strings.Join(location, " <- ")
+}
+
 // Common errors
 var (
 	ErrShortRead = &LeptonError{Code: ExitCodeShortRead, Message: "short read"}
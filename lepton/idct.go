@@ -1,5 +1,7 @@
 package lepton
 
+import "math"
+
 // IDCT implements inverse discrete cosine transform for DC prediction
 // This is a simplified IDCT focused on edge pixel reconstruction for prediction
 
@@ -160,73 +162,76 @@ func ComputeEdgeBestPrior(
 	return neighbor.EdgeCoefsV[edgeIdx]
 }
 
-// IDCT8x8 performs a full 8x8 inverse DCT
-// This is used for reconstructing pixels, not for prediction during encoding
+// IDCT8x8 dequantizes a block of coefficients, in the transposed order of
+// AlignedBlock, and returns its pixels in raster order, level shifted and
+// clamped to 0..255
 func IDCT8x8(coeffs *[64]int16, qt *QuantizationTables) [64]int16 {
-	var result [64]int16
-	var tmp [64]int32
-
-	// Dequantize and apply horizontal 1D IDCT
-	for row := 0; row < 8; row++ {
-		idct1D_row(coeffs, qt, row, &tmp)
+	var raster [8][8]int32
+	for i := 0; i < 64; i++ {
+		raster[i>>3][i&7] = int32(coeffs[i]) * int32(qt.GetQ(i))
 	}
 
-	// Apply vertical 1D IDCT
-	for col := 0; col < 8; col++ {
-		idct1D_col(&tmp, col, &result)
+	var pixels [8][8]int16
+	runIDCTInternal(&raster, &pixels)
+
+	// The IDCT leaves 3 extra bits of precision for the DC prediction
+	var result [64]int16
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			val := (int32(pixels[y][x])+4)>>3 + 128
+			if val < 0 {
+				val = 0
+			} else if val > 255 {
+				val = 255
+			}
+			result[y*8+x] = int16(val)
+		}
 	}
 
 	return result
 }
 
-// idct1D_row performs 1D IDCT on a row
-func idct1D_row(coeffs *[64]int16, qt *QuantizationTables, row int, tmp *[64]int32) {
-	base := row * 8
-
-	// Dequantize
-	var v [8]int32
-	for i := 0; i < 8; i++ {
-		v[i] = int32(coeffs[base+i]) * int32(qt.GetQ(base+i))
-	}
-
-	// Apply IDCT butterfly
-	// Simplified version - can be optimized with standard IDCT algorithms
-	for x := 0; x < 8; x++ {
-		var sum int32 = 0
-		for u := 0; u < 8; u++ {
-			sum += v[u] * idctCos(u, x)
+// reducedIDCTCos holds C(u) * cos((2x+1)u*pi/2n) / 2 for the sizes n of
+// reducedIDCT, indexed by n, x and u
+var reducedIDCTCos = func() (table [5][4][4]float64) {
+	for _, n := range []int{1, 2, 4} {
+		for x := 0; x < n; x++ {
+			for u := 0; u < n; u++ {
+				c := math.Cos(float64((2*x+1)*u)*math.Pi/float64(2*n)) / 2
+				if u == 0 {
+					c /= math.Sqrt2
+				}
+				table[n][x][u] = c
+			}
 		}
-		tmp[base+x] = sum
 	}
-}
-
-// idct1D_col performs 1D IDCT on a column
-func idct1D_col(tmp *[64]int32, col int, result *[64]int16) {
-	for y := 0; y < 8; y++ {
-		var sum int32 = 0
-		for v := 0; v < 8; v++ {
-			sum += tmp[v*8+col] * idctCos(v, y)
-		}
-		// Scale and clamp to 8-bit range + 128 (JPEG level shift)
-		val := (sum + (1 << 19)) >> 20 // Scale factor
-		if val < -128 {
-			val = -128
-		} else if val > 127 {
-			val = 127
+	return table
+}()
+
+// reducedIDCT is IDCT8x8 scaled down to n x n pixels, for n of 1, 2 or 4. It
+// only uses the lowest n x n coefficients, on which it runs an n point IDCT,
+// and writes the pixels to result in raster order with rows n apart.
+func reducedIDCT(coeffs *[64]int16, qt *QuantizationTables, n int, result *[64]int16) {
+	cos := &reducedIDCTCos[n]
+
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			sum := 0.0
+			for u := 0; u < n; u++ {
+				for v := 0; v < n; v++ {
+					// Coefficients are transposed, with the horizontal frequency first
+					pos := u*8 + v
+					sum += float64(int32(coeffs[pos])*int32(qt.GetQ(pos))) * cos[x][u] * cos[y][v]
+				}
+			}
+
+			val := int32(math.Floor(sum+0.5)) + 128
+			if val < 0 {
+				val = 0
+			} else if val > 255 {
+				val = 255
+			}
+			result[y*n+x] = int16(val)
 		}
-		result[y*8+col] = int16(val + 128)
 	}
 }
-
-// idctCos returns the cosine coefficient for IDCT
-func idctCos(u, x int) int32 {
-	// cos((2x+1)*u*pi/16) scaled by sqrt(2)/4 for u=0, 1/2 otherwise
-	// Precomputed table would be more efficient
-	// This is a simplified placeholder
-	if u == 0 {
-		return 362 // ~= 1/sqrt(2) * 512
-	}
-
-	// Approximate using the precomputed values
-	return IcosBased8192Scaled[u]
-}
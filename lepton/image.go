@@ -0,0 +1,209 @@
+package lepton
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+func init() {
+	image.RegisterFormat("lepton", string(LeptonFileHeader[:]), DecodeImage, DecodeImageConfig)
+}
+
+// DecodeImage decodes a Lepton file straight to an image, without rebuilding
+// the JPEG. Grayscale files give an *image.Gray and color files an
+// *image.YCbCr.
+func DecodeImage(r io.Reader) (image.Image, error) {
+	return DecodeImageWithOptions(r, nil)
+}
+
+// DecodeImageWithOptions is like DecodeImage but uses the given options.
+// A nil opts uses CompatLeptonVectorRead.
+func DecodeImageWithOptions(r io.Reader, opts *Options) (img image.Image, err error) {
+	defer recoverPanic(&err)
+	header, images, err := decodeImageBlocks(r, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return renderImage(header.JpegHeader, images, 8), nil
+}
+
+// DecodeThumbnail decodes a Lepton file to an image scaled down by 1/scale,
+// which is 2, 4 or 8. Only the lowest 8/scale x 8/scale coefficients of each
+// block are transformed, so at scale 8 a pixel is the DC of a block. The
+// image types are those of DecodeImage.
+func DecodeThumbnail(r io.Reader, scale int) (image.Image, error) {
+	return DecodeThumbnailWithOptions(r, scale, nil)
+}
+
+// DecodeThumbnailWithOptions is like DecodeThumbnail but uses the given
+// options. A nil opts uses CompatLeptonVectorRead.
+func DecodeThumbnailWithOptions(r io.Reader, scale int, opts *Options) (img image.Image, err error) {
+	defer recoverPanic(&err)
+	if scale != 1 && scale != 2 && scale != 4 && scale != 8 {
+		return nil, NewLeptonError(ExitCodeSyntaxError,
+			fmt.Sprintf("thumbnail scale %d is not 1, 2, 4 or 8", scale))
+	}
+
+	header, images, err := decodeImageBlocks(r, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return renderImage(header.JpegHeader, images, 8/scale), nil
+}
+
+// decodeImageBlocks reads a Lepton file and decodes the coefficients of
+// every component, for components that DecodeImage can convert
+func decodeImageBlocks(r io.Reader, opts *Options) (*LeptonHeader, []*BlockBasedImage, error) {
+	if opts == nil {
+		opts = CompatLeptonVectorRead()
+	}
+
+	header, err := ReadLeptonHeaderWithOptions(r, opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read Lepton header: %w", err)
+	}
+	if _, err := imageColorModel(header.JpegHeader); err != nil {
+		return nil, nil, err
+	}
+	if err := readCompletionMarker(r); err != nil {
+		return nil, nil, err
+	}
+
+	images, err := decodeImages(header, r, opts, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, images, nil
+}
+
+// DecodeImageConfig returns the color model and dimensions of the image in a
+// Lepton file. Only the header is read.
+func DecodeImageConfig(r io.Reader) (image.Config, error) {
+	header, err := ReadLeptonHeader(r)
+	if err != nil {
+		return image.Config{}, fmt.Errorf("failed to read Lepton header: %w", err)
+	}
+
+	model, err := imageColorModel(header.JpegHeader)
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	return image.Config{
+		ColorModel: model,
+		Width:      int(header.JpegHeader.Width),
+		Height:     int(header.JpegHeader.Height),
+	}, nil
+}
+
+// imageColorModel returns the color model that DecodeImage gives for the
+// components of header
+func imageColorModel(header *JpegHeader) (color.Model, error) {
+	switch header.Cmpc {
+	case 1:
+		return color.GrayModel, nil
+	case 3:
+		return color.YCbCrModel, nil
+	}
+	return nil, NewLeptonError(ExitCodeUnsupportedJpeg,
+		fmt.Sprintf("cannot convert %d components to an image", header.Cmpc))
+}
+
+// renderImage runs the inverse DCT over the coefficients of every component,
+// giving blockSize x blockSize pixels for every block
+func renderImage(header *JpegHeader, images []*BlockBasedImage, blockSize int) image.Image {
+	width := (int(header.Width)*blockSize + 7) / 8
+	height := (int(header.Height)*blockSize + 7) / 8
+	bounds := image.Rect(0, 0, width, height)
+
+	if header.Cmpc == 1 {
+		img := image.NewGray(bounds)
+		renderComponent(img.Pix, img.Stride, width, height, images[0], header, 0, blockSize)
+		return img
+	}
+
+	ratio, ok := subsampleRatio(header)
+	img := image.NewYCbCr(bounds, ratio)
+	planes := [3][]uint8{img.Y, img.Cb, img.Cr}
+	strides := [3]int{img.YStride, img.CStride, img.CStride}
+
+	for cmp := 0; cmp < 3; cmp++ {
+		ci := &header.CmpInfo[cmp]
+		cmpWidth := (width*int(ci.Sfh) + int(header.MaxSfh) - 1) / int(header.MaxSfh)
+		cmpHeight := (height*int(ci.Sfv) + int(header.MaxSfv) - 1) / int(header.MaxSfv)
+		if ok {
+			renderComponent(planes[cmp], strides[cmp], cmpWidth, cmpHeight, images[cmp], header, cmp, blockSize)
+			continue
+		}
+
+		// Sampling that image.YCbCr cannot represent is upsampled to 4:4:4
+		pix := make([]uint8, cmpWidth*cmpHeight)
+		renderComponent(pix, cmpWidth, cmpWidth, cmpHeight, images[cmp], header, cmp, blockSize)
+		for y := 0; y < height; y++ {
+			sy := y * int(ci.Sfv) / int(header.MaxSfv)
+			for x := 0; x < width; x++ {
+				planes[cmp][y*strides[cmp]+x] = pix[sy*cmpWidth+x*int(ci.Sfh)/int(header.MaxSfh)]
+			}
+		}
+	}
+
+	return img
+}
+
+// subsampleRatio returns the image.YCbCr ratio of a three component header,
+// or false if its sampling factors do not match one
+func subsampleRatio(header *JpegHeader) (image.YCbCrSubsampleRatio, bool) {
+	luma, cb, cr := &header.CmpInfo[0], &header.CmpInfo[1], &header.CmpInfo[2]
+	if luma.Sfh != header.MaxSfh || luma.Sfv != header.MaxSfv ||
+		cb.Sfh != cr.Sfh || cb.Sfv != cr.Sfv ||
+		luma.Sfh%cb.Sfh != 0 || luma.Sfv%cb.Sfv != 0 {
+		return 0, false
+	}
+
+	switch [2]uint32{luma.Sfh / cb.Sfh, luma.Sfv / cb.Sfv} {
+	case [2]uint32{1, 1}:
+		return image.YCbCrSubsampleRatio444, true
+	case [2]uint32{2, 1}:
+		return image.YCbCrSubsampleRatio422, true
+	case [2]uint32{2, 2}:
+		return image.YCbCrSubsampleRatio420, true
+	case [2]uint32{1, 2}:
+		return image.YCbCrSubsampleRatio440, true
+	case [2]uint32{4, 1}:
+		return image.YCbCrSubsampleRatio411, true
+	case [2]uint32{4, 2}:
+		return image.YCbCrSubsampleRatio410, true
+	}
+	return 0, false
+}
+
+// renderComponent writes the top left width x height samples of a component
+// to pix, with rows stride bytes apart and blockSize x blockSize samples for
+// every block
+func renderComponent(pix []uint8, stride, width, height int, blocks *BlockBasedImage, header *JpegHeader, cmp int, blockSize int) {
+	qt := NewQuantizationTables(header.QTables[header.CmpInfo[cmp].QTableIndex])
+	blockWidth := blocks.GetBlockWidth()
+
+	var pixels [64]int16
+	for by := 0; by*blockSize < height; by++ {
+		for bx := 0; bx*blockSize < width; bx++ {
+			block := blocks.GetBlock(uint32(by)*blockWidth + uint32(bx))
+			if blockSize == 8 {
+				pixels = IDCT8x8(&block.RawData, qt)
+			} else {
+				reducedIDCT(&block.RawData, qt, blockSize, &pixels)
+			}
+
+			for y := 0; y < blockSize && by*blockSize+y < height; y++ {
+				row := pix[(by*blockSize+y)*stride:]
+				for x := 0; x < blockSize && bx*blockSize+x < width; x++ {
+					row[bx*blockSize+x] = uint8(pixels[y*blockSize+x])
+				}
+			}
+		}
+	}
+}
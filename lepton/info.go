@@ -0,0 +1,139 @@
+package lepton
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Info summarizes a JPEG or Lepton file from its header alone, for listing
+// files without decoding them. It can be marshalled with encoding/json. The
+// fields that only Lepton files record are zero for JPEG files.
+type Info struct {
+	Format     string      `json:"format"`   // "jpeg" or "lepton"
+	JpegType   string      `json:"jpegType"` // as in Dump, e.g. "baseline" or "progressive"
+	Width      uint32      `json:"width"`
+	Height     uint32      `json:"height"`
+	Components int         `json:"components"`
+	Sampling   [][2]uint32 `json:"sampling"` // horizontal and vertical sampling factor of each component
+
+	// PrefixGarbageSize is the number of bytes before the SOI marker
+	PrefixGarbageSize int `json:"prefixGarbageSize"`
+
+	// Version is the Lepton format version
+	Version uint8 `json:"version,omitempty"`
+
+	// OriginalFileSize is the size of the JPEG that the Lepton file decodes to
+	OriginalFileSize uint32 `json:"originalFileSize,omitempty"`
+
+	// Partitions is the number of partitions, which are decoded by a thread each
+	Partitions int `json:"partitions,omitempty"`
+
+	// GarbageSize is the number of bytes stored after the scans, which is
+	// usually just the EOI marker
+	GarbageSize int `json:"garbageSize,omitempty"`
+
+	// Truncated is set if the JPEG ended within its scans
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// ReadInfo reads the header of a JPEG or Lepton file, telling them apart by
+// their first bytes, and summarizes it. Nothing beyond the header is decoded.
+func ReadInfo(r io.Reader) (*Info, error) {
+	return ReadInfoWithOptions(r, nil)
+}
+
+// ReadInfoWithOptions is like ReadInfo but applies the limits of opts. A nil
+// opts uses CompatLeptonVectorWrite for JPEG and CompatLeptonVectorRead for
+// Lepton files.
+func ReadInfoWithOptions(r io.Reader, opts *Options) (info *Info, err error) {
+	defer recoverPanic(&err)
+	reader := bufio.NewReader(r)
+
+	magic, err := reader.Peek(len(LeptonFileHeader))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file type: %w", err)
+	}
+	if magic[0] == LeptonFileHeader[0] && magic[1] == LeptonFileHeader[1] {
+		if opts == nil {
+			opts = CompatLeptonVectorRead()
+		}
+		return readLeptonInfo(reader, opts)
+	}
+
+	if opts == nil {
+		opts = CompatLeptonVectorWrite()
+	}
+	return readJpegInfo(reader, opts)
+}
+
+// Stat is ReadInfo for the named file
+func Stat(name string) (*Info, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReadInfo(file)
+}
+
+// readLeptonInfo summarizes the header of a Lepton file
+func readLeptonInfo(r io.Reader, opts *Options) (*Info, error) {
+	header, err := ReadLeptonHeaderWithOptions(r, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	info := newInfo("lepton", header.JpegHeader)
+	info.Version = header.Version
+	info.OriginalFileSize = header.OriginalFileSize
+	info.Partitions = len(header.ThreadHandoffs)
+	info.PrefixGarbageSize = len(header.RecoveryInfo.PrefixGarbage)
+	info.GarbageSize = len(header.RecoveryInfo.GarbageData)
+	info.Truncated = header.RecoveryInfo.EarlyEofEncountered
+	return info, nil
+}
+
+// readJpegInfo summarizes the header of a JPEG file, reading up to the first
+// SOS segment
+func readJpegInfo(reader *bufio.Reader, opts *Options) (*Info, error) {
+	prefixGarbage, err := readPrefixGarbage(reader, opts.MaxPrefixGarbage)
+	if err != nil {
+		return nil, err
+	}
+	_, headerBytes, err := parseJpegHeaderFull(reader, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the header again the way Lepton files store it, so that the
+	// sampling factors are read the same for both formats
+	rawHeader := append(append([]byte(nil), SOI[:]...), headerBytes...)
+	header, _, err := parseJpegHeaderWithOptions(rawHeader, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	info := newInfo("jpeg", header)
+	info.PrefixGarbageSize = len(prefixGarbage)
+	return info, nil
+}
+
+// newInfo returns the Info of a file of the given format with the frame
+// information of header filled in
+func newInfo(format string, header *JpegHeader) *Info {
+	info := &Info{
+		Format:     format,
+		JpegType:   jpegTypeName(header),
+		Width:      header.Width,
+		Height:     header.Height,
+		Components: header.Cmpc,
+		Sampling:   make([][2]uint32, header.Cmpc),
+	}
+	for i := range info.Sampling {
+		info.Sampling[i] = [2]uint32{header.CmpInfo[i].Sfh, header.CmpInfo[i].Sfv}
+	}
+	return info
+}
@@ -1,21 +1,36 @@
 package lepton
 
+import "fmt"
+
 // JPEG marker codes
 const (
-	MarkerSOI  = 0xD8 // Start Of Image
-	MarkerEOI  = 0xD9 // End Of Image
-	MarkerSOS  = 0xDA // Start Of Scan
-	MarkerDQT  = 0xDB // Define Quantization Table
-	MarkerDHT  = 0xC4 // Define Huffman Table
-	MarkerDRI  = 0xDD // Define Restart Interval
-	MarkerAPP0 = 0xE0 // Application Segment 0
-	MarkerAPP1 = 0xE1 // Application Segment 1
-	MarkerSOF0 = 0xC0 // Baseline DCT
-	MarkerSOF1 = 0xC1 // Extended Sequential DCT
-	MarkerSOF2 = 0xC2 // Progressive DCT
-	MarkerRST0 = 0xD0 // Restart marker 0
-	MarkerRST7 = 0xD7 // Restart marker 7
-	MarkerCOM  = 0xFE // Comment
+	MarkerSOI   = 0xD8 // Start Of Image
+	MarkerEOI   = 0xD9 // End Of Image
+	MarkerSOS   = 0xDA // Start Of Scan
+	MarkerDQT   = 0xDB // Define Quantization Table
+	MarkerDHT   = 0xC4 // Define Huffman Table
+	MarkerDRI   = 0xDD // Define Restart Interval
+	MarkerAPP0  = 0xE0 // Application Segment 0
+	MarkerAPP1  = 0xE1 // Application Segment 1
+	MarkerAPP2  = 0xE2 // Application Segment 2
+	MarkerAPP15 = 0xEF // Application Segment 15
+	MarkerSOF0  = 0xC0 // Baseline DCT
+	MarkerSOF1  = 0xC1 // Extended Sequential DCT
+	MarkerSOF2  = 0xC2 // Progressive DCT
+	MarkerSOF3  = 0xC3 // Lossless
+	MarkerSOF5  = 0xC5 // Differential Sequential DCT
+	MarkerSOF6  = 0xC6 // Differential Progressive DCT
+	MarkerSOF7  = 0xC7 // Differential Lossless
+	MarkerSOF9  = 0xC9 // Extended Sequential DCT, arithmetic coding
+	MarkerSOF10 = 0xCA // Progressive DCT, arithmetic coding
+	MarkerSOF11 = 0xCB // Lossless, arithmetic coding
+	MarkerSOF13 = 0xCD // Differential Sequential DCT, arithmetic coding
+	MarkerSOF14 = 0xCE // Differential Progressive DCT, arithmetic coding
+	MarkerSOF15 = 0xCF // Differential Lossless, arithmetic coding
+	MarkerDAC   = 0xCC // Define Arithmetic Conditioning
+	MarkerRST0  = 0xD0 // Restart marker 0
+	MarkerRST7  = 0xD7 // Restart marker 7
+	MarkerCOM   = 0xFE // Comment
 )
 
 // JpegHeader contains parsed JPEG header information
@@ -38,6 +53,17 @@ type JpegHeader struct {
 	// HuffAC contains AC Huffman tables
 	HuffAC [4]*HuffmanTable
 
+	// Arithmetic is set for arithmetic coded images (SOF9 and SOF10). The
+	// table indexes of the components then select the conditioning below.
+	Arithmetic bool
+
+	// ArithDCL and ArithDCU are the DC conditioning bounds of each table
+	ArithDCL [4]uint8
+	ArithDCU [4]uint8
+
+	// ArithACK is the AC conditioning of each table
+	ArithACK [4]uint8
+
 	// Height is the image height in pixels
 	Height uint32
 
@@ -95,6 +121,8 @@ type JpegHeader struct {
 func NewJpegHeader() *JpegHeader {
 	h := &JpegHeader{
 		JpegType:           JpegTypeUnknown,
+		ArithDCU:           [4]uint8{1, 1, 1, 1},
+		ArithACK:           [4]uint8{5, 5, 5, 5},
 		Use16BitDCEstimate: true,
 		Use16BitAdvPredict: true,
 	}
@@ -129,6 +157,28 @@ func (h *JpegHeader) GetBlockHeight(cmp int) uint32 {
 	return h.CmpInfo[cmp].Bcv
 }
 
+// checkFrameMarker rejects the SOF markers of the lossless and hierarchical
+// processes, which are not made of DCT blocks that Lepton could code
+func checkFrameMarker(marker byte) error {
+	switch marker {
+	case MarkerSOF3, MarkerSOF11:
+		return NewLeptonError(ExitCodeUnsupportedJpeg, "lossless JPEG not supported")
+	case MarkerSOF5, MarkerSOF6, MarkerSOF7, MarkerSOF13, MarkerSOF14, MarkerSOF15:
+		return NewLeptonError(ExitCodeUnsupportedJpeg, "hierarchical JPEG not supported")
+	}
+	return nil
+}
+
+// checkSamplePrecision rejects frames that are not 8 bit. The coefficients of
+// 12 bit images, which SOF1 allows, are beyond the range of the model.
+func checkSamplePrecision(precision byte) error {
+	if precision != 8 {
+		return NewLeptonError(ExitCodeUnsupportedJpeg,
+			fmt.Sprintf("%d bit sample precision not supported, only 8 bit JPEGs can be compressed", precision))
+	}
+	return nil
+}
+
 // HuffmanTable represents a Huffman table for encoding/decoding
 type HuffmanTable struct {
 	// NumCodes is the count of codes for each bit length (1-16)
@@ -158,6 +208,20 @@ func NewHuffmanTable() *HuffmanTable {
 	return &HuffmanTable{}
 }
 
+// IsValid returns false if the table defines more codes than fit in the
+// code space of their bit lengths
+func (h *HuffmanTable) IsValid() bool {
+	code := 0
+	for bits := 1; bits <= 16; bits++ {
+		code += int(h.NumCodes[bits])
+		if code > 1<<bits {
+			return false
+		}
+		code <<= 1
+	}
+	return true
+}
+
 // BuildDerivedTable builds derived lookup tables for fast decoding
 func (h *HuffmanTable) BuildDerivedTable() {
 	// Count total symbols
@@ -179,6 +243,10 @@ func (h *HuffmanTable) BuildDerivedTable() {
 			shift := 8 - bits
 			baseIdx := code << shift
 			numEntries := 1 << shift
+			if baseIdx+numEntries > len(h.FastLookup) {
+				// Invalid table with codes beyond the code space
+				numEntries = 0
+			}
 			for j := 0; j < numEntries; j++ {
 				// Encode symbol and bit length in lookup value
 				h.FastLookup[baseIdx+j] = int16(h.Symbols[symbolIdx]) | int16(bits<<8)
@@ -3,6 +3,7 @@ package lepton
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 )
@@ -12,12 +13,62 @@ type JpegReadResult struct {
 	ImageData              []*BlockBasedImage
 	Header                 *JpegHeader
 	RawHeader              []byte
+	PrefixGarbage          []byte // data preceding the SOI marker
 	GarbageData            []byte
 	Partitions             []JpegPartition
+	EndScanPosition        int64 // end of the first scan, relative to its start like JpegPartition.Position
 	MaxDPos                [MaxComponents]uint32
+	MaxCmp                 uint32 // highest component index in the progressive scans
+	MaxBpos                uint32 // highest band end in the progressive scans
+	MaxSah                 uint8  // highest successive approximation in the progressive scans
 	EarlyEOF               bool
 	PadBit                 *uint8
-	remainingFromBitReader []byte // unexported: bytes left in BitReader's buffer after scan
+	RestartCount           uint32  // number of RST markers within the first scan
+	MissingRestarts        bool    // some restart intervals end without an RST marker
+	TrailingRestarts       int     // number of RST markers that follow the first scan
+	remainingFromBitReader []byte  // unexported: bytes left in BitReader's buffer after scan
+	truncatedTail          [2]byte // unexported: last two bytes of a truncated scan
+	BytesRead              int64   // number of bytes of the input that belong to the JPEG
+	ExplicitZeroRuns       ExplicitZeroRuns
+}
+
+// ExplicitZeroRuns records the baseline blocks whose last zero coefficients
+// were coded with ZRL symbols before the EOB, or instead of it at the end of
+// the block, rather than with the EOB alone. Lepton only stores coefficients,
+// so the number of ZRLs of each such block is kept to write them again. It
+// is indexed by component and then by block position.
+type ExplicitZeroRuns [MaxComponents]map[uint32]uint8
+
+// set records that the block at dpos of component cmp ends with zrls ZRLs
+func (z *ExplicitZeroRuns) set(cmp int, dpos uint32, zrls uint8) {
+	if z[cmp] == nil {
+		z[cmp] = make(map[uint32]uint8)
+	}
+	z[cmp][dpos] = zrls
+}
+
+// Len returns the number of blocks with explicit zero runs
+func (z *ExplicitZeroRuns) Len() int {
+	n := 0
+	for _, blocks := range z {
+		n += len(blocks)
+	}
+	return n
+}
+
+// trailingZeroRuns returns the number of ZRL symbols that code the zeros
+// between the last nonzero coefficient of a block in zigzag order and its
+// end of block eob. The zeros must make up whole ZRLs.
+func trailingZeroRuns(block *[64]int16, eob int) (uint8, error) {
+	last := eob - 1
+	for last > 0 && block[last] == 0 {
+		last--
+	}
+	zeros := eob - 1 - last
+	if zeros%16 != 0 {
+		return 0, NewLeptonError(ExitCodeUnsupportedJpeg, "cannot encode image with eob after last 0")
+	}
+	return uint8(zeros / 16), nil
 }
 
 // JpegPartition contains information about a partition in the JPEG scan
@@ -32,29 +83,58 @@ type JpegPartition struct {
 
 // ReadJpegFile reads a JPEG file and extracts DCT coefficients
 func ReadJpegFile(reader io.Reader) (*JpegReadResult, error) {
-	// Buffer the reader for efficient reading
-	bufReader := bufio.NewReader(reader)
+	return ReadJpegFileWithOptions(reader, CompatLeptonVectorWrite())
+}
 
-	// Read SOI marker
-	header := make([]byte, 2)
-	if _, err := io.ReadFull(bufReader, header); err != nil {
-		return nil, fmt.Errorf("failed to read JPEG header: %w", err)
+// ReadJpegFileWithOptions reads a JPEG file and extracts DCT coefficients,
+// rejecting anything the options do not allow.
+// With StopReadingAtEOI the reader is left positioned right after the EOI
+// marker, see newStopAtEOIReader.
+func ReadJpegFileWithOptions(reader io.Reader, opts *Options) (_ *JpegReadResult, err error) {
+	defer recoverPanic(&err)
+	if !opts.StopReadingAtEOI {
+		return readJpegFile(reader, opts)
 	}
-	if header[0] != 0xFF || header[1] != MarkerSOI {
-		return nil, NewLeptonError(ExitCodeUnsupportedJpeg, "JPEG must start with 0xFF 0xD8")
+
+	source, rewind := newStopAtEOIReader(reader)
+	counter := &countingReader{reader: source}
+	result, err := readJpegFile(counter, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := rewind(counter.count, result.BytesRead); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// readJpegFile reads a JPEG file without regard to where the reader is left
+func readJpegFile(reader io.Reader, opts *Options) (*JpegReadResult, error) {
+	// Buffer the reader for efficient reading, counting what is taken from it
+	counter := &countingReader{reader: reader}
+	bufReader := bufio.NewReader(counter)
+
+	// Read SOI marker, keeping whatever precedes it as prefix garbage
+	prefixGarbage, err := readPrefixGarbage(bufReader, opts.MaxPrefixGarbage)
+	if err != nil {
+		return nil, err
 	}
 
 	rawHeader := make([]byte, 0, 4096)
-	rawHeader = append(rawHeader, header...)
+	rawHeader = append(rawHeader, SOI[:]...)
 
 	// Parse JPEG header
-	jpegHeader, headerBytes, err := parseJpegHeaderFull(bufReader)
+	jpegHeader, headerBytes, err := parseJpegHeaderFull(bufReader, opts)
 	if err != nil {
 		return nil, err
 	}
 	rawHeader = append(rawHeader, headerBytes...)
 
-	if jpegHeader.Cmpc > ColorChannelNumBlockTypes {
+	if !opts.Progressive && jpegHeader.JpegType == JpegTypeProgressive {
+		return nil, NewLeptonError(ExitCodeProgressiveUnsupported, "file is progressive, but this is disabled")
+	}
+
+	if !opts.AllowFourComponents && jpegHeader.Cmpc > ColorChannelNumBlockTypes {
 		return nil, NewLeptonError(ExitCodeUnsupported4Colors, "doesn't support 4 color channels")
 	}
 
@@ -67,40 +147,156 @@ func ReadJpegFile(reader io.Reader) (*JpegReadResult, error) {
 	}
 
 	result := &JpegReadResult{
-		ImageData: imageData,
-		Header:    jpegHeader,
-		RawHeader: rawHeader,
+		ImageData:     imageData,
+		Header:        jpegHeader,
+		RawHeader:     rawHeader,
+		PrefixGarbage: prefixGarbage,
 	}
 
-	if jpegHeader.JpegType == JpegTypeSequential {
+	if jpegHeader.Arithmetic {
+		// Arithmetic coded scans are all read and regenerated one by one
+		if err := readArithmeticScans(bufReader, jpegHeader, result, opts); err != nil {
+			return nil, err
+		}
+	} else if jpegHeader.JpegType == JpegTypeSequential {
 		// Read the single baseline scan
-		if err := readBaselineScan(bufReader, jpegHeader, result); err != nil {
+		if err := readBaselineScan(bufReader, jpegHeader, result, opts); err != nil {
 			return nil, err
 		}
 
-		// Read any remaining data as garbage
-		var garbage []byte
-		if len(result.remainingFromBitReader) > 0 {
-			garbage = append(garbage, result.remainingFromBitReader...)
-		}
-		remaining, err := io.ReadAll(bufReader)
-		if err != nil && err != io.EOF {
-			return nil, fmt.Errorf("failed to read garbage data: %w", err)
+		if result.EarlyEOF {
+			if opts.StopReadingAtEOI {
+				return nil, NewLeptonError(ExitCodeShortRead, "early EOF encountered")
+			}
+			if err := truncateScan(result); err != nil {
+				return nil, err
+			}
+		} else if opts.StopReadingAtEOI {
+			// Ensure there is an actual EOI marker since we haven't consumed it yet
+			endOfFile := make([]byte, 2)
+			if _, err := io.ReadFull(bufReader, endOfFile); err != nil {
+				return nil, NewLeptonError(ExitCodeShortRead, "JPEG file does not end with EOI marker")
+			}
+			if endOfFile[0] != EOI[0] || endOfFile[1] != EOI[1] {
+				return nil, NewLeptonError(ExitCodeUnsupportedJpeg, "JPEG file does not end with EOI marker")
+			}
+			result.GarbageData = endOfFile
+		} else {
+			// Read any remaining data as garbage
+			var garbage []byte
+			if len(result.remainingFromBitReader) > 0 {
+				garbage = append(garbage, result.remainingFromBitReader...)
+			}
+			remaining, err := io.ReadAll(bufReader)
+			if err != nil && err != io.EOF {
+				return nil, fmt.Errorf("failed to read garbage data: %w", err)
+			}
+			garbage = append(garbage, remaining...)
+			result.GarbageData = garbage
 		}
-		garbage = append(garbage, remaining...)
-		result.GarbageData = garbage
 	} else {
 		// Progressive JPEG - read multiple scans
-		if err := readProgressiveScans(bufReader, jpegHeader, result); err != nil {
+		if err := readProgressiveScans(bufReader, jpegHeader, result, opts); err != nil {
 			return nil, err
 		}
 	}
 
+	result.BytesRead = counter.count - int64(bufReader.Buffered())
+
 	return result, nil
 }
 
+// readPrefixGarbage consumes the input up to and including the SOI marker and
+// returns the bytes that precede it. At most limit bytes may precede SOI.
+func readPrefixGarbage(reader *bufio.Reader, limit uint32) ([]byte, error) {
+	var prefix []byte
+	for {
+		marker, err := reader.Peek(2)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read JPEG header: %w", err)
+		}
+		if marker[0] == 0xFF && marker[1] == MarkerSOI {
+			reader.Discard(2)
+			return prefix, nil
+		}
+		if uint32(len(prefix)) >= limit {
+			return nil, NewLeptonError(ExitCodeUnsupportedJpeg, "JPEG must start with 0xFF 0xD8")
+		}
+		prefix = append(prefix, marker[0])
+		reader.Discard(1)
+	}
+}
+
+// newStopAtEOIReader returns a reader for a JPEG that may be followed by other
+// data, and a function that puts reader back right after the image once it is
+// known how many of the bytes read were used. Readers that can seek are read
+// in bulk and seeked back. Anything else is read one byte at a time so that
+// nothing past the image is taken from it. That is cheap for an io.ByteReader
+// such as a bufio.Reader, but costs a Read call per byte otherwise, so pipes
+// and network connections should be wrapped in a bufio.Reader by the caller.
+func newStopAtEOIReader(reader io.Reader) (io.Reader, func(read, used int64) error) {
+	// An *os.File for a pipe is an io.Seeker whose Seek always fails
+	if seeker, ok := reader.(io.Seeker); ok {
+		if _, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			return reader, func(read, used int64) error {
+				if read == used {
+					return nil
+				}
+				if _, err := seeker.Seek(used-read, io.SeekCurrent); err != nil {
+					return fmt.Errorf("failed to seek to the end of the JPEG: %w", err)
+				}
+				return nil
+			}
+		}
+	}
+
+	byteAtATime := &byteAtATimeReader{reader: reader}
+	byteAtATime.byteReader, _ = reader.(io.ByteReader)
+	return byteAtATime, func(read, used int64) error {
+		if read != used {
+			return NewLeptonError(ExitCodeAssertionFailure, "read past the end of the JPEG")
+		}
+		return nil
+	}
+}
+
+// byteAtATimeReader reads at most one byte from the underlying reader per
+// call, with ReadByte if it has one
+type byteAtATimeReader struct {
+	reader     io.Reader
+	byteReader io.ByteReader
+}
+
+func (r *byteAtATimeReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if r.byteReader == nil {
+		return r.reader.Read(p[:1])
+	}
+
+	b, err := r.byteReader.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	p[0] = b
+	return 1, nil
+}
+
+// countingReader wraps a reader and counts bytes read
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
 // parseJpegHeaderFull parses the JPEG header segments until SOS
-func parseJpegHeaderFull(reader *bufio.Reader) (*JpegHeader, []byte, error) {
+func parseJpegHeaderFull(reader *bufio.Reader, opts *Options) (*JpegHeader, []byte, error) {
 	header := NewJpegHeader()
 	rawBytes := make([]byte, 0, 2048)
 
@@ -146,20 +342,36 @@ func parseJpegHeaderFull(reader *bufio.Reader) (*JpegHeader, []byte, error) {
 		switch markerType {
 		case MarkerSOF0, MarkerSOF1:
 			// Baseline or Extended Sequential DCT
-			if err := parseSOFRead(header, segmentData, JpegTypeSequential); err != nil {
+			if err := parseSOFRead(header, segmentData, JpegTypeSequential, opts); err != nil {
 				return nil, nil, err
 			}
 		case MarkerSOF2:
 			// Progressive DCT
-			if err := parseSOFRead(header, segmentData, JpegTypeProgressive); err != nil {
+			if err := parseSOFRead(header, segmentData, JpegTypeProgressive, opts); err != nil {
+				return nil, nil, err
+			}
+		case MarkerSOF9:
+			// Extended Sequential DCT, arithmetic coding
+			if err := parseSOFRead(header, segmentData, JpegTypeSequential, opts); err != nil {
+				return nil, nil, err
+			}
+			header.Arithmetic = true
+		case MarkerSOF10:
+			// Progressive DCT, arithmetic coding
+			if err := parseSOFRead(header, segmentData, JpegTypeProgressive, opts); err != nil {
+				return nil, nil, err
+			}
+			header.Arithmetic = true
+		case MarkerDAC:
+			if err := parseDAC(header, segmentData); err != nil {
 				return nil, nil, err
 			}
 		case MarkerDHT:
-			if err := parseDHTRead(header, segmentData); err != nil {
+			if err := parseDHTRead(header, segmentData, opts); err != nil {
 				return nil, nil, err
 			}
 		case MarkerDQT:
-			if err := parseDQTRead(header, segmentData); err != nil {
+			if err := parseDQTRead(header, segmentData, opts); err != nil {
 				return nil, nil, err
 			}
 		case MarkerDRI:
@@ -173,13 +385,16 @@ func parseJpegHeaderFull(reader *bufio.Reader) (*JpegHeader, []byte, error) {
 			// SOS means we're done with headers
 			return header, rawBytes, nil
 		default:
-			// Skip unknown/APP segments
+			// Skip unknown/APP segments, but not the frames of other processes
+			if err := checkFrameMarker(markerType); err != nil {
+				return nil, nil, err
+			}
 		}
 	}
 }
 
 // parseSOFRead parses Start Of Frame segment during JPEG reading
-func parseSOFRead(header *JpegHeader, data []byte, jpegType JpegType) error {
+func parseSOFRead(header *JpegHeader, data []byte, jpegType JpegType, opts *Options) error {
 	if len(data) < 6 {
 		return NewLeptonError(ExitCodeUnsupportedJpeg, "SOF segment too short")
 	}
@@ -190,10 +405,8 @@ func parseSOFRead(header *JpegHeader, data []byte, jpegType JpegType) error {
 
 	header.JpegType = jpegType
 
-	precision := data[0]
-	if precision != 8 {
-		return NewLeptonError(ExitCodeUnsupportedJpeg,
-			fmt.Sprintf("%d bit precision not supported", precision))
+	if err := checkSamplePrecision(data[0]); err != nil {
+		return err
 	}
 
 	header.Height = uint32(data[1])<<8 | uint32(data[2])
@@ -204,6 +417,10 @@ func parseSOFRead(header *JpegHeader, data []byte, jpegType JpegType) error {
 		return NewLeptonError(ExitCodeUnsupportedJpeg, "image dimensions cannot be zero")
 	}
 
+	if err := opts.checkDimensions(header.Width, header.Height, ExitCodeUnsupportedJpeg); err != nil {
+		return err
+	}
+
 	if header.Cmpc > 4 {
 		return NewLeptonError(ExitCodeUnsupportedJpeg,
 			fmt.Sprintf("image has %d components, max 4 supported", header.Cmpc))
@@ -219,7 +436,11 @@ func parseSOFRead(header *JpegHeader, data []byte, jpegType JpegType) error {
 		header.CmpInfo[cmp].Sfv = uint32(data[pos+1] >> 4)
 		header.CmpInfo[cmp].Sfh = uint32(data[pos+1] & 0x0F)
 
-		if header.CmpInfo[cmp].Sfv > 2 || header.CmpInfo[cmp].Sfh > 2 {
+		if header.CmpInfo[cmp].Sfv < 1 || header.CmpInfo[cmp].Sfv > 4 ||
+			header.CmpInfo[cmp].Sfh < 1 || header.CmpInfo[cmp].Sfh > 4 {
+			return NewLeptonError(ExitCodeUnsupportedJpeg, "sampling factors must be between 1 and 4")
+		}
+		if !opts.AllowSamplingBeyondTwo && (header.CmpInfo[cmp].Sfv > 2 || header.CmpInfo[cmp].Sfh > 2) {
 			return NewLeptonError(ExitCodeSamplingBeyondTwoUnsupported,
 				"sampling factor beyond 2 not supported")
 		}
@@ -269,7 +490,7 @@ func parseSOFRead(header *JpegHeader, data []byte, jpegType JpegType) error {
 }
 
 // parseDHTRead parses Define Huffman Table segment during JPEG reading
-func parseDHTRead(header *JpegHeader, data []byte) error {
+func parseDHTRead(header *JpegHeader, data []byte, opts *Options) error {
 	pos := 0
 	for pos < len(data) {
 		if pos >= len(data) {
@@ -307,6 +528,10 @@ func parseDHTRead(header *JpegHeader, data []byte) error {
 		}
 		pos += totalSymbols
 
+		if !opts.AcceptInvalidDHT && !ht.IsValid() {
+			return NewLeptonError(ExitCodeUnsupportedJpeg, "Huffman table out of space")
+		}
+
 		ht.BuildDerivedTable()
 
 		if tableClass == 0 {
@@ -320,7 +545,7 @@ func parseDHTRead(header *JpegHeader, data []byte) error {
 }
 
 // parseDQTRead parses Define Quantization Table segment during JPEG reading
-func parseDQTRead(header *JpegHeader, data []byte) error {
+func parseDQTRead(header *JpegHeader, data []byte, opts *Options) error {
 	pos := 0
 	for pos < len(data) {
 		precision := (data[pos] >> 4) & 0x0F
@@ -338,6 +563,12 @@ func parseDQTRead(header *JpegHeader, data []byte) error {
 			}
 			for i := 0; i < 64; i++ {
 				header.QTables[tableID][i] = uint16(data[pos+i])
+				if header.QTables[tableID][i] == 0 {
+					if opts.RejectDQTsWithZeros {
+						return NewLeptonError(ExitCodeUnsupportedJpegWithZeroIdct0, "DQT has zero value")
+					}
+					break
+				}
 			}
 			pos += 64
 		} else {
@@ -347,6 +578,12 @@ func parseDQTRead(header *JpegHeader, data []byte) error {
 			}
 			for i := 0; i < 64; i++ {
 				header.QTables[tableID][i] = uint16(data[pos+i*2])<<8 | uint16(data[pos+i*2+1])
+				if header.QTables[tableID][i] == 0 {
+					if opts.RejectDQTsWithZeros {
+						return NewLeptonError(ExitCodeUnsupportedJpegWithZeroIdct0, "DQT has zero value")
+					}
+					break
+				}
 			}
 			pos += 128
 		}
@@ -372,6 +609,7 @@ func parseSOSRead(header *JpegHeader, data []byte) error {
 	header.ScanComponentOrder = make([]int, numComponents)
 
 	pos := 1
+	blocksPerMcu := uint32(0)
 	for i := 0; i < numComponents; i++ {
 		if pos+2 > len(data) {
 			return NewLeptonError(ExitCodeUnsupportedJpeg, "SOS segment too short for components")
@@ -390,13 +628,24 @@ func parseSOSRead(header *JpegHeader, data []byte) error {
 			return NewLeptonError(ExitCodeUnsupportedJpeg, "component ID mismatch in SOS")
 		}
 
+		if data[pos+1]>>4 > 3 || data[pos+1]&0x0F > 3 {
+			return NewLeptonError(ExitCodeUnsupportedJpeg, "table index out of range in SOS")
+		}
+
 		header.ScanComponentOrder[i] = cmpIdx
 		header.CmpInfo[cmpIdx].HuffDC = (data[pos+1] >> 4) & 0x0F
 		header.CmpInfo[cmpIdx].HuffAC = data[pos+1] & 0x0F
+		blocksPerMcu += header.CmpInfo[cmpIdx].Sfh * header.CmpInfo[cmpIdx].Sfv
 
 		pos += 2
 	}
 
+	// JPEG limits the MCU of an interleaved scan to 10 blocks
+	if numComponents > 1 && blocksPerMcu > 10 {
+		return NewLeptonError(ExitCodeUnsupportedJpeg,
+			fmt.Sprintf("interleaved scan has %d blocks per MCU, max 10", blocksPerMcu))
+	}
+
 	if pos+3 > len(data) {
 		return NewLeptonError(ExitCodeUnsupportedJpeg, "SOS segment too short for spectral selection")
 	}
@@ -410,7 +659,7 @@ func parseSOSRead(header *JpegHeader, data []byte) error {
 }
 
 // readBaselineScan reads baseline JPEG scan data
-func readBaselineScan(reader *bufio.Reader, header *JpegHeader, result *JpegReadResult) error {
+func readBaselineScan(reader *bufio.Reader, header *JpegHeader, result *JpegReadResult, opts *Options) error {
 	bitReader := NewBitReader(reader)
 
 	state := NewJpegPositionState(header, 0)
@@ -452,12 +701,19 @@ func readBaselineScan(reader *bufio.Reader, header *JpegHeader, result *JpegRead
 				return err
 			}
 
+			cmp := state.GetCmp()
 			if eob > 1 && block[eob-1] == 0 {
-				return NewLeptonError(ExitCodeUnsupportedJpeg, "cannot encode image with eob after last 0")
+				if !opts.AllowExplicitZeroRuns {
+					return NewLeptonError(ExitCodeUnsupportedJpeg, "cannot encode image with eob after last 0")
+				}
+				zrls, err := trailingZeroRuns(&block, eob)
+				if err != nil {
+					return err
+				}
+				result.ExplicitZeroRuns.set(cmp, state.GetDpos(), zrls)
 			}
 
 			// Apply DC prediction
-			cmp := state.GetCmp()
 			block[0] = block[0] + lastDC[cmp]
 			lastDC[cmp] = block[0]
 
@@ -477,6 +733,8 @@ func readBaselineScan(reader *bufio.Reader, header *JpegHeader, result *JpegRead
 			// Check for EOF
 			if bitReader.IsEOF() {
 				result.EarlyEOF = true
+				result.EndScanPosition = bitReader.ConsumedPosition()
+				result.truncatedTail = bitReader.LastBytes()
 				return nil
 			}
 
@@ -492,8 +750,12 @@ func readBaselineScan(reader *bufio.Reader, header *JpegHeader, result *JpegRead
 						result.PadBit = &padBit
 					}
 				}
+				if err := readTrailingRestarts(bitReader, header, result); err != nil {
+					return err
+				}
 				// Store remaining buffer for garbage data collection
 				result.remainingFromBitReader = bitReader.RemainingBuffer()
+				result.EndScanPosition = bitReader.ConsumedPosition()
 				return nil
 			}
 
@@ -512,10 +774,25 @@ func readBaselineScan(reader *bufio.Reader, header *JpegHeader, result *JpegRead
 					result.PadBit = &padBit
 				}
 
-				// Verify reset code
-				if err := bitReader.VerifyResetCode(); err != nil {
+				// Lepton only records how many RST markers the scan contains, so
+				// once an interval ends without one no later interval may have one
+				marker, err := bitReader.NextMarker()
+				if err != nil {
 					return err
 				}
+				isRst := marker >= MarkerRST0 && marker <= MarkerRST7
+				switch {
+				case isRst && result.MissingRestarts:
+					return NewLeptonError(ExitCodeInvalidResetCode,
+						fmt.Sprintf("reset code ff %02x found after a restart interval without one", marker))
+				case isRst:
+					if err := bitReader.VerifyResetCode(); err != nil {
+						return err
+					}
+					result.RestartCount++
+				default:
+					result.MissingRestarts = true
+				}
 
 				// Reset DC values
 				lastDC = [MaxComponents]int16{}
@@ -525,6 +802,60 @@ func readBaselineScan(reader *bufio.Reader, header *JpegHeader, result *JpegRead
 	}
 }
 
+// truncateScan moves the last two bytes of a scan that ended early into the
+// garbage data. The decoder assumes that a file without garbage ends properly,
+// so a truncated file must always have some.
+func truncateScan(result *JpegReadResult) error {
+	if result.EndScanPosition < 2 {
+		return NewLeptonError(ExitCodeUnsupportedJpeg, "no scan data found in JPEG file")
+	}
+	result.EndScanPosition -= 2
+
+	// Partitions that would start in what is now garbage are merged into the
+	// one before them, which runs to the end of the image anyway
+	for len(result.Partitions) > 1 && result.Partitions[len(result.Partitions)-1].Position >= result.EndScanPosition {
+		result.Partitions = result.Partitions[:len(result.Partitions)-1]
+	}
+	if len(result.Partitions) > 0 && result.Partitions[0].Position >= result.EndScanPosition {
+		return NewLeptonError(ExitCodeUnsupportedJpeg, "partition conflicts with garbage data")
+	}
+
+	result.GarbageData = result.truncatedTail[:]
+	return nil
+}
+
+// readTrailingRestarts consumes the RST markers that directly follow the scan,
+// as long as they continue the numbering of the restart intervals. The decoder
+// recreates them from the FRS section.
+func readTrailingRestarts(bitReader *BitReader, header *JpegHeader, result *JpegReadResult) error {
+	cumulativeResetMarkers := uint32(0)
+	if header.RestartInterval != 0 {
+		cumulativeResetMarkers = (header.Mcuh*header.Mcuv - 1) / uint32(header.RestartInterval)
+	}
+
+	// The FRS section stores the count in a single byte
+	for result.TrailingRestarts < 255 {
+		marker, err := bitReader.NextMarker()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		expected := MarkerRST0 + byte((cumulativeResetMarkers+uint32(result.TrailingRestarts))&7)
+		if marker != expected {
+			return nil
+		}
+		if err := bitReader.SkipMarker(); err != nil {
+			return err
+		}
+		result.TrailingRestarts++
+	}
+
+	return nil
+}
+
 // decodeBlockSeq decodes a sequential baseline block
 func decodeBlockSeq(bitReader *BitReader, header *JpegHeader, cmp int) ([64]int16, int, error) {
 	var block [64]int16
@@ -546,6 +877,7 @@ func decodeBlockSeq(bitReader *BitReader, header *JpegHeader, cmp int) ([64]int1
 
 	// Decode AC coefficients
 	pos := 1
+	eofFixup := false
 	for pos < 64 {
 		z, coef, isEOB, err := readACCoef(bitReader, acTable)
 		if err != nil {
@@ -558,11 +890,7 @@ func decodeBlockSeq(bitReader *BitReader, header *JpegHeader, cmp int) ([64]int1
 		}
 
 		if z+pos >= 64 {
-			if !bitReader.IsEOF() {
-				return block, eob, NewLeptonError(ExitCodeUnsupportedJpeg,
-					"run length exceeds block boundary")
-			}
-			// Handle truncated file
+			eofFixup = true
 			break
 		}
 
@@ -571,6 +899,18 @@ func decodeBlockSeq(bitReader *BitReader, header *JpegHeader, cmp int) ([64]int1
 		pos++
 	}
 
+	// Once the file ends the bit reader returns zeros, which decode as long
+	// zero runs. Outside of that case the JPEG cannot be recoded.
+	if eofFixup {
+		if !bitReader.IsEOF() {
+			return block, eob, NewLeptonError(ExitCodeUnsupportedJpeg,
+				"run length exceeds block boundary")
+		}
+
+		// The block is written back up to eob, so end it with a nonzero value
+		block[eob-1] = 1
+	}
+
 	return block, eob, nil
 }
 
@@ -679,8 +1019,9 @@ func ReadJpegBytes(data []byte) (*JpegReadResult, error) {
 }
 
 // readProgressiveScans reads all progressive scans from a JPEG file
-func readProgressiveScans(reader *bufio.Reader, header *JpegHeader, result *JpegReadResult) error {
+func readProgressiveScans(reader *bufio.Reader, header *JpegHeader, result *JpegReadResult, opts *Options) error {
 	// Read first scan (DC first stage for all components)
+	recordScanProgress(header, result)
 	scanReader, err := readProgressiveFirstScan(reader, header, result)
 	if err != nil {
 		return err
@@ -688,6 +1029,10 @@ func readProgressiveScans(reader *bufio.Reader, header *JpegHeader, result *Jpeg
 
 	// Read subsequent scans until we hit EOI
 	for {
+		if result.EarlyEOF {
+			return truncateProgressiveScans(header, result, opts)
+		}
+
 		// Create a combined reader: remaining buffer from BitReader + underlying reader
 		var combinedReader *bufio.Reader
 		if scanReader != nil && len(scanReader.RemainingBuffer()) > 0 {
@@ -697,49 +1042,134 @@ func readProgressiveScans(reader *bufio.Reader, header *JpegHeader, result *Jpeg
 			combinedReader = reader
 		}
 
-		// Try to parse the next scan header
-		moreScans, headerBytes, err := parseNextScanHeader(combinedReader, header)
+		moreScans, err := readNextScanHeader(combinedReader, header, result, opts)
+		if err != nil || !moreScans {
+			return err
+		}
+
+		// Read this scan
+		recordScanProgress(header, result)
+		scanReader, err = readProgressiveScanWithReader(combinedReader, header, result)
 		if err != nil {
 			return err
 		}
+	}
+}
 
-		// Accumulate header bytes
-		result.RawHeader = append(result.RawHeader, headerBytes...)
+// readNextScanHeader reads the segments up to the next SOS marker of a
+// multi-scan image and adds them to the raw header. It returns false when the
+// image ends instead: at EOI, keeping it and whatever follows as garbage, or
+// at the end of the file, keeping the partial segments as garbage.
+func readNextScanHeader(reader *bufio.Reader, header *JpegHeader, result *JpegReadResult, opts *Options) (bool, error) {
+	moreScans, headerBytes, err := parseNextScanHeader(reader, header, opts)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		// The file ends between scans, keep what there is of the header as garbage
+		if opts.StopReadingAtEOI {
+			return false, NewLeptonError(ExitCodeShortRead, "JPEG file does not end with EOI marker")
+		}
+		result.GarbageData = headerBytes
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
 
-		if !moreScans {
-			// We hit EOI, done reading scans
-			// EOI is included in headerBytes, treat as garbage since we'll reconstruct it
-			result.GarbageData = []byte{0xFF, MarkerEOI}
+	// Accumulate header bytes
+	result.RawHeader = append(result.RawHeader, headerBytes...)
 
-			// Read any remaining data after EOI as additional garbage
-			remaining, err := io.ReadAll(combinedReader)
-			if err != nil && err != io.EOF {
-				return fmt.Errorf("failed to read garbage data: %w", err)
-			}
-			if len(remaining) > 0 {
-				result.GarbageData = append(result.GarbageData, remaining...)
-			}
-			return nil
+	if moreScans {
+		return true, nil
+	}
+
+	// We hit EOI, done reading scans
+	// EOI is included in headerBytes, treat as garbage since we'll reconstruct it
+	result.GarbageData = []byte{0xFF, MarkerEOI}
+
+	if opts.StopReadingAtEOI {
+		return false, nil
+	}
+
+	// Read any remaining data after EOI as additional garbage
+	remaining, err := io.ReadAll(reader)
+	if err != nil && err != io.EOF {
+		return false, fmt.Errorf("failed to read garbage data: %w", err)
+	}
+	if len(remaining) > 0 {
+		result.GarbageData = append(result.GarbageData, remaining...)
+	}
+	return false, nil
+}
+
+// recordScanProgress tracks how far the progressive scans reach, which is
+// stored alongside truncated images
+func recordScanProgress(header *JpegHeader, result *JpegReadResult) {
+	if uint32(header.CsTo) > result.MaxBpos {
+		result.MaxBpos = uint32(header.CsTo)
+	}
+	if header.CsSah > result.MaxSah {
+		result.MaxSah = header.CsSah
+	}
+	if header.CsSal > result.MaxSah {
+		result.MaxSah = header.CsSal
+	}
+	for _, cmp := range header.ScanComponentOrder {
+		if uint32(cmp) > result.MaxCmp {
+			result.MaxCmp = uint32(cmp)
 		}
+	}
+}
 
-		// Read this scan
-		scanReader, err = readProgressiveScanWithReader(combinedReader, header, result)
-		if err != nil {
-			return err
+// endTruncatedRun gives the block following the end of a truncated AC scan a
+// new nonzero coefficient, so that the writer ends its run of empty blocks
+// where the file ended. Everything from that block on is cut from the output.
+func endTruncatedRun(result *JpegReadResult, header *JpegHeader, state *JpegPositionState, sta JpegDecodeStatus) {
+	if sta != DecodeInProgress {
+		// Runs of empty blocks end with the scan or restart interval anyway
+		return
+	}
+
+	block := result.ImageData[state.GetCmp()].EnsureBlock(state.GetDpos())
+	for bpos := int(header.CsFrom); bpos <= int(header.CsTo); bpos++ {
+		if block.GetTransposedFromZigzag(bpos) == 0 {
+			block.SetTransposedFromZigzag(bpos, 1<<header.CsSal)
+			return
 		}
 	}
 }
 
+// truncatedBeforeMarker reports whether the file ends where a restart marker
+// is expected
+func truncatedBeforeMarker(bitReader *BitReader) bool {
+	_, err := bitReader.NextMarker()
+	return err == io.EOF
+}
+
+// truncateProgressiveScans finishes reading a progressive or arithmetic coded
+// image whose last scan ended early. The decoder regenerates every scan in full and cuts its
+// output at the original file size, so no block is left out of the Lepton data.
+func truncateProgressiveScans(header *JpegHeader, result *JpegReadResult, opts *Options) error {
+	if opts.StopReadingAtEOI {
+		return NewLeptonError(ExitCodeShortRead, "early EOF encountered")
+	}
+
+	result.EarlyEOF = true
+	for i := 0; i < header.Cmpc; i++ {
+		result.MaxDPos[i] = header.CmpInfo[i].Bc - 1
+	}
+	return nil
+}
+
 // parseNextScanHeader parses headers until the next SOS or EOI marker
-// Returns true if more scans to read, false if EOI was encountered
-func parseNextScanHeader(reader *bufio.Reader, header *JpegHeader) (bool, []byte, error) {
+// Returns true if more scans to read, false if EOI was encountered.
+// If the file ends first, the bytes read so far are returned with the error.
+func parseNextScanHeader(reader *bufio.Reader, header *JpegHeader, opts *Options) (bool, []byte, error) {
 	rawBytes := make([]byte, 0, 256)
 
 	for {
 		// Read marker
 		marker := make([]byte, 2)
-		if _, err := io.ReadFull(reader, marker); err != nil {
-			return false, nil, fmt.Errorf("failed to read marker: %w", err)
+		if n, err := io.ReadFull(reader, marker); err != nil {
+			return false, append(rawBytes, marker[:n]...), fmt.Errorf("failed to read marker: %w", err)
 		}
 		rawBytes = append(rawBytes, marker...)
 
@@ -758,8 +1188,8 @@ func parseNextScanHeader(reader *bufio.Reader, header *JpegHeader) (bool, []byte
 
 		// Read segment length
 		lenBytes := make([]byte, 2)
-		if _, err := io.ReadFull(reader, lenBytes); err != nil {
-			return false, nil, fmt.Errorf("failed to read segment length: %w", err)
+		if n, err := io.ReadFull(reader, lenBytes); err != nil {
+			return false, append(rawBytes, lenBytes[:n]...), fmt.Errorf("failed to read segment length: %w", err)
 		}
 		rawBytes = append(rawBytes, lenBytes...)
 
@@ -770,19 +1200,23 @@ func parseNextScanHeader(reader *bufio.Reader, header *JpegHeader) (bool, []byte
 
 		// Read segment data
 		segmentData := make([]byte, segmentLen-2)
-		if _, err := io.ReadFull(reader, segmentData); err != nil {
-			return false, nil, fmt.Errorf("failed to read segment data: %w", err)
+		if n, err := io.ReadFull(reader, segmentData); err != nil {
+			return false, append(rawBytes, segmentData[:n]...), fmt.Errorf("failed to read segment data: %w", err)
 		}
 		rawBytes = append(rawBytes, segmentData...)
 
 		// Parse segment based on type
 		switch markerType {
 		case MarkerDHT:
-			if err := parseDHTRead(header, segmentData); err != nil {
+			if err := parseDHTRead(header, segmentData, opts); err != nil {
 				return false, nil, err
 			}
 		case MarkerDQT:
-			if err := parseDQTRead(header, segmentData); err != nil {
+			if err := parseDQTRead(header, segmentData, opts); err != nil {
+				return false, nil, err
+			}
+		case MarkerDAC:
+			if err := parseDAC(header, segmentData); err != nil {
 				return false, nil, err
 			}
 		case MarkerDRI:
@@ -863,6 +1297,13 @@ func readProgressiveFirstScan(reader *bufio.Reader, header *JpegHeader, result *
 				if state.GetMcu()%header.Mcuh == 0 && oldMcu != state.GetMcu() {
 					doHandoff = true
 				}
+
+				// The rest of a truncated scan is not part of the file
+				if bitReader.ConsumedPastEOF() {
+					result.EarlyEOF = true
+					result.EndScanPosition = bitReader.ConsumedPosition()
+					return bitReader, nil
+				}
 			}
 
 			// Verify fill bits at end of restart interval or scan
@@ -880,6 +1321,10 @@ func readProgressiveFirstScan(reader *bufio.Reader, header *JpegHeader, result *
 			}
 
 			if sta == RestartIntervalExpired {
+				if truncatedBeforeMarker(bitReader) {
+					result.EarlyEOF = true
+					break
+				}
 				if err := bitReader.VerifyResetCode(); err != nil {
 					return nil, err
 				}
@@ -888,6 +1333,7 @@ func readProgressiveFirstScan(reader *bufio.Reader, header *JpegHeader, result *
 			}
 		}
 
+		result.EndScanPosition = bitReader.ConsumedPosition()
 		return bitReader, nil
 	}
 
@@ -982,6 +1428,12 @@ func readProgressiveDCRefine(bitReader *BitReader, header *JpegHeader, result *J
 			block.SetTransposedFromZigzag(0, current+(int16(bit)<<header.CsSal))
 
 			sta = state.NextMcuPos(header)
+
+			// The rest of a truncated scan is not part of the file
+			if bitReader.ConsumedPastEOF() {
+				result.EarlyEOF = true
+				return nil
+			}
 		}
 
 		// Verify fill bits
@@ -999,6 +1451,10 @@ func readProgressiveDCRefine(bitReader *BitReader, header *JpegHeader, result *J
 		}
 
 		if sta == RestartIntervalExpired {
+			if truncatedBeforeMarker(bitReader) {
+				result.EarlyEOF = true
+				return nil
+			}
 			if err := bitReader.VerifyResetCode(); err != nil {
 				return err
 			}
@@ -1044,6 +1500,13 @@ func readProgressiveACFirst(bitReader *BitReader, header *JpegHeader, result *Jp
 			if sta == DecodeInProgress {
 				sta = state.NextMcuPos(header)
 			}
+
+			// The rest of a truncated scan is not part of the file
+			if bitReader.ConsumedPastEOF() {
+				result.EarlyEOF = true
+				endTruncatedRun(result, header, state, sta)
+				return nil
+			}
 		}
 
 		// Verify fill bits
@@ -1061,6 +1524,10 @@ func readProgressiveACFirst(bitReader *BitReader, header *JpegHeader, result *Jp
 		}
 
 		if sta == RestartIntervalExpired {
+			if truncatedBeforeMarker(bitReader) {
+				result.EarlyEOF = true
+				return nil
+			}
 			if err := bitReader.VerifyResetCode(); err != nil {
 				return err
 			}
@@ -1188,6 +1655,13 @@ func readProgressiveACRefine(bitReader *BitReader, header *JpegHeader, result *J
 			// In AC refinement, we process each block individually (even EOBRUN blocks need correction bits)
 			// So just move to next position without skipping
 			sta = state.NextMcuPos(header)
+
+			// The rest of a truncated scan is not part of the file
+			if bitReader.ConsumedPastEOF() {
+				result.EarlyEOF = true
+				endTruncatedRun(result, header, state, sta)
+				return nil
+			}
 		}
 
 		// Verify fill bits
@@ -1205,6 +1679,10 @@ func readProgressiveACRefine(bitReader *BitReader, header *JpegHeader, result *J
 		}
 
 		if sta == RestartIntervalExpired {
+			if truncatedBeforeMarker(bitReader) {
+				result.EarlyEOF = true
+				return nil
+			}
 			if err := bitReader.VerifyResetCode(); err != nil {
 				return err
 			}
@@ -17,8 +17,17 @@ type JpegWriter struct {
 	// Current DC values for differential encoding
 	lastDC [MaxComponents]int16
 
-	// Restart interval counter
-	restartCounter int
+	// Restart interval counter and index of the next RST marker
+	restartCounter   int
+	restartMarkerIdx int
+
+	// unsegmentedScan makes writeScanMcuRange place RST markers like writeScanData
+	// does for a scan written as a single segment: no marker follows the last MCU
+	unsegmentedScan bool
+
+	// progress stops writing once its context is cancelled, checked before
+	// each row of MCUs. Nil when the writer is used on its own.
+	progress *progressTracker
 }
 
 // HuffmanEncodeTable contains precomputed codes and lengths for encoding
@@ -81,6 +90,21 @@ func buildEncodeTable(decodeTable *HuffmanTable) *HuffmanEncodeTable {
 
 // WriteJpeg writes the complete reconstructed JPEG to the output
 func (w *JpegWriter) WriteJpeg(images []*BlockBasedImage) error {
+	if err := w.writeJpegPrefix(); err != nil {
+		return err
+	}
+
+	// Branch based on JPEG type, arithmetic coded images are regenerated scan
+	// by scan like progressive ones
+	if w.header.JpegType == JpegTypeProgressive || w.header.JpegHeader.Arithmetic {
+		return w.writeProgressiveJpeg(images)
+	}
+
+	return w.writeBaselineJpeg(images)
+}
+
+// writeJpegPrefix writes the prefix garbage, if any, followed by the SOI marker
+func (w *JpegWriter) writeJpegPrefix() error {
 	// Write prefix garbage if any
 	if len(w.header.RecoveryInfo.PrefixGarbage) > 0 {
 		if _, err := w.output.Write(w.header.RecoveryInfo.PrefixGarbage); err != nil {
@@ -93,20 +117,22 @@ func (w *JpegWriter) WriteJpeg(images []*BlockBasedImage) error {
 		return err
 	}
 
-	// Branch based on JPEG type
-	if w.header.JpegType == JpegTypeProgressive {
-		return w.writeProgressiveJpeg(images)
-	}
+	return nil
+}
 
-	return w.writeBaselineJpeg(images)
+// writeBaselineHeader writes the raw JPEG header up to and including SOS
+// (RawJpegHeaderReadIndex marks end of first scan's headers)
+func (w *JpegWriter) writeBaselineHeader() error {
+	headerToWrite := w.header.RawJpegHeader[:w.header.RawJpegHeaderReadIndex]
+	if _, err := w.output.Write(headerToWrite); err != nil {
+		return err
+	}
+	return nil
 }
 
 // writeBaselineJpeg writes a baseline (sequential) JPEG
 func (w *JpegWriter) writeBaselineJpeg(images []*BlockBasedImage) error {
-	// Write the raw JPEG header up to and including SOS
-	// (RawJpegHeaderReadIndex marks end of first scan's headers)
-	headerToWrite := w.header.RawJpegHeader[:w.header.RawJpegHeaderReadIndex]
-	if _, err := w.output.Write(headerToWrite); err != nil {
+	if err := w.writeBaselineHeader(); err != nil {
 		return err
 	}
 
@@ -178,6 +204,14 @@ func (w *JpegWriter) writeBaselineJpeg(images []*BlockBasedImage) error {
 		}
 	}
 
+	return w.writeBaselineTrailer(usedPartitionedPath, lastSegmentSlack)
+}
+
+// writeBaselineTrailer writes everything that follows the scan data of a
+// baseline JPEG: trailing RST markers, the remaining header and the garbage data.
+// lastSegmentSlack is the unused space of the last segment when the scan was
+// written per thread partition.
+func (w *JpegWriter) writeBaselineTrailer(usedPartitionedPath bool, lastSegmentSlack int) error {
 	// Write trailing RST markers if needed (for compatibility with C++ Lepton)
 	// RestartErrors (rst_err) represents extra RST markers at the end of scan data.
 	//
@@ -292,6 +326,9 @@ func (w *JpegWriter) writeScanData(images []*BlockBasedImage, maxScanBytes int64
 
 	// Iterate through MCUs
 	for mcuY := uint32(0); mcuY < jpegHeader.Mcuv; mcuY++ {
+		if err := w.progress.check(); err != nil {
+			return err
+		}
 		for mcuX := uint32(0); mcuX < jpegHeader.Mcuh; mcuX++ {
 			if reachedLimit {
 				goto endMCULoop
@@ -338,7 +375,7 @@ func (w *JpegWriter) writeScanData(images []*BlockBasedImage, maxScanBytes int64
 							block = &EmptyBlock
 						}
 
-						if err := w.writeBlock(block, cmp); err != nil {
+						if err := w.writeBlock(block, cmp, blockY*ci.Bch+blockX); err != nil {
 							return err
 						}
 					}
@@ -415,6 +452,12 @@ func (w *JpegWriter) writeScanData(images []*BlockBasedImage, maxScanBytes int64
 						}
 					}
 
+					// Only as many RST markers as the scan had (CRS section)
+					if w.header.RecoveryInfo.RestartCountsSet && len(w.header.RecoveryInfo.RestartCounts) > 0 &&
+						restartMarkerIdx >= int(w.header.RecoveryInfo.RestartCounts[0]) {
+						writeRst = false
+					}
+
 					if writeRst {
 						rstMarker := []byte{0xFF, byte(MarkerRST0 + (restartMarkerIdx & 7))}
 						if err := writeLimited(rstMarker); err != nil {
@@ -500,6 +543,11 @@ func (w *JpegWriter) writeScanDataNonInterleaved(images []*BlockBasedImage, maxS
 	for dpos := uint32(0); dpos < totalBlocks; dpos++ {
 		blockX := dpos % ci.Bch
 		blockY := dpos / ci.Bch
+		if blockX == 0 {
+			if err := w.progress.check(); err != nil {
+				return err
+			}
+		}
 
 		// Skip padding blocks outside natural dimensions
 		if blockX >= ci.Nch || blockY >= ci.Ncv {
@@ -511,7 +559,7 @@ func (w *JpegWriter) writeScanDataNonInterleaved(images []*BlockBasedImage, maxS
 			block = &EmptyBlock
 		}
 
-		if err := w.writeBlock(block, cmp); err != nil {
+		if err := w.writeBlock(block, cmp, dpos); err != nil {
 			return err
 		}
 
@@ -545,6 +593,12 @@ func (w *JpegWriter) writeScanDataNonInterleaved(images []*BlockBasedImage, maxS
 					}
 				}
 
+				// Only as many RST markers as the scan had (CRS section)
+				if w.header.RecoveryInfo.RestartCountsSet && len(w.header.RecoveryInfo.RestartCounts) > 0 &&
+					restartMarkerIdx >= int(w.header.RecoveryInfo.RestartCounts[0]) {
+					writeRst = false
+				}
+
 				if writeRst {
 					rstMarker := []byte{0xFF, byte(MarkerRST0 + (restartMarkerIdx & 7))}
 					if err := writeLimited(rstMarker); err != nil {
@@ -675,21 +729,53 @@ func (w *JpegWriter) encodeScanDposRange(
 	startDpos, endDpos uint32,
 	padAtEnd bool,
 ) ([]byte, error) {
+	w.seekRestartInterval(int(startDpos))
+
+	if err := w.writeScanDposRange(images, cmp, startDpos, endDpos); err != nil {
+		return nil, err
+	}
+
+	if padAtEnd {
+		padBit := byte(0xFF)
+		if w.header.RecoveryInfo.PadBit != nil {
+			padBit = *w.header.RecoveryInfo.PadBit
+		}
+		w.bitWriter.Pad(padBit)
+	}
+
+	return w.bitWriter.DetachBuffer(), nil
+}
+
+// seekRestartInterval positions the restart interval counters at the MCU (or
+// block for non-interleaved scans) with the given index within the scan
+func (w *JpegWriter) seekRestartInterval(globalStart int) {
+	w.restartCounter = 0
+	w.restartMarkerIdx = 0
+	if restartInterval := int(w.header.JpegHeader.RestartInterval); restartInterval > 0 {
+		w.restartMarkerIdx = globalStart / restartInterval
+		w.restartCounter = globalStart % restartInterval
+	}
+}
+
+// writeScanDposRange writes the blocks of a non-interleaved scan in [startDpos, endDpos)
+// to the bit writer, continuing the restart interval counters of the writer
+func (w *JpegWriter) writeScanDposRange(
+	images []*BlockBasedImage,
+	cmp int,
+	startDpos, endDpos uint32,
+) error {
 	jpegHeader := w.header.JpegHeader
 	ci := &jpegHeader.CmpInfo[cmp]
 	restartInterval := int(jpegHeader.RestartInterval)
 
-	blockCount := 0
-	restartMarkerIdx := 0
-	if restartInterval > 0 {
-		globalStart := int(startDpos)
-		restartMarkerIdx = globalStart / restartInterval
-		blockCount = globalStart % restartInterval
-	}
-
 	for dpos := startDpos; dpos < endDpos; dpos++ {
 		blockX := dpos % ci.Bch
 		blockY := dpos / ci.Bch
+		if blockX == 0 {
+			if err := w.progress.check(); err != nil {
+				return err
+			}
+		}
 
 		if blockX >= ci.Nch || blockY >= ci.Ncv {
 			continue
@@ -700,13 +786,13 @@ func (w *JpegWriter) encodeScanDposRange(
 			block = &EmptyBlock
 		}
 
-		if err := w.writeBlock(block, cmp); err != nil {
-			return nil, err
+		if err := w.writeBlock(block, cmp, dpos); err != nil {
+			return err
 		}
 
 		if restartInterval > 0 {
-			blockCount++
-			if blockCount >= restartInterval {
+			w.restartCounter++
+			if w.restartCounter >= restartInterval {
 				padBit := byte(0xFF)
 				if w.header.RecoveryInfo.PadBit != nil {
 					padBit = *w.header.RecoveryInfo.PadBit
@@ -717,22 +803,36 @@ func (w *JpegWriter) encodeScanDposRange(
 				// (mirrors Rust behavior for backward compatibility with C++ Lepton files)
 				shouldWriteRst := len(w.header.RecoveryInfo.RestartCounts) == 0 ||
 					!w.header.RecoveryInfo.RestartCountsSet ||
-					restartMarkerIdx < int(w.header.RecoveryInfo.RestartCounts[0])
+					w.restartMarkerIdx < int(w.header.RecoveryInfo.RestartCounts[0])
 
 				if shouldWriteRst {
 					w.bitWriter.WriteByteUnescaped(0xFF)
-					w.bitWriter.WriteByteUnescaped(byte(MarkerRST0 + (restartMarkerIdx & 7)))
+					w.bitWriter.WriteByteUnescaped(byte(MarkerRST0 + (w.restartMarkerIdx & 7)))
 				}
-				restartMarkerIdx++
+				w.restartMarkerIdx++
 
 				for i := 0; i < MaxComponents; i++ {
 					w.lastDC[i] = 0
 				}
-				blockCount = 0
+				w.restartCounter = 0
 			}
 		}
 	}
 
+	return nil
+}
+
+func (w *JpegWriter) encodeScanMcuRange(
+	images []*BlockBasedImage,
+	mcuYStart, mcuYEnd uint32,
+	padAtEnd bool,
+) ([]byte, error) {
+	w.seekRestartInterval(int(mcuYStart * w.header.JpegHeader.Mcuh))
+
+	if err := w.writeScanMcuRange(images, mcuYStart, mcuYEnd); err != nil {
+		return nil, err
+	}
+
 	if padAtEnd {
 		padBit := byte(0xFF)
 		if w.header.RecoveryInfo.PadBit != nil {
@@ -744,23 +844,19 @@ func (w *JpegWriter) encodeScanDposRange(
 	return w.bitWriter.DetachBuffer(), nil
 }
 
-func (w *JpegWriter) encodeScanMcuRange(
+// writeScanMcuRange writes the MCU rows [mcuYStart, mcuYEnd) of an interleaved scan
+// to the bit writer, continuing the restart interval counters of the writer
+func (w *JpegWriter) writeScanMcuRange(
 	images []*BlockBasedImage,
 	mcuYStart, mcuYEnd uint32,
-	padAtEnd bool,
-) ([]byte, error) {
+) error {
 	jpegHeader := w.header.JpegHeader
 	restartInterval := int(jpegHeader.RestartInterval)
 
-	mcuCount := 0
-	restartMarkerIdx := 0
-	if restartInterval > 0 {
-		globalStart := int(mcuYStart * jpegHeader.Mcuh)
-		restartMarkerIdx = globalStart / restartInterval
-		mcuCount = globalStart % restartInterval
-	}
-
 	for mcuY := mcuYStart; mcuY < mcuYEnd; mcuY++ {
+		if err := w.progress.check(); err != nil {
+			return err
+		}
 		for mcuX := uint32(0); mcuX < jpegHeader.Mcuh; mcuX++ {
 			for _, cmp := range jpegHeader.ScanComponentOrder {
 				ci := &jpegHeader.CmpInfo[cmp]
@@ -775,16 +871,16 @@ func (w *JpegWriter) encodeScanMcuRange(
 							block = &EmptyBlock
 						}
 
-						if err := w.writeBlock(block, cmp); err != nil {
-							return nil, err
+						if err := w.writeBlock(block, cmp, blockY*ci.Bch+blockX); err != nil {
+							return err
 						}
 					}
 				}
 			}
 
 			if restartInterval > 0 {
-				mcuCount++
-				if mcuCount >= restartInterval {
+				w.restartCounter++
+				if w.restartCounter >= restartInterval {
 					padBit := byte(0xFF)
 					if w.header.RecoveryInfo.PadBit != nil {
 						padBit = *w.header.RecoveryInfo.PadBit
@@ -795,36 +891,31 @@ func (w *JpegWriter) encodeScanMcuRange(
 					// (mirrors Rust behavior for backward compatibility with C++ Lepton files)
 					shouldWriteRst := len(w.header.RecoveryInfo.RestartCounts) == 0 ||
 						!w.header.RecoveryInfo.RestartCountsSet ||
-						restartMarkerIdx < int(w.header.RecoveryInfo.RestartCounts[0])
+						w.restartMarkerIdx < int(w.header.RecoveryInfo.RestartCounts[0])
+					if w.unsegmentedScan && mcuY == jpegHeader.Mcuv-1 && mcuX == jpegHeader.Mcuh-1 {
+						shouldWriteRst = false
+					}
 
 					if shouldWriteRst {
 						w.bitWriter.WriteByteUnescaped(0xFF)
-						w.bitWriter.WriteByteUnescaped(byte(MarkerRST0 + (restartMarkerIdx & 7)))
+						w.bitWriter.WriteByteUnescaped(byte(MarkerRST0 + (w.restartMarkerIdx & 7)))
 					}
-					restartMarkerIdx++
+					w.restartMarkerIdx++
 
 					for i := 0; i < MaxComponents; i++ {
 						w.lastDC[i] = 0
 					}
-					mcuCount = 0
+					w.restartCounter = 0
 				}
 			}
 		}
 	}
 
-	if padAtEnd {
-		padBit := byte(0xFF)
-		if w.header.RecoveryInfo.PadBit != nil {
-			padBit = *w.header.RecoveryInfo.PadBit
-		}
-		w.bitWriter.Pad(padBit)
-	}
-
-	return w.bitWriter.DetachBuffer(), nil
+	return nil
 }
 
 // writeBlock writes a single 8x8 block using Huffman encoding
-func (w *JpegWriter) writeBlock(block *AlignedBlock, componentIdx int) error {
+func (w *JpegWriter) writeBlock(block *AlignedBlock, componentIdx int, dpos uint32) error {
 	jpegHeader := w.header.JpegHeader
 	ci := &jpegHeader.CmpInfo[componentIdx]
 
@@ -841,8 +932,8 @@ func (w *JpegWriter) writeBlock(block *AlignedBlock, componentIdx int) error {
 
 	w.encodeDC(dcDiff, dcTable)
 
-	// Encode AC coefficients
-	w.encodeAC(&zigzagBlock, acTable)
+	// Encode AC coefficients, ending with the ZRLs that the original had
+	w.encodeAC(&zigzagBlock, acTable, int(w.header.RecoveryInfo.ExplicitZeroRuns[componentIdx][dpos]))
 
 	return nil
 }
@@ -878,8 +969,9 @@ func (w *JpegWriter) encodeDC(diff int16, table *HuffmanEncodeTable) {
 	}
 }
 
-// encodeAC encodes AC coefficients
-func (w *JpegWriter) encodeAC(block *AlignedBlock, table *HuffmanEncodeTable) {
+// encodeAC encodes AC coefficients. The first trailingZRLs*16 of the zeros
+// after the last nonzero coefficient are coded with ZRL symbols.
+func (w *JpegWriter) encodeAC(block *AlignedBlock, table *HuffmanEncodeTable, trailingZRLs int) {
 	zeroRunLength := 0
 
 	for i := 1; i < 64; i++ {
@@ -928,6 +1020,11 @@ func (w *JpegWriter) encodeAC(block *AlignedBlock, table *HuffmanEncodeTable) {
 		}
 	}
 
+	for ; trailingZRLs > 0 && zeroRunLength >= 16; trailingZRLs-- {
+		w.bitWriter.Write(uint32(table.codes[0xF0]), uint32(table.lengths[0xF0]))
+		zeroRunLength -= 16
+	}
+
 	// If block ends with zeros (or is all zeros), write EOB
 	// Note: zeroRunLength > 0 means there are trailing zeros
 	// For all-zero AC, zeroRunLength will be 63
@@ -1021,7 +1118,8 @@ func (w *JpegWriter) advanceNextHeaderSegment() (bool, error) {
 			// Parse new Huffman table and rebuild encoding tables
 			length := int(data[pos])<<8 | int(data[pos+1])
 			dhtContent := data[pos+2 : pos+length]
-			if err := parseDHT(w.header.JpegHeader, dhtContent); err != nil {
+			// Tables after the first scan were already accepted when the file was encoded
+			if err := parseDHT(w.header.JpegHeader, dhtContent, CompatLeptonVectorRead()); err != nil {
 				return false, err
 			}
 			// Rebuild encoding tables
@@ -1051,6 +1149,14 @@ func (w *JpegWriter) advanceNextHeaderSegment() (bool, error) {
 			length := int(data[pos])<<8 | int(data[pos+1])
 			pos += length
 
+		case MarkerDAC:
+			// Arithmetic conditioning, accepted when the file was encoded
+			length := int(data[pos])<<8 | int(data[pos+1])
+			if err := parseDAC(w.header.JpegHeader, data[pos+2:pos+length]); err != nil {
+				return false, err
+			}
+			pos += length
+
 		default:
 			// Skip unknown markers
 			if pos+2 <= len(data) {
@@ -1067,6 +1173,9 @@ func (w *JpegWriter) advanceNextHeaderSegment() (bool, error) {
 // writeProgressiveScanData writes scan data for a single progressive scan
 func (w *JpegWriter) writeProgressiveScanData(images []*BlockBasedImage, scanIndex int) error {
 	jpegHeader := w.header.JpegHeader
+	if jpegHeader.Arithmetic {
+		return w.writeArithmeticScan(images)
+	}
 
 	// Reset DC values at start of scan
 	for i := 0; i < MaxComponents; i++ {
@@ -1105,6 +1214,11 @@ func (w *JpegWriter) writeProgressiveScanNonInterleaved(images []*BlockBasedImag
 	for dpos := uint32(0); dpos < totalBlocks; dpos++ {
 		blockX := dpos % ci.Bch
 		blockY := dpos / ci.Bch
+		if blockX == 0 {
+			if err := w.progress.check(); err != nil {
+				return err
+			}
+		}
 
 		// Skip blocks beyond natural dimensions (padding blocks)
 		if blockX >= ci.Nch || blockY >= ci.Ncv {
@@ -1214,6 +1328,9 @@ func (w *JpegWriter) writeProgressiveScanInterleaved(images []*BlockBasedImage,
 
 	// Iterate through MCUs
 	for mcuY := uint32(0); mcuY < jpegHeader.Mcuv; mcuY++ {
+		if err := w.progress.check(); err != nil {
+			return err
+		}
 		for mcuX := uint32(0); mcuX < jpegHeader.Mcuh; mcuX++ {
 			// Write all blocks in this MCU in SOS component order
 			for _, cmp := range jpegHeader.ScanComponentOrder {
@@ -10,6 +10,10 @@ type LeptonDecoder struct {
 	boolReader *VPXBoolReader
 	qt         []*QuantizationTables
 	header     *JpegHeader
+
+	// progress is told about every decoded row and stops decoding once its
+	// context is cancelled. Nil when the decoder is used on its own.
+	progress *progressTracker
 }
 
 // NewLeptonDecoder creates a new LeptonDecoder
@@ -42,6 +46,19 @@ func (d *LeptonDecoder) DecodeRowRange(
 	lastDC [MaxComponents]int16,
 	maxDPos [MaxComponents]uint32,
 	earlyEof bool,
+) (err error) {
+	defer recoverPanic(&err)
+	return d.decodeRows(images, lumaYStart, lumaYEnd, maxDPos, earlyEof, nil)
+}
+
+// decodeRows decodes blocks for a range of luma rows. If rowDone is not nil it
+// is called with the index of each MCU row once all of its rows have been decoded.
+func (d *LeptonDecoder) decodeRows(
+	images []*BlockBasedImage,
+	lumaYStart, lumaYEnd uint32,
+	maxDPos [MaxComponents]uint32,
+	earlyEof bool,
+	rowDone func(mcuRow uint32) error,
 ) error {
 	// Initialize truncate components for row spec calculation
 	tc := NewTruncateComponents()
@@ -68,6 +85,10 @@ func (d *LeptonDecoder) DecodeRowRange(
 	// Calculate total decode iterations
 	decodeIndex := uint32(0)
 
+	// MCU row that has rows decoded but was not yet reported to rowDone
+	pendingMcuRow := uint32(0)
+	hasPendingMcuRow := false
+
 	// Decode rows
 	for {
 		rowSpec := getRowSpecFromIndex(decodeIndex, images, d.header.Mcuv, maxCodedHeights)
@@ -90,6 +111,14 @@ func (d *LeptonDecoder) DecodeRowRange(
 			break
 		}
 
+		if hasPendingMcuRow && rowSpec.mcuRowIndex != pendingMcuRow && rowDone != nil {
+			if err := rowDone(pendingMcuRow); err != nil {
+				return err
+			}
+		}
+		pendingMcuRow = rowSpec.mcuRowIndex
+		hasPendingMcuRow = true
+
 		cmp := rowSpec.component
 		currY := rowSpec.currY
 
@@ -117,10 +146,17 @@ func (d *LeptonDecoder) DecodeRowRange(
 		if err != nil {
 			return err
 		}
+		if err := d.progress.rowDone(); err != nil {
+			return err
+		}
 
 		decodeIndex++
 	}
 
+	if hasPendingMcuRow && rowDone != nil {
+		return rowDone(pendingMcuRow)
+	}
+
 	return nil
 }
 
@@ -158,7 +194,7 @@ func (d *LeptonDecoder) decodeRow(
 		}
 
 		// Store the block
-		image.AppendBlock(block)
+		image.SetBlockByDpos(ctx.curBlockIndex, block)
 
 		// Store neighbor summary for next block
 		ctx.SetNeighborSummaryHere(neighborSummaryCache, ns)
@@ -458,7 +494,8 @@ func getRowSpecFromIndex(
 	return retval
 }
 
-// getColorIndex returns 0 for luma, 1 for chroma
+// getColorIndex returns 0 for luma, 1 for chroma and the K component of a
+// CMYK image
 func getColorIndex(component int) int {
 	if component == 0 {
 		return 0
@@ -9,6 +9,10 @@ type LeptonEncoder struct {
 	boolWriter *VPXBoolWriter
 	model      *Model
 	header     *JpegHeader
+
+	// progress is told about every coded row and stops encoding once its
+	// context is cancelled. Nil when the encoder is used on its own.
+	progress *progressTracker
 }
 
 // NewLeptonEncoder creates a new LeptonEncoder
@@ -31,7 +35,11 @@ func (e *LeptonEncoder) EncodeRowRange(
 	quantizationTables []*QuantizationTables,
 	imageData []*BlockBasedImage,
 	minY, maxY uint32,
-) error {
+	maxDPos [MaxComponents]uint32,
+	earlyEof bool,
+) (err error) {
+	defer recoverPanic(&err)
+
 	// Initialize helper structures
 	numComponents := len(imageData)
 	isTopRow := make([]bool, numComponents)
@@ -45,12 +53,16 @@ func (e *LeptonEncoder) EncodeRowRange(
 		neighborSummaryCache[i] = make([]NeighborSummary, width*2) // 2 rows for alternating
 	}
 
-	// Get max coded heights (all blocks for encoding)
-	maxCodedHeights := make([]uint32, numComponents)
-	for i := 0; i < numComponents; i++ {
-		maxCodedHeights[i] = imageData[i].GetOriginalHeight()
+	// Encode all blocks, or only those read before the end of a truncated file
+	tc := NewTruncateComponents()
+	tc.Init(e.header)
+	if earlyEof {
+		tc.SetTruncationBounds(e.header, maxDPos)
 	}
 
+	maxCodedHeights := tc.GetMaxCodedHeights()
+	componentSizesInBlocks := tc.GetComponentSizesInBlocks()
+
 	// Use the same row iteration order as the decoder
 	decodeIndex := uint32(0)
 	for {
@@ -97,9 +109,13 @@ func (e *LeptonEncoder) EncodeRowRange(
 			currY,
 			leftModel,
 			middleModel,
+			componentSizesInBlocks[cmp],
 		); err != nil {
 			return err
 		}
+		if err := e.progress.rowDone(); err != nil {
+			return err
+		}
 
 		decodeIndex++
 	}
@@ -116,6 +132,7 @@ func (e *LeptonEncoder) processRow(
 	rowY uint32,
 	leftModel *ProbabilityTables,
 	middleModel *ProbabilityTables,
+	componentSizeInBlocks uint32,
 ) error {
 	blockContext := NewBlockContextForRow(rowY, imageData)
 	blockWidth := imageData.GetBlockWidth()
@@ -144,7 +161,11 @@ func (e *LeptonEncoder) processRow(
 		}
 
 		blockContext.SetNeighborSummaryHere(neighborSummaryCache, ns)
-		blockContext.Next()
+
+		// For truncated files, stop at the truncation boundary
+		if blockContext.Next() >= componentSizeInBlocks {
+			return nil
+		}
 	}
 
 	return nil
@@ -34,6 +34,9 @@ type LeptonHeader struct {
 	// OriginalFileSize is the size of the original JPEG
 	OriginalFileSize uint32
 
+	// CompressedHeaderSize is the size of the zlib compressed header
+	CompressedHeaderSize uint32
+
 	// RawJpegHeader contains the raw JPEG header bytes
 	RawJpegHeader []byte
 
@@ -49,6 +52,11 @@ type LeptonHeader struct {
 
 	// RecoveryInfo contains information needed for exact reconstruction
 	RecoveryInfo *ReconstructionInfo
+
+	// decompressedHeader holds the sections of the compressed header, and
+	// hdrSection the bounds of the HDR section within it
+	decompressedHeader []byte
+	hdrSection         [2]int
 }
 
 // ReconstructionInfo holds information needed to exactly reconstruct the JPEG
@@ -91,6 +99,9 @@ type ReconstructionInfo struct {
 
 	// TruncatedEOI indicates if the EOI marker was truncated
 	TruncatedEOI bool
+
+	// ExplicitZeroRuns are the blocks that end with ZRL symbols
+	ExplicitZeroRuns ExplicitZeroRuns
 }
 
 // NewLeptonHeader creates a new LeptonHeader
@@ -104,7 +115,16 @@ func NewLeptonHeader() *LeptonHeader {
 
 // ReadLeptonHeader reads and parses a Lepton file header from a reader
 func ReadLeptonHeader(r io.Reader) (*LeptonHeader, error) {
+	return ReadLeptonHeaderWithOptions(r, CompatLeptonVectorRead())
+}
+
+// ReadLeptonHeaderWithOptions reads and parses a Lepton file header, rejecting
+// anything the options do not allow
+func ReadLeptonHeaderWithOptions(r io.Reader, opts *Options) (_ *LeptonHeader, err error) {
+	defer recoverPanic(&err)
 	header := NewLeptonHeader()
+	header.Use16BitDCEstimate = opts.Use16BitDCEstimate
+	header.Use16BitAdvPredict = opts.Use16BitAdvPredict
 
 	// Read fixed header (28 bytes)
 	fixedHeader := make([]byte, 28)
@@ -135,6 +155,10 @@ func ReadLeptonHeader(r io.Reader) (*LeptonHeader, error) {
 			fmt.Sprintf("invalid JPEG type marker: %c", fixedHeader[3]))
 	}
 
+	if !opts.Progressive && header.JpegType == JpegTypeProgressive {
+		return nil, ErrExitCode(ExitCodeProgressiveUnsupported, "file is progressive, but this is disabled")
+	}
+
 	// Thread count
 	header.ThreadCount = fixedHeader[4]
 
@@ -160,27 +184,51 @@ func ReadLeptonHeader(r io.Reader) (*LeptonHeader, error) {
 
 	// Bytes 24-28: Compressed header size
 	compressedHeaderSize := binary.LittleEndian.Uint32(fixedHeader[24:28])
+	header.CompressedHeaderSize = compressedHeaderSize
+
+	if compressedHeaderSize > opts.MaxJpegFileSize ||
+		(opts.MaxCompressedHeaderSize != 0 && compressedHeaderSize > opts.MaxCompressedHeaderSize) {
+		return nil, ErrExitCode(ExitCodeBadLeptonFile, "too big compressed header")
+	}
+	if header.OriginalFileSize > opts.MaxJpegFileSize {
+		return nil, ErrExitCode(ExitCodeBadLeptonFile,
+			fmt.Sprintf("only support images < %d megs", opts.MaxJpegFileSize/(1024*1024)))
+	}
 
-	// Read compressed header
-	compressedHeader := make([]byte, compressedHeaderSize)
-	if _, err := io.ReadFull(r, compressedHeader); err != nil {
+	// Read compressed header into a buffer that grows with the data that
+	// arrives, rather than allocating the size the file claims up front
+	var compressedHeader bytes.Buffer
+	if _, err := io.CopyN(&compressedHeader, r, int64(compressedHeaderSize)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		return nil, fmt.Errorf("failed to read compressed header: %w", err)
 	}
 
 	// Decompress header using zlib
-	zlibReader, err := zlib.NewReader(bytes.NewReader(compressedHeader))
+	zlibReader, err := zlib.NewReader(&compressedHeader)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create zlib reader: %w", err)
 	}
 	defer zlibReader.Close()
 
-	decompressedHeader, err := io.ReadAll(zlibReader)
+	// Read at most one byte past the limit to detect headers that are too large
+	var headerReader io.Reader = zlibReader
+	if opts.MaxDecompressedHeaderSize != 0 {
+		headerReader = io.LimitReader(zlibReader, int64(opts.MaxDecompressedHeaderSize)+1)
+	}
+	decompressedHeader, err := io.ReadAll(headerReader)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decompress header: %w", err)
 	}
+	if opts.MaxDecompressedHeaderSize != 0 && len(decompressedHeader) > int(opts.MaxDecompressedHeaderSize) {
+		return nil, ErrExitCode(ExitCodeOutOfMemory,
+			fmt.Sprintf("header decompresses to more than %d bytes", opts.MaxDecompressedHeaderSize))
+	}
 
 	// Parse the decompressed header sections
-	if err := header.parseDecompressedHeader(decompressedHeader); err != nil {
+	header.decompressedHeader = decompressedHeader
+	if err := header.parseDecompressedHeader(decompressedHeader, opts); err != nil {
 		return nil, err
 	}
 
@@ -194,7 +242,7 @@ func ReadLeptonHeader(r io.Reader) (*LeptonHeader, error) {
 }
 
 // parseDecompressedHeader parses the sections in the decompressed header
-func (h *LeptonHeader) parseDecompressedHeader(data []byte) error {
+func (h *LeptonHeader) parseDecompressedHeader(data []byte, opts *Options) error {
 	pos := 0
 
 	for pos < len(data) {
@@ -218,12 +266,13 @@ func (h *LeptonHeader) parseDecompressedHeader(data []byte) error {
 				return ErrExitCode(ExitCodeBadLeptonFile, "HDR data beyond end")
 			}
 			h.RawJpegHeader = data[pos : pos+int(size)]
+			h.hdrSection = [2]int{pos - 7, pos + int(size)}
 			pos += int(size)
 
 			// Parse the JPEG header and get position after SOS
 			var err error
 			var readIndex int
-			h.JpegHeader, readIndex, err = ParseJpegHeader(h.RawJpegHeader)
+			h.JpegHeader, readIndex, err = parseJpegHeaderWithOptions(h.RawJpegHeader, opts)
 			if err != nil {
 				return err
 			}
@@ -236,6 +285,10 @@ func (h *LeptonHeader) parseDecompressedHeader(data []byte) error {
 			// HH section - thread handoffs
 			// Third byte of marker is the number of threads
 			numThreads := int(marker[2])
+			if opts.MaxDecodePartitions != 0 && len(h.ThreadHandoffs)+numThreads > int(opts.MaxDecodePartitions) {
+				return ErrExitCode(ExitCodeOutOfMemory,
+					fmt.Sprintf("file has more than %d partitions", opts.MaxDecodePartitions))
+			}
 
 			handoffs, n, err := parseThreadHandoffs(data[pos:], numThreads)
 			if err != nil {
@@ -290,13 +343,13 @@ func (h *LeptonHeader) parseDecompressedHeader(data []byte) error {
 			count := binary.LittleEndian.Uint32(data[pos:])
 			pos += 4
 
+			if uint64(count) > uint64(len(data)-pos)/4 {
+				return ErrExitCode(ExitCodeBadLeptonFile, "CRS data beyond end")
+			}
 			h.RecoveryInfo.RestartCount = int(count)
 			h.RecoveryInfo.RestartCountsSet = true
 			h.RecoveryInfo.RestartCounts = make([]uint32, count)
 			for i := uint32(0); i < count; i++ {
-				if pos+4 > len(data) {
-					return ErrExitCode(ExitCodeBadLeptonFile, "CRS data beyond end")
-				}
 				h.RecoveryInfo.RestartCounts[i] = binary.LittleEndian.Uint32(data[pos:])
 				pos += 4
 			}
@@ -339,6 +392,27 @@ func (h *LeptonHeader) parseDecompressedHeader(data []byte) error {
 			pos += 4
 			h.RecoveryInfo.EarlyEofEncountered = true
 
+		case bytes.Equal(marker, LeptonHeaderZeroRunMarker[:]):
+			// ZRL section - blocks that end with explicit zero runs
+			// (6 bytes each: component, uint32 block position, ZRL count)
+			if pos+4 > len(data) {
+				return ErrExitCode(ExitCodeBadLeptonFile, "ZRL section too short")
+			}
+			count := int(binary.LittleEndian.Uint32(data[pos:]))
+			pos += 4
+
+			if count > (len(data)-pos)/6 {
+				return ErrExitCode(ExitCodeBadLeptonFile, "ZRL data beyond end")
+			}
+			for i := 0; i < count; i++ {
+				cmp := int(data[pos])
+				if cmp >= MaxComponents {
+					return ErrExitCode(ExitCodeBadLeptonFile, "ZRL component out of range")
+				}
+				h.RecoveryInfo.ExplicitZeroRuns.set(cmp, binary.LittleEndian.Uint32(data[pos+1:]), data[pos+5])
+				pos += 6
+			}
+
 		default:
 			// Unknown marker - skip it if we can determine size
 			// For safety, return error
@@ -347,6 +421,12 @@ func (h *LeptonHeader) parseDecompressedHeader(data []byte) error {
 		}
 	}
 
+	garbageSize := len(h.RecoveryInfo.GarbageData) + len(h.RecoveryInfo.PrefixGarbage)
+	if opts.MaxGarbageSize != 0 && garbageSize > int(opts.MaxGarbageSize) {
+		return ErrExitCode(ExitCodeOutOfMemory,
+			fmt.Sprintf("file has %d bytes of garbage, more than %d", garbageSize, opts.MaxGarbageSize))
+	}
+
 	// If no garbage data was specified, add EOI marker as default
 	if len(h.RecoveryInfo.GarbageData) == 0 {
 		h.RecoveryInfo.GarbageData = EOI[:]
@@ -397,7 +477,13 @@ func parseThreadHandoffs(data []byte, numThreads int) ([]ThreadHandoff, int, err
 
 // ParseJpegHeader parses raw JPEG header bytes into a JpegHeader struct
 // Returns the header, the position after SOS marker, and any error
-func ParseJpegHeader(data []byte) (*JpegHeader, int, error) {
+func ParseJpegHeader(data []byte) (_ *JpegHeader, _ int, err error) {
+	defer recoverPanic(&err)
+	return parseJpegHeaderWithOptions(data, CompatLeptonVectorRead())
+}
+
+// parseJpegHeaderWithOptions is ParseJpegHeader with the limits of opts applied
+func parseJpegHeaderWithOptions(data []byte, opts *Options) (*JpegHeader, int, error) {
 	header := NewJpegHeader()
 	header.RawHeader = data
 	pos := 0
@@ -423,7 +509,7 @@ func ParseJpegHeader(data []byte) (*JpegHeader, int, error) {
 		case MarkerSOF0, MarkerSOF1:
 			// Baseline DCT
 			header.JpegType = JpegTypeSequential
-			if err := parseSOF(header, data[pos:]); err != nil {
+			if err := parseSOF(header, data[pos:], opts); err != nil {
 				return nil, 0, err
 			}
 			pos += int(binary.BigEndian.Uint16(data[pos:]))
@@ -431,15 +517,35 @@ func ParseJpegHeader(data []byte) (*JpegHeader, int, error) {
 		case MarkerSOF2:
 			// Progressive DCT
 			header.JpegType = JpegTypeProgressive
-			if err := parseSOF(header, data[pos:]); err != nil {
+			if err := parseSOF(header, data[pos:], opts); err != nil {
+				return nil, 0, err
+			}
+			pos += int(binary.BigEndian.Uint16(data[pos:]))
+
+		case MarkerSOF9, MarkerSOF10:
+			// Arithmetic coded sequential or progressive DCT
+			header.JpegType = JpegTypeSequential
+			if marker == MarkerSOF10 {
+				header.JpegType = JpegTypeProgressive
+			}
+			header.Arithmetic = true
+			if err := parseSOF(header, data[pos:], opts); err != nil {
 				return nil, 0, err
 			}
 			pos += int(binary.BigEndian.Uint16(data[pos:]))
 
+		case MarkerDAC:
+			// Arithmetic conditioning
+			length := int(binary.BigEndian.Uint16(data[pos:]))
+			if err := parseDAC(header, data[pos+2:pos+length]); err != nil {
+				return nil, 0, err
+			}
+			pos += length
+
 		case MarkerDQT:
 			// Quantization table
 			length := int(binary.BigEndian.Uint16(data[pos:]))
-			if err := parseDQT(header, data[pos+2:pos+length]); err != nil {
+			if err := parseDQT(header, data[pos+2:pos+length], opts); err != nil {
 				return nil, 0, err
 			}
 			pos += length
@@ -447,7 +553,7 @@ func ParseJpegHeader(data []byte) (*JpegHeader, int, error) {
 		case MarkerDHT:
 			// Huffman table
 			length := int(binary.BigEndian.Uint16(data[pos:]))
-			if err := parseDHT(header, data[pos+2:pos+length]); err != nil {
+			if err := parseDHT(header, data[pos+2:pos+length], opts); err != nil {
 				return nil, 0, err
 			}
 			pos += length
@@ -468,7 +574,10 @@ func ParseJpegHeader(data []byte) (*JpegHeader, int, error) {
 			return header, pos, nil
 
 		default:
-			// Skip unknown markers
+			// Skip unknown markers, but not the frames of other processes
+			if err := checkFrameMarker(marker); err != nil {
+				return nil, 0, err
+			}
 			if pos+2 <= len(data) {
 				length := int(binary.BigEndian.Uint16(data[pos:]))
 				pos += length
@@ -480,16 +589,23 @@ func ParseJpegHeader(data []byte) (*JpegHeader, int, error) {
 }
 
 // parseSOF parses a Start Of Frame marker
-func parseSOF(header *JpegHeader, data []byte) error {
+func parseSOF(header *JpegHeader, data []byte, opts *Options) error {
 	if len(data) < 8 {
 		return ErrExitCode(ExitCodeBadLeptonFile, "SOF too short")
 	}
 
-	// Skip length (2 bytes) and precision (1 byte)
+	// Skip length (2 bytes), precision must be 8 bits like in the JPEG reader
+	if err := checkSamplePrecision(data[2]); err != nil {
+		return err
+	}
 	header.Height = uint32(binary.BigEndian.Uint16(data[3:5]))
 	header.Width = uint32(binary.BigEndian.Uint16(data[5:7]))
 	header.Cmpc = int(data[7])
 
+	if err := opts.checkDimensions(header.Width, header.Height, ExitCodeOutOfMemory); err != nil {
+		return err
+	}
+
 	if header.Cmpc > MaxComponents {
 		return ErrExitCode(ExitCodeUnsupported4Colors, "too many components")
 	}
@@ -552,7 +668,7 @@ func parseSOF(header *JpegHeader, data []byte) error {
 }
 
 // parseDQT parses a Define Quantization Table marker
-func parseDQT(header *JpegHeader, data []byte) error {
+func parseDQT(header *JpegHeader, data []byte, opts *Options) error {
 	pos := 0
 	for pos < len(data) {
 		info := data[pos]
@@ -574,6 +690,9 @@ func parseDQT(header *JpegHeader, data []byte) error {
 				value := data[pos+i]
 				header.QTables[tableIdx][i] = uint16(value)
 				if value == 0 {
+					if opts.RejectDQTsWithZeros {
+						return ErrExitCode(ExitCodeUnsupportedJpegWithZeroIdct0, "DQT has zero value")
+					}
 					break
 				}
 			}
@@ -587,6 +706,9 @@ func parseDQT(header *JpegHeader, data []byte) error {
 				value := binary.BigEndian.Uint16(data[pos+i*2:])
 				header.QTables[tableIdx][i] = value
 				if value == 0 {
+					if opts.RejectDQTsWithZeros {
+						return ErrExitCode(ExitCodeUnsupportedJpegWithZeroIdct0, "DQT has zero value")
+					}
 					break
 				}
 			}
@@ -598,7 +720,7 @@ func parseDQT(header *JpegHeader, data []byte) error {
 }
 
 // parseDHT parses a Define Huffman Table marker
-func parseDHT(header *JpegHeader, data []byte) error {
+func parseDHT(header *JpegHeader, data []byte, opts *Options) error {
 	pos := 0
 	for pos < len(data) {
 		info := data[pos]
@@ -634,6 +756,10 @@ func parseDHT(header *JpegHeader, data []byte) error {
 		table.SymbolCount = totalSymbols
 		pos += totalSymbols
 
+		if !opts.AcceptInvalidDHT && !table.IsValid() {
+			return ErrExitCode(ExitCodeUnsupportedJpeg, "Huffman table out of space")
+		}
+
 		// Build derived tables
 		table.BuildDerivedTable()
 
@@ -673,6 +799,9 @@ func parseSOS(header *JpegHeader, data []byte) error {
 
 		dcTable := (huffTable >> 4) & 0x0F
 		acTable := huffTable & 0x0F
+		if dcTable > 3 || acTable > 3 {
+			return ErrExitCode(ExitCodeBadLeptonFile, "SOS table index out of range")
+		}
 
 		// Find the component with matching Jid and set its Huffman tables
 		for j := 0; j < header.Cmpc; j++ {
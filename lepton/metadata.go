@@ -0,0 +1,319 @@
+package lepton
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Identifiers at the start of the APPn segments that Metadata picks out
+const (
+	exifIdentifier = "Exif\x00\x00"
+	xmpIdentifier  = "http://ns.adobe.com/xap/1.0/\x00"
+	iccIdentifier  = "ICC_PROFILE\x00"
+	mpfIdentifier  = "MPF\x00"
+)
+
+// Metadata holds the APPn and COM segments of a JPEG, as stored in the header
+// of a Lepton file. It can be marshalled with encoding/json.
+type Metadata struct {
+	// Exif is the TIFF data of the APP1 Exif segment
+	Exif []byte `json:"exif,omitempty"`
+
+	// XMP is the XMP packet of the APP1 XMP segment
+	XMP []byte `json:"xmp,omitempty"`
+
+	// ICCProfile is the ICC profile put back together from its APP2 chunks.
+	// It is nil if any chunk is missing or the chunks disagree on their count.
+	ICCProfile []byte `json:"iccProfile,omitempty"`
+
+	// MPF is the TIFF data of the APP2 Multi-Picture Format segment, which
+	// indexes the further images of the file
+	MPF []byte `json:"mpf,omitempty"`
+
+	// Comments are the contents of the COM segments
+	Comments [][]byte `json:"comments,omitempty"`
+
+	// Segments are all APPn and COM segments in file order, including those
+	// picked out above
+	Segments []MetadataSegment `json:"segments"`
+
+	// Embedded is the metadata of the JPEG images stored after the EOI
+	// marker, such as the further images of a multi-picture file
+	Embedded []*Metadata `json:"embedded,omitempty"`
+}
+
+// MetadataSegment is an APPn or COM segment
+type MetadataSegment struct {
+	Marker byte   `json:"marker"`
+	Data   []byte `json:"data"` // the contents after the length
+}
+
+// ReadMetadata reads the header of a Lepton file and returns the metadata
+// of the JPEG in it. Only the compressed header is read, not the scan data.
+func ReadMetadata(r io.Reader) (*Metadata, error) {
+	return ReadMetadataWithOptions(r, nil)
+}
+
+// ReadMetadataWithOptions is like ReadMetadata but applies the limits of
+// opts. A nil opts uses CompatLeptonVectorRead.
+func ReadMetadataWithOptions(r io.Reader, opts *Options) (md *Metadata, err error) {
+	defer recoverPanic(&err)
+	if opts == nil {
+		opts = CompatLeptonVectorRead()
+	}
+
+	header, err := ReadLeptonHeaderWithOptions(r, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// The raw header holds the segments before every scan without the scan
+	// data, so it can be walked to its end
+	md = &Metadata{}
+	md.addSegments(header.RawJpegHeader, false)
+	md.Embedded = embeddedMetadata(header.RecoveryInfo.GarbageData)
+	return md, nil
+}
+
+// addSegments walks the marker segments of a JPEG header in data, which may
+// start with SOI, and adds the metadata segments. With stopAtScan the walk
+// ends after the first SOS segment, for images whose scan data follows. It
+// returns the number of bytes walked.
+func (md *Metadata) addSegments(data []byte, stopAtScan bool) int {
+	pos := 0
+	if len(data) >= 2 && data[0] == 0xFF && data[1] == MarkerSOI {
+		pos = 2
+	}
+
+	for pos+4 <= len(data) && data[pos] == 0xFF {
+		marker := data[pos+1]
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if marker == MarkerEOI || length < 2 || pos+2+length > len(data) {
+			break
+		}
+
+		if marker >= MarkerAPP0 && marker <= MarkerAPP15 || marker == MarkerCOM {
+			md.addSegment(marker, data[pos+4:pos+2+length])
+		}
+
+		pos += 2 + length
+		if marker == MarkerSOS && stopAtScan {
+			break
+		}
+	}
+
+	md.ICCProfile = assembleICCProfile(md.Segments)
+	return pos
+}
+
+// addSegment adds a metadata segment and picks it out if its type is known
+func (md *Metadata) addSegment(marker byte, data []byte) {
+	md.Segments = append(md.Segments, MetadataSegment{Marker: marker, Data: data})
+
+	switch {
+	case marker == MarkerCOM:
+		md.Comments = append(md.Comments, data)
+	case marker == MarkerAPP1 && md.Exif == nil && bytes.HasPrefix(data, []byte(exifIdentifier)):
+		md.Exif = data[len(exifIdentifier):]
+	case marker == MarkerAPP1 && md.XMP == nil && bytes.HasPrefix(data, []byte(xmpIdentifier)):
+		md.XMP = data[len(xmpIdentifier):]
+	case marker == MarkerAPP2 && md.MPF == nil && bytes.HasPrefix(data, []byte(mpfIdentifier)):
+		md.MPF = data[len(mpfIdentifier):]
+	}
+}
+
+// assembleICCProfile joins the ICC profile chunks of the APP2 segments, each
+// of which has a sequence number from 1 and the count of chunks
+func assembleICCProfile(segments []MetadataSegment) []byte {
+	var chunks [][]byte
+	for _, segment := range segments {
+		data := segment.Data
+		if segment.Marker != MarkerAPP2 || !bytes.HasPrefix(data, []byte(iccIdentifier)) || len(data) < len(iccIdentifier)+2 {
+			continue
+		}
+
+		seq, count := int(data[len(iccIdentifier)]), int(data[len(iccIdentifier)+1])
+		if chunks == nil {
+			chunks = make([][]byte, count)
+		}
+		if count != len(chunks) || seq < 1 || seq > count || chunks[seq-1] != nil {
+			return nil
+		}
+		chunks[seq-1] = data[len(iccIdentifier)+2:]
+	}
+
+	var profile []byte
+	for _, chunk := range chunks {
+		if chunk == nil {
+			return nil
+		}
+		profile = append(profile, chunk...)
+	}
+	return profile
+}
+
+// embeddedMetadata finds the JPEG images in the data after the EOI marker and
+// returns their metadata. Scan data cannot hold an SOI marker, so every SOI
+// followed by a marker starts an image.
+func embeddedMetadata(garbage []byte) []*Metadata {
+	var images []*Metadata
+	for pos := 0; pos+3 <= len(garbage); pos++ {
+		if garbage[pos] != 0xFF || garbage[pos+1] != MarkerSOI || garbage[pos+2] != 0xFF {
+			continue
+		}
+
+		md := &Metadata{}
+		pos += md.addSegments(garbage[pos:], true) - 1
+		images = append(images, md)
+	}
+	return images
+}
+
+// RewriteMetadata copies a Lepton file from r to w with the APPn and COM
+// segments before the first scan replaced by the ones edit returns for them,
+// e.g. to remove location data. The segments are written together where the
+// first one was, or right after SOI if there were none. Only the compressed
+// header is rebuilt: the original file size, header sizes and footer are
+// updated and the partition data is copied as it is. Segments of images after
+// the EOI marker are left alone.
+func RewriteMetadata(r io.Reader, w io.Writer, edit func([]MetadataSegment) []MetadataSegment) error {
+	return RewriteMetadataWithOptions(r, w, edit, nil)
+}
+
+// RewriteMetadataWithOptions is like RewriteMetadata but applies the limits
+// of opts to the input. A nil opts uses CompatLeptonVectorRead.
+func RewriteMetadataWithOptions(r io.Reader, w io.Writer, edit func([]MetadataSegment) []MetadataSegment, opts *Options) (err error) {
+	defer recoverPanic(&err)
+	if opts == nil {
+		opts = CompatLeptonVectorRead()
+	}
+
+	// Keep the bytes of the fixed header, which is written again with new sizes
+	var headerBytes bytes.Buffer
+	header, err := ReadLeptonHeaderWithOptions(io.TeeReader(r, &headerBytes), opts)
+	if err != nil {
+		return fmt.Errorf("failed to read Lepton header: %w", err)
+	}
+	if err := readCompletionMarker(r); err != nil {
+		return err
+	}
+
+	remainingData, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read segment data: %w", err)
+	}
+	if len(remainingData) < leptonFooterSize {
+		return ErrExitCode(ExitCodeBadLeptonFile, "missing file size footer")
+	}
+	segmentData := remainingData[:len(remainingData)-leptonFooterSize]
+	if err := header.checkFooter(remainingData[len(segmentData):], len(segmentData)); err != nil {
+		return err
+	}
+
+	rawHeader, err := rewriteSegments(header.RawJpegHeader, edit)
+	if err != nil {
+		return err
+	}
+	originalFileSize := int64(header.OriginalFileSize) + int64(len(rawHeader)-len(header.RawJpegHeader))
+	if originalFileSize < 0 || originalFileSize > math.MaxUint32 {
+		return NewLeptonError(ExitCodeIntegerCastOverflow,
+			fmt.Sprintf("rewritten JPEG would be %d bytes", originalFileSize))
+	}
+
+	// Replace the HDR section and keep all other sections of the header
+	sections := header.decompressedHeader
+	var decompressedHeader bytes.Buffer
+	decompressedHeader.Write(sections[:header.hdrSection[0]])
+	decompressedHeader.Write(LeptonHeaderMarker[:])
+	binary.Write(&decompressedHeader, binary.LittleEndian, uint32(len(rawHeader)))
+	decompressedHeader.Write(rawHeader)
+	decompressedHeader.Write(sections[header.hdrSection[1]:])
+
+	var compressedHeader bytes.Buffer
+	zlibWriter := zlib.NewWriter(&compressedHeader)
+	zlibWriter.Write(decompressedHeader.Bytes())
+	zlibWriter.Close()
+
+	fixedHeader := headerBytes.Bytes()[:28]
+	if fixedHeader[8] == 'M' && fixedHeader[9] == 'S' {
+		binary.LittleEndian.PutUint32(fixedHeader[10:14], uint32(decompressedHeader.Len()))
+	}
+	binary.LittleEndian.PutUint32(fixedHeader[20:24], uint32(originalFileSize))
+	binary.LittleEndian.PutUint32(fixedHeader[24:28], uint32(compressedHeader.Len()))
+
+	// 28 (fixed header) + compressed header + 3 (CMP) + segment data + 4 (footer)
+	fileSize := uint32(28 + compressedHeader.Len() + 3 + len(segmentData) + leptonFooterSize)
+	for _, data := range [][]byte{fixedHeader, compressedHeader.Bytes(), LeptonHeaderCompletionMarker[:], segmentData} {
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return binary.Write(w, binary.LittleEndian, fileSize)
+}
+
+// rewriteSegments returns the raw JPEG header with the APPn and COM segments
+// before the first scan replaced by the ones edit returns for them
+func rewriteSegments(raw []byte, edit func([]MetadataSegment) []MetadataSegment) ([]byte, error) {
+	var segments []MetadataSegment
+	var kept []byte
+	insertAt := -1
+
+	pos := 0
+	for pos+2 <= len(raw) && raw[pos] == 0xFF {
+		marker := raw[pos+1]
+		if marker == MarkerSOI {
+			kept = append(kept, raw[pos:pos+2]...)
+			pos += 2
+			continue
+		}
+		if pos+4 > len(raw) {
+			break
+		}
+		end := pos + 2 + int(binary.BigEndian.Uint16(raw[pos+2:]))
+		if end < pos+4 || end > len(raw) {
+			break
+		}
+
+		if marker >= MarkerAPP0 && marker <= MarkerAPP15 || marker == MarkerCOM {
+			if insertAt < 0 {
+				insertAt = len(kept)
+			}
+			segments = append(segments, MetadataSegment{Marker: marker, Data: raw[pos+4 : end]})
+		} else {
+			kept = append(kept, raw[pos:end]...)
+		}
+
+		pos = end
+		if marker == MarkerSOS {
+			break
+		}
+	}
+	kept = append(kept, raw[pos:]...)
+
+	if insertAt < 0 {
+		// Right after SOI, which the raw header of a Lepton file leaves out
+		insertAt = 0
+		if len(kept) >= 2 && kept[0] == 0xFF && kept[1] == MarkerSOI {
+			insertAt = 2
+		}
+	}
+
+	rewritten := append([]byte(nil), kept[:insertAt]...)
+	for _, segment := range edit(segments) {
+		if !(segment.Marker >= MarkerAPP0 && segment.Marker <= MarkerAPP15 || segment.Marker == MarkerCOM) {
+			return nil, NewLeptonError(ExitCodeSyntaxError,
+				fmt.Sprintf("marker 0x%02X is not an APPn or COM marker", segment.Marker))
+		}
+		if len(segment.Data) > math.MaxUint16-2 {
+			return nil, NewLeptonError(ExitCodeSyntaxError,
+				fmt.Sprintf("segment of %d bytes does not fit in a JPEG segment", len(segment.Data)))
+		}
+		rewritten = append(rewritten, 0xFF, segment.Marker, byte((len(segment.Data)+2)>>8), byte(len(segment.Data)+2))
+		rewritten = append(rewritten, segment.Data...)
+	}
+	return append(rewritten, kept[insertAt:]...), nil
+}
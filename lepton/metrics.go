@@ -0,0 +1,162 @@
+package lepton
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ModelComponent identifies the part of the model that a coded bit belongs to
+type ModelComponent int
+
+const (
+	// ModelComponentDummy is used for bits that are not part of the model,
+	// such as the marker bit at the start of each stream
+	ModelComponentDummy ModelComponent = iota
+	ModelComponentCoefExp
+	ModelComponentCoefSign
+	ModelComponentCoefResidual
+	ModelComponentCoefNoise
+	ModelComponentNonZero7x7Count
+	ModelComponentNonZeroEdgeCount
+	ModelComponentEdgeExp
+	ModelComponentEdgeSign
+	ModelComponentEdgeResidual
+	ModelComponentEdgeNoise
+	ModelComponentDCExp
+	ModelComponentDCSign
+	ModelComponentDCResidual
+	ModelComponentDCNoise
+
+	// NumModelComponents is the number of model components
+	NumModelComponents
+)
+
+// String returns the name of the component the way the Rust port prints it
+func (c ModelComponent) String() string {
+	switch c {
+	case ModelComponentDummy:
+		return "Dummy"
+	case ModelComponentCoefExp:
+		return "Coef(Exp)"
+	case ModelComponentCoefSign:
+		return "Coef(Sign)"
+	case ModelComponentCoefResidual:
+		return "Coef(Residual)"
+	case ModelComponentCoefNoise:
+		return "Coef(Noise)"
+	case ModelComponentNonZero7x7Count:
+		return "NonZero7x7Count"
+	case ModelComponentNonZeroEdgeCount:
+		return "NonZeroEdgeCount"
+	case ModelComponentEdgeExp:
+		return "Edge(Exp)"
+	case ModelComponentEdgeSign:
+		return "Edge(Sign)"
+	case ModelComponentEdgeResidual:
+		return "Edge(Residual)"
+	case ModelComponentEdgeNoise:
+		return "Edge(Noise)"
+	case ModelComponentDCExp:
+		return "DC(Exp)"
+	case ModelComponentDCSign:
+		return "DC(Sign)"
+	case ModelComponentDCResidual:
+		return "DC(Residual)"
+	case ModelComponentDCNoise:
+		return "DC(Noise)"
+	default:
+		return fmt.Sprintf("ModelComponent(%d)", int(c))
+	}
+}
+
+// ModelComponentStatistics counts the bits coded for a model component
+type ModelComponentStatistics struct {
+	TotalBits       int64 // bits before compression
+	TotalCompressed int64 // bits shifted out of the arithmetic coder
+}
+
+// Metrics collects compression statistics per model component. Pass one in
+// Options.Metrics to have Encode or Decode fill it in. Each partition records
+// into its own Metrics, which are merged once all partitions are done.
+type Metrics struct {
+	Components [NumModelComponents]ModelComponentStatistics
+	WorkerTime time.Duration // time spent coding partitions, summed over all workers
+}
+
+// record adds a coded bit and the number of bits it shifted out of the coder
+func (m *Metrics) record(cmp ModelComponent, shift uint32) {
+	s := &m.Components[cmp]
+	s.TotalBits++
+	s.TotalCompressed += int64(shift)
+}
+
+// Merge adds the statistics of other to m
+func (m *Metrics) Merge(other *Metrics) {
+	for i := range m.Components {
+		m.Components[i].TotalBits += other.Components[i].TotalBits
+		m.Components[i].TotalCompressed += other.Components[i].TotalCompressed
+	}
+	m.WorkerTime += other.WorkerTime
+}
+
+// startWorker starts timing a partition and returns a function that adds the
+// elapsed time to WorkerTime
+func (m *Metrics) startWorker() func() {
+	start := time.Now()
+	return func() {
+		m.WorkerTime += time.Since(start)
+	}
+}
+
+// newPartitionMetrics returns a Metrics for each of n partitions, or nil if
+// metrics are not being collected
+func newPartitionMetrics(metrics *Metrics, n int) []Metrics {
+	if metrics == nil {
+		return nil
+	}
+	return make([]Metrics, n)
+}
+
+// mergePartitionMetrics adds the statistics of every partition to metrics
+func mergePartitionMetrics(metrics *Metrics, partitionMetrics []Metrics) {
+	for i := range partitionMetrics {
+		metrics.Merge(&partitionMetrics[i])
+	}
+}
+
+// TotalCompressedBits returns the compressed bits of all components
+func (m *Metrics) TotalCompressedBits() int64 {
+	total := int64(0)
+	for _, s := range m.Components {
+		total += s.TotalCompressed
+	}
+	return total
+}
+
+// WriteText writes the statistics of each component that coded any bits,
+// largest compressed size first
+func (m *Metrics) WriteText(w io.Writer) error {
+	order := make([]ModelComponent, 0, NumModelComponents)
+	for c := ModelComponent(0); c < NumModelComponents; c++ {
+		if m.Components[c].TotalBits > 0 {
+			order = append(order, c)
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return m.Components[order[i]].TotalCompressed > m.Components[order[j]].TotalCompressed
+	})
+
+	var b strings.Builder
+	for _, c := range order {
+		s := m.Components[c]
+		fmt.Fprintf(&b, "%-18s total_bits=%d total_compressed=%d ratio=%.2f\n",
+			c, s.TotalBits, s.TotalCompressed, float64(s.TotalCompressed)/float64(s.TotalBits))
+	}
+	fmt.Fprintf(&b, "worker time: %v\n", m.WorkerTime)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -46,13 +46,13 @@ func (m *Model) GetPerColor(colorIndex int) *ModelPerColor {
 // ReadDC reads a DC coefficient
 func (m *Model) ReadDC(boolReader *VPXBoolReader, colorIndex int, uncertainty, uncertainty2 int16) (int16, error) {
 	exp, sign, bits := m.getDCBranches(uncertainty, uncertainty2, colorIndex)
-	return readLengthSignCoef(boolReader, exp, sign, bits)
+	return readLengthSignCoef(boolReader, exp, sign, bits, ModelComponentDCExp, ModelComponentDCSign, ModelComponentDCNoise)
 }
 
 // WriteDC writes a DC coefficient
 func (m *Model) WriteDC(boolWriter *VPXBoolWriter, colorIndex int, coef int16, uncertainty, uncertainty2 int16) error {
 	exp, sign, bits := m.getDCBranches(uncertainty, uncertainty2, colorIndex)
-	return writeLengthSignCoef(boolWriter, coef, exp, sign, bits)
+	return writeLengthSignCoef(boolWriter, coef, exp, sign, bits, ModelComponentDCExp, ModelComponentDCSign, ModelComponentDCNoise)
 }
 
 func (m *Model) getDCBranches(uncertainty, uncertainty2 int16, colorIndex int) ([]Branch, *Branch, []Branch) {
@@ -136,13 +136,13 @@ func newModelPerColor() ModelPerColor {
 // ReadCoef reads a coefficient from the 7x7 block
 func (m *ModelPerColor) ReadCoef(boolReader *VPXBoolReader, zig49 int, numNonZerosBin int, bestPriorBitLen int) (int16, error) {
 	exp, sign, bits := m.getCoefBranches(numNonZerosBin, zig49, bestPriorBitLen)
-	return readLengthSignCoef(boolReader, exp, sign, bits)
+	return readLengthSignCoef(boolReader, exp, sign, bits, ModelComponentCoefExp, ModelComponentCoefSign, ModelComponentCoefNoise)
 }
 
 // WriteCoef writes a coefficient to the 7x7 block
 func (m *ModelPerColor) WriteCoef(boolWriter *VPXBoolWriter, coef int16, zig49 int, numNonZerosBin int, bestPriorBitLen int) error {
 	exp, sign, bits := m.getCoefBranches(numNonZerosBin, zig49, bestPriorBitLen)
-	return writeLengthSignCoef(boolWriter, coef, exp, sign, bits)
+	return writeLengthSignCoef(boolWriter, coef, exp, sign, bits, ModelComponentCoefExp, ModelComponentCoefSign, ModelComponentCoefNoise)
 }
 
 func (m *ModelPerColor) getCoefBranches(numNonZerosBin, zig49, bestPriorBitLen int) ([]Branch, *Branch, []Branch) {
@@ -155,27 +155,27 @@ func (m *ModelPerColor) getCoefBranches(numNonZerosBin, zig49, bestPriorBitLen i
 // ReadNonZero7x7Count reads the count of non-zero coefficients in the 7x7 block
 func (m *ModelPerColor) ReadNonZero7x7Count(boolReader *VPXBoolReader, numNonZeros7x7ContextBin uint8) (uint8, error) {
 	prob := m.NumNonZerosCounts7x7[numNonZeros7x7ContextBin][:]
-	val, err := boolReader.GetGrid(prob)
+	val, err := boolReader.GetGrid(prob, ModelComponentNonZero7x7Count)
 	return uint8(val), err
 }
 
 // WriteNonZero7x7Count writes the count of non-zero coefficients in the 7x7 block
 func (m *ModelPerColor) WriteNonZero7x7Count(boolWriter *VPXBoolWriter, numNonZeros7x7ContextBin uint8, numNonZeros7x7 uint8) error {
 	prob := m.NumNonZerosCounts7x7[numNonZeros7x7ContextBin][:]
-	return boolWriter.PutGrid(numNonZeros7x7, prob)
+	return boolWriter.PutGrid(numNonZeros7x7, prob, ModelComponentNonZero7x7Count)
 }
 
 // ReadNonZeroEdgeCount reads the count of non-zero edge coefficients
 func (m *ModelPerColor) ReadNonZeroEdgeCount(boolReader *VPXBoolReader, horizontal bool, estEob, numNonZerosBin uint8) (uint8, error) {
 	prob := m.getNonZeroCountsEdge(horizontal, estEob, numNonZerosBin)
-	val, err := boolReader.GetGrid(prob)
+	val, err := boolReader.GetGrid(prob, ModelComponentNonZeroEdgeCount)
 	return uint8(val), err
 }
 
 // WriteNonZeroEdgeCount writes the count of non-zero edge coefficients
 func (m *ModelPerColor) WriteNonZeroEdgeCount(boolWriter *VPXBoolWriter, horizontal bool, estEob, numNonZerosBin uint8, numNonZerosEdge uint8) error {
 	prob := m.getNonZeroCountsEdge(horizontal, estEob, numNonZerosBin)
-	return boolWriter.PutGrid(numNonZerosEdge, prob)
+	return boolWriter.PutGrid(numNonZerosEdge, prob, ModelComponentNonZeroEdgeCount)
 }
 
 func (m *ModelPerColor) getNonZeroCountsEdge(horizontal bool, estEob, numNonZerosBin uint8) []Branch {
@@ -194,7 +194,7 @@ func (m *ModelPerColor) ReadEdgeCoefficient(boolReader *VPXBoolReader, qt *Quant
 	bestPriorBitLen := min(MaxExponent-1, int(u32BitLength(uint32(bestPriorAbs))))
 
 	lengthBranches := m.CountsX[numNonZerosEdgeBin][zig15offset].ExponentCounts[bestPriorBitLen][:]
-	length, err := boolReader.GetUnaryEncoded(lengthBranches)
+	length, err := boolReader.GetUnaryEncoded(lengthBranches, ModelComponentEdgeExp)
 	if err != nil {
 		return 0, err
 	}
@@ -205,7 +205,7 @@ func (m *ModelPerColor) ReadEdgeCoefficient(boolReader *VPXBoolReader, qt *Quant
 		// but the sign here is taken from its truncated i16 value
 		sign := &m.SignCounts[calcSignIndex(int16(bestPrior))][bestPriorBitLen]
 
-		neg, err := boolReader.GetBit(sign)
+		neg, err := boolReader.GetBit(sign, ModelComponentEdgeSign)
 		if err != nil {
 			return 0, err
 		}
@@ -222,7 +222,7 @@ func (m *ModelPerColor) ReadEdgeCoefficient(boolReader *VPXBoolReader, qt *Quant
 
 				decodedSoFar := 1
 				for i >= minThreshold {
-					curBit, err := boolReader.GetBit(&threshProb[decodedSoFar])
+					curBit, err := boolReader.GetBit(&threshProb[decodedSoFar], ModelComponentEdgeResidual)
 					if err != nil {
 						return 0, err
 					}
@@ -241,7 +241,7 @@ func (m *ModelPerColor) ReadEdgeCoefficient(boolReader *VPXBoolReader, qt *Quant
 
 			if i >= 0 {
 				resProb := m.CountsX[numNonZerosEdgeBin][zig15offset].ResidualNoiseCounts[:]
-				bits, err := boolReader.GetNBits(i+1, resProb)
+				bits, err := boolReader.GetNBits(i+1, resProb, ModelComponentEdgeNoise)
 				if err != nil {
 					return 0, err
 				}
@@ -281,7 +281,7 @@ func (m *ModelPerColor) WriteEdgeCoefficient(boolWriter *VPXBoolWriter, qt *Quan
 	}
 
 	lengthBranches := m.CountsX[numNonZerosEdgeBin][zig15offset].ExponentCounts[bestPriorBitLen][:]
-	if err := boolWriter.PutUnaryEncoded(length, lengthBranches); err != nil {
+	if err := boolWriter.PutUnaryEncoded(length, lengthBranches, ModelComponentEdgeExp); err != nil {
 		return err
 	}
 
@@ -290,7 +290,7 @@ func (m *ModelPerColor) WriteEdgeCoefficient(boolWriter *VPXBoolWriter, qt *Quan
 		// but the sign here is taken from its truncated i16 value
 		sign := &m.SignCounts[calcSignIndex(int16(bestPrior))][bestPriorBitLen]
 
-		if err := boolWriter.PutBit(coef >= 0, sign); err != nil {
+		if err := boolWriter.PutBit(coef >= 0, sign, ModelComponentEdgeSign); err != nil {
 			return err
 		}
 
@@ -304,7 +304,7 @@ func (m *ModelPerColor) WriteEdgeCoefficient(boolWriter *VPXBoolWriter, qt *Quan
 				encodedSoFar := 1
 				for i >= minThreshold {
 					curBit := (absCoef & (1 << i)) != 0
-					if err := boolWriter.PutBit(curBit, &threshProb[encodedSoFar]); err != nil {
+					if err := boolWriter.PutBit(curBit, &threshProb[encodedSoFar], ModelComponentEdgeResidual); err != nil {
 						return err
 					}
 
@@ -322,7 +322,7 @@ func (m *ModelPerColor) WriteEdgeCoefficient(boolWriter *VPXBoolWriter, qt *Quan
 
 			if i >= 0 {
 				resProb := m.CountsX[numNonZerosEdgeBin][zig15offset].ResidualNoiseCounts[:]
-				if err := boolWriter.PutNBits(int(absCoef), i+1, resProb); err != nil {
+				if err := boolWriter.PutNBits(int(absCoef), i+1, resProb, ModelComponentEdgeNoise); err != nil {
 					return err
 				}
 			}
@@ -389,23 +389,24 @@ func newCountsDC() CountsDC {
 	return c
 }
 
-// readLengthSignCoef reads a coefficient using length-sign-bits encoding
-func readLengthSignCoef(boolReader *VPXBoolReader, magnitudeBranches []Branch, signBranch *Branch, bitsBranch []Branch) (int16, error) {
-	length, err := boolReader.GetUnaryEncoded(magnitudeBranches)
+// readLengthSignCoef reads a coefficient using length-sign-bits encoding,
+// recording each part under the given model components
+func readLengthSignCoef(boolReader *VPXBoolReader, magnitudeBranches []Branch, signBranch *Branch, bitsBranch []Branch, magnitudeCmp, signCmp, bitsCmp ModelComponent) (int16, error) {
+	length, err := boolReader.GetUnaryEncoded(magnitudeBranches, magnitudeCmp)
 	if err != nil {
 		return 0, err
 	}
 
 	var coef int16 = 0
 	if length != 0 {
-		neg, err := boolReader.GetBit(signBranch)
+		neg, err := boolReader.GetBit(signBranch, signCmp)
 		if err != nil {
 			return 0, err
 		}
 		neg = !neg
 
 		if length > 1 {
-			bits, err := boolReader.GetNBits(length-1, bitsBranch)
+			bits, err := boolReader.GetNBits(length-1, bitsBranch, bitsCmp)
 			if err != nil {
 				return 0, err
 			}
@@ -422,8 +423,9 @@ func readLengthSignCoef(boolReader *VPXBoolReader, magnitudeBranches []Branch, s
 	return coef, nil
 }
 
-// writeLengthSignCoef writes a coefficient using length-sign-bits encoding
-func writeLengthSignCoef(boolWriter *VPXBoolWriter, coef int16, magnitudeBranches []Branch, signBranch *Branch, bitsBranch []Branch) error {
+// writeLengthSignCoef writes a coefficient using length-sign-bits encoding,
+// recording each part under the given model components
+func writeLengthSignCoef(boolWriter *VPXBoolWriter, coef int16, magnitudeBranches []Branch, signBranch *Branch, bitsBranch []Branch, magnitudeCmp, signCmp, bitsCmp ModelComponent) error {
 	absCoef := abs16(coef)
 	coefBitLen := int(u16BitLength(absCoef))
 
@@ -431,18 +433,18 @@ func writeLengthSignCoef(boolWriter *VPXBoolWriter, coef int16, magnitudeBranche
 		return NewLeptonError(ExitCodeCoefficientOutOfRange, "coefficient > MAX_EXPONENT")
 	}
 
-	if err := boolWriter.PutUnaryEncoded(coefBitLen, magnitudeBranches); err != nil {
+	if err := boolWriter.PutUnaryEncoded(coefBitLen, magnitudeBranches, magnitudeCmp); err != nil {
 		return err
 	}
 
 	if coef != 0 {
-		if err := boolWriter.PutBit(coef > 0, signBranch); err != nil {
+		if err := boolWriter.PutBit(coef > 0, signBranch, signCmp); err != nil {
 			return err
 		}
 	}
 
 	if coefBitLen > 1 {
-		if err := boolWriter.PutNBits(int(absCoef), coefBitLen-1, bitsBranch); err != nil {
+		if err := boolWriter.PutNBits(int(absCoef), coefBitLen-1, bitsBranch, bitsCmp); err != nil {
 			return err
 		}
 	}
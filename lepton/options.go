@@ -0,0 +1,226 @@
+package lepton
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"unsafe"
+)
+
+// Options controls which JPEG features are accepted and how encoding and
+// decoding are performed. It mirrors EnabledFeatures from the Rust implementation.
+type Options struct {
+	// Progressive enables reading of progressive images
+	Progressive bool
+
+	// RejectDQTsWithZeros rejects images with zeros in a quantization table
+	// (may cause divide-by-zero)
+	RejectDQTsWithZeros bool
+
+	// MaxJpegWidth is the maximum image width in pixels
+	MaxJpegWidth uint32
+
+	// MaxJpegHeight is the maximum image height in pixels
+	MaxJpegHeight uint32
+
+	// Use16BitDCEstimate selects the 16-bit DC estimate math of the C++ SIMD build.
+	// When decoding, the flags stored in the file take precedence if present.
+	Use16BitDCEstimate bool
+
+	// Use16BitAdvPredict selects the 16-bit edge prediction math of the C++ SIMD build.
+	// When decoding, the flags stored in the file take precedence if present.
+	Use16BitAdvPredict bool
+
+	// AcceptInvalidDHT accepts Huffman tables with more codes than fit in the code space
+	AcceptInvalidDHT bool
+
+	// AcceptShortOutput accepts Lepton files that decode to fewer bytes than
+	// the original file size they record, which some existing files do.
+	// Otherwise decoding fails with ExitCodeVerificationLengthMismatch.
+	AcceptShortOutput bool
+
+	// AllowFourComponents encodes four component (CMYK) images, coding the
+	// fourth component like chroma. Other Lepton implementations cannot read
+	// the result, so otherwise such images are rejected with
+	// ExitCodeUnsupported4Colors. Decoding accepts them either way.
+	AllowFourComponents bool
+
+	// AllowExplicitZeroRuns encodes baseline images with blocks whose trailing
+	// zeros are coded with ZRL symbols, recording those blocks in a ZRL header
+	// section. Other Lepton implementations cannot read the section, so
+	// otherwise such images are rejected with ExitCodeUnsupportedJpeg.
+	// Decoding accepts it either way.
+	AllowExplicitZeroRuns bool
+
+	// AllowSamplingBeyondTwo encodes images with sampling factors of 3 or 4.
+	// Other Lepton implementations cannot read the result, so otherwise such
+	// images are rejected with ExitCodeSamplingBeyondTwoUnsupported. Decoding
+	// accepts them either way.
+	AllowSamplingBeyondTwo bool
+
+	// MaxPartitions is the maximum number of partitions used for encoding.
+	// Zero is treated as one.
+	MaxPartitions uint32
+
+	// MaxDecodePartitions is the maximum number of partitions a Lepton file
+	// may have when decoding. Every partition is decoded with a model of its
+	// own. Zero means no limit.
+	MaxDecodePartitions uint32
+
+	// MaxProcessorThreads is the maximum number of goroutines used to encode or
+	// decode partitions concurrently. Zero means runtime.GOMAXPROCS(0).
+	MaxProcessorThreads uint32
+
+	// MaxJpegFileSize is the maximum size of the JPEG file in bytes
+	MaxJpegFileSize uint32
+
+	// MaxJpegPixels is the maximum number of pixels, width times height, of
+	// the image. Zero means no limit.
+	MaxJpegPixels uint32
+
+	// MaxCompressedHeaderSize is the maximum size of the zlib compressed
+	// header of a Lepton file. It is also limited to MaxJpegFileSize. Zero
+	// means no other limit.
+	MaxCompressedHeaderSize uint32
+
+	// MaxDecompressedHeaderSize is the maximum size the header of a Lepton
+	// file may decompress to, so that a small file cannot expand to
+	// gigabytes. Zero means no limit.
+	MaxDecompressedHeaderSize uint32
+
+	// MaxGarbageSize is the maximum size of the data before SOI and after
+	// the scan data that a Lepton file may hold. Zero means no limit.
+	MaxGarbageSize uint32
+
+	// MaxBlockMemory is the maximum number of bytes that may be allocated for
+	// the coefficients of the image when decoding, and for the data that
+	// DecodeStreaming holds back for later partitions. Zero means no limit.
+	MaxBlockMemory uint64
+
+	// StopReadingAtEOI stops reading the JPEG at its EOI marker instead of
+	// treating trailing data as garbage. Truncated files are rejected with
+	// ExitCodeShortRead since they have no EOI marker. The reader is left
+	// positioned right after the EOI marker, so JPEGs embedded in a larger
+	// stream can be compressed one after another with EncodeStream. Readers
+	// that cannot seek, such as pipes and network connections, should be
+	// passed as a bufio.Reader, as they are read one byte at a time.
+	StopReadingAtEOI bool
+
+	// MaxPrefixGarbage is the maximum number of bytes that may precede the SOI
+	// marker. They are stored in the PGR section and restored when decoding.
+	MaxPrefixGarbage uint32
+
+	// Metrics, if set, has the bits coded for each model component added to
+	// it by every encode or decode using these options, so statistics can be
+	// collected over many files. Nil disables collection.
+	Metrics *Metrics
+
+	// Progress, if set, is called as rows of blocks and partitions are coded
+	// by an encode or decode using these options. Calls never overlap, but
+	// they come from the goroutines coding the partitions, so the callback
+	// should return quickly. Nil disables reporting.
+	Progress func(Progress)
+}
+
+// CompatLeptonVectorWrite returns options that allow everything for encoding
+// that is compatible with C++ Lepton compiled with SIMD. Used by Encode.
+func CompatLeptonVectorWrite() *Options {
+	return &Options{
+		Progressive:         true,
+		RejectDQTsWithZeros: true,
+		MaxJpegWidth:        16386,
+		MaxJpegHeight:       16386,
+		Use16BitDCEstimate:  true,
+		Use16BitAdvPredict:  true,
+		AcceptInvalidDHT:    false,
+		MaxPartitions:       8,
+		MaxProcessorThreads: 8,
+		MaxJpegFileSize:     128 * 1024 * 1024,
+		StopReadingAtEOI:    false,
+	}
+}
+
+// CompatLeptonScalarRead returns options that allow everything for decoding
+// C++ Lepton images encoded with the scalar compile options
+func CompatLeptonScalarRead() *Options {
+	return &Options{
+		Progressive:         true,
+		RejectDQTsWithZeros: false,
+		MaxJpegWidth:        math.MaxUint32,
+		MaxJpegHeight:       math.MaxUint32,
+		Use16BitDCEstimate:  false,
+		Use16BitAdvPredict:  false,
+		AcceptInvalidDHT:    true,
+		MaxPartitions:       8,
+		MaxProcessorThreads: 8,
+		MaxJpegFileSize:     128 * 1024 * 1024,
+		StopReadingAtEOI:    false,
+	}
+}
+
+// CompatLeptonVectorRead returns options that allow everything for decoding
+// C++ Lepton images encoded with the vector (SSE2/AVX2) compile options.
+// Used by DecodeLepton.
+func CompatLeptonVectorRead() *Options {
+	return &Options{
+		Progressive:         true,
+		RejectDQTsWithZeros: false,
+		MaxJpegWidth:        math.MaxUint32,
+		MaxJpegHeight:       math.MaxUint32,
+		Use16BitDCEstimate:  true,
+		Use16BitAdvPredict:  true,
+		AcceptInvalidDHT:    true,
+		MaxPartitions:       8,
+		MaxProcessorThreads: 8,
+		MaxJpegFileSize:     128 * 1024 * 1024,
+		StopReadingAtEOI:    false,
+	}
+}
+
+// processorThreads returns the number of goroutines to use for n partitions
+func (o *Options) processorThreads(n int) int {
+	threads := int(o.MaxProcessorThreads)
+	if threads <= 0 {
+		threads = runtime.GOMAXPROCS(0)
+	}
+	if threads > n {
+		threads = n
+	}
+	if threads < 1 {
+		threads = 1
+	}
+	return threads
+}
+
+// checkDimensions rejects images that are larger than the options allow.
+// Images with more than MaxJpegPixels pixels fail with pixelsCode, which is
+// ExitCodeOutOfMemory when decoding, where the pixels are to be allocated.
+func (o *Options) checkDimensions(width, height uint32, pixelsCode ExitCode) error {
+	if height > o.MaxJpegHeight || width > o.MaxJpegWidth {
+		return ErrExitCode(ExitCodeUnsupportedJpeg,
+			fmt.Sprintf("image dimensions larger than %dx%d", o.MaxJpegWidth, o.MaxJpegHeight))
+	}
+	if o.MaxJpegPixels != 0 && uint64(width)*uint64(height) > uint64(o.MaxJpegPixels) {
+		return ErrExitCode(pixelsCode,
+			fmt.Sprintf("image with %dx%d pixels larger than %d pixels", width, height, o.MaxJpegPixels))
+	}
+	return nil
+}
+
+// blockMemory returns the number of bytes taken by the coefficients of the
+// given number of blocks
+func blockMemory(blocks uint64) uint64 {
+	return blocks * uint64(unsafe.Sizeof(AlignedBlock{}))
+}
+
+// checkBlockMemory rejects decoding when the given number of coefficient
+// blocks and heldBack bytes of buffered output need more memory than the
+// options allow
+func (o *Options) checkBlockMemory(blocks, heldBack uint64) error {
+	size := blockMemory(blocks) + heldBack
+	if o.MaxBlockMemory != 0 && size > o.MaxBlockMemory {
+		return ErrExitCode(ExitCodeOutOfMemory,
+			fmt.Sprintf("decoding needs %d bytes of block memory, more than %d", size, o.MaxBlockMemory))
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package lepton
+
+import (
+	"context"
+	"sync"
+)
+
+// Progress tells how far an encode or decode has come. It is passed to
+// Options.Progress every time a row of blocks has been coded and every time
+// a partition is finished.
+type Progress struct {
+	// Rows is the number of rows of blocks coded so far, over all components
+	Rows int
+
+	// TotalRows is the number of rows of blocks in the image. Rows stops
+	// short of it for truncated images, whose missing rows are not coded.
+	TotalRows int
+
+	// Partitions is the number of partitions finished so far
+	Partitions int
+
+	// TotalPartitions is the number of partitions of the image
+	TotalPartitions int
+}
+
+// progressTracker checks for cancellation of the context of an encode or
+// decode and reports its progress. Partitions are coded concurrently, so the
+// callback is called under a lock and never by two goroutines at once. A nil
+// tracker does neither, for coders that are used on their own.
+type progressTracker struct {
+	ctx    context.Context
+	report func(Progress)
+
+	mu       sync.Mutex
+	progress Progress
+}
+
+// newProgressTracker returns a tracker for coding the image of header in the
+// given number of partitions. report may be nil.
+func newProgressTracker(ctx context.Context, report func(Progress), header *JpegHeader, partitions int) *progressTracker {
+	t := &progressTracker{
+		ctx:    ctx,
+		report: report,
+	}
+	t.progress.TotalPartitions = partitions
+	for i := 0; i < header.Cmpc; i++ {
+		t.progress.TotalRows += int(header.CmpInfo[i].Bcv)
+	}
+	return t
+}
+
+// check returns the error of the context once it is cancelled
+func (t *progressTracker) check() error {
+	if t == nil {
+		return nil
+	}
+	return t.ctx.Err()
+}
+
+// rowDone reports a coded row of blocks and checks for cancellation
+func (t *progressTracker) rowDone() error {
+	if t == nil {
+		return nil
+	}
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+	t.update(func(p *Progress) { p.Rows++ })
+	return nil
+}
+
+// partitionDone reports a finished partition
+func (t *progressTracker) partitionDone() {
+	if t == nil {
+		return
+	}
+	t.update(func(p *Progress) { p.Partitions++ })
+}
+
+// update changes the progress and reports it
+func (t *progressTracker) update(change func(*Progress)) {
+	if t.report == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	change(&t.progress)
+	t.report(t.progress)
+}
@@ -16,6 +16,7 @@ type VPXBoolReader struct {
 	value          uint64
 	rang           uint64 // 128 << bitsInValueMinusLastByte <= range <= 255 << bitsInValueMinusLastByte
 	upstreamReader io.Reader
+	metrics        *Metrics // statistics per model component, or nil
 }
 
 // NewVPXBoolReader creates a new VPXBoolReader
@@ -28,7 +29,7 @@ func NewVPXBoolReader(reader io.Reader) (*VPXBoolReader, error) {
 
 	// Read the marker false bit
 	var dummyBranch Branch = NewBranch()
-	bit, err := r.GetBit(&dummyBranch)
+	bit, err := r.GetBit(&dummyBranch, ModelComponentDummy)
 	if err != nil {
 		return nil, err
 	}
@@ -40,7 +41,7 @@ func NewVPXBoolReader(reader io.Reader) (*VPXBoolReader, error) {
 }
 
 // get performs a single bit read with the given branch
-func (r *VPXBoolReader) get(branch *Branch, tmpValue *uint64, tmpRange *uint64) bool {
+func (r *VPXBoolReader) get(branch *Branch, tmpValue *uint64, tmpRange *uint64, cmp ModelComponent) bool {
 	probability := uint64(branch.GetProbability())
 
 	split := mulProb(*tmpRange, probability)
@@ -57,6 +58,9 @@ func (r *VPXBoolReader) get(branch *Branch, tmpValue *uint64, tmpRange *uint64)
 	}
 
 	shift := leadingZeros64(*tmpRange)
+	if r.metrics != nil {
+		r.metrics.record(cmp, shift)
+	}
 	*tmpValue <<= shift
 	*tmpRange <<= shift
 
@@ -64,7 +68,7 @@ func (r *VPXBoolReader) get(branch *Branch, tmpValue *uint64, tmpRange *uint64)
 }
 
 // GetBit reads a single bit using the given branch for probability
-func (r *VPXBoolReader) GetBit(branch *Branch) (bool, error) {
+func (r *VPXBoolReader) GetBit(branch *Branch, cmp ModelComponent) (bool, error) {
 	tmpValue := r.value
 	tmpRange := r.rang
 
@@ -77,7 +81,7 @@ func (r *VPXBoolReader) GetBit(branch *Branch) (bool, error) {
 		}
 	}
 
-	bit := r.get(branch, &tmpValue, &tmpRange)
+	bit := r.get(branch, &tmpValue, &tmpRange, cmp)
 
 	r.value = tmpValue
 	r.rang = tmpRange
@@ -87,7 +91,7 @@ func (r *VPXBoolReader) GetBit(branch *Branch) (bool, error) {
 
 // GetGrid reads a value encoded using a grid (binary tree) of branches
 // A is the size of the grid (must be power of 2)
-func (r *VPXBoolReader) GetGrid(branches []Branch) (int, error) {
+func (r *VPXBoolReader) GetGrid(branches []Branch, cmp ModelComponent) (int, error) {
 	if len(branches) == 0 || (len(branches)&(len(branches)-1)) != 0 {
 		panic("branches length must be power of 2")
 	}
@@ -106,7 +110,7 @@ func (r *VPXBoolReader) GetGrid(branches []Branch) (int, error) {
 	numBits := bitLength(A) - 1
 
 	for i := 0; i < numBits; i++ {
-		curBit := r.get(&branches[decodedSoFar], &tmpValue, &tmpRange)
+		curBit := r.get(&branches[decodedSoFar], &tmpValue, &tmpRange, cmp)
 		decodedSoFar <<= 1
 		if curBit {
 			decodedSoFar |= 1
@@ -123,7 +127,7 @@ func (r *VPXBoolReader) GetGrid(branches []Branch) (int, error) {
 }
 
 // GetUnaryEncoded reads a unary encoded value (count of 1s before first 0)
-func (r *VPXBoolReader) GetUnaryEncoded(branches []Branch) (int, error) {
+func (r *VPXBoolReader) GetUnaryEncoded(branches []Branch, cmp ModelComponent) (int, error) {
 	A := len(branches)
 	tmpValue := r.value
 	tmpRange := r.rang
@@ -147,6 +151,9 @@ func (r *VPXBoolReader) GetUnaryEncoded(branches []Branch) (int, error) {
 			tmpValue -= split
 
 			shift := leadingZeros64(tmpRange)
+			if r.metrics != nil {
+				r.metrics.record(cmp, shift)
+			}
 			tmpValue <<= shift
 			tmpRange <<= shift
 		} else {
@@ -155,6 +162,9 @@ func (r *VPXBoolReader) GetUnaryEncoded(branches []Branch) (int, error) {
 			tmpRange = split
 
 			shift := leadingZeros64(tmpRange)
+			if r.metrics != nil {
+				r.metrics.record(cmp, shift)
+			}
 			tmpValue <<= shift
 			tmpRange <<= shift
 
@@ -172,7 +182,7 @@ func (r *VPXBoolReader) GetUnaryEncoded(branches []Branch) (int, error) {
 }
 
 // GetNBits reads n bits using the given branches
-func (r *VPXBoolReader) GetNBits(n int, branches []Branch) (int, error) {
+func (r *VPXBoolReader) GetNBits(n int, branches []Branch, cmp ModelComponent) (int, error) {
 	if n > len(branches) {
 		panic("n exceeds branches length")
 	}
@@ -190,7 +200,7 @@ func (r *VPXBoolReader) GetNBits(n int, branches []Branch) (int, error) {
 			}
 		}
 
-		bit := r.get(&branches[i], &tmpValue, &tmpRange)
+		bit := r.get(&branches[i], &tmpValue, &tmpRange, cmp)
 		if bit {
 			coef |= 1 << i
 		}
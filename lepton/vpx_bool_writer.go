@@ -10,6 +10,7 @@ type VPXBoolWriter struct {
 	rang     uint32
 	buffer   []byte
 	writer   io.Writer
+	metrics  *Metrics // statistics per model component, or nil
 }
 
 // NewVPXBoolWriter creates a new VPXBoolWriter
@@ -23,7 +24,7 @@ func NewVPXBoolWriter(writer io.Writer) (*VPXBoolWriter, error) {
 
 	// Write initial false bit to prevent carry overflow
 	var dummyBranch Branch = NewBranch()
-	if err := w.PutBit(false, &dummyBranch); err != nil {
+	if err := w.PutBit(false, &dummyBranch, ModelComponentDummy); err != nil {
 		return nil, err
 	}
 
@@ -31,7 +32,7 @@ func NewVPXBoolWriter(writer io.Writer) (*VPXBoolWriter, error) {
 }
 
 // put performs the core arithmetic encoding operation
-func (w *VPXBoolWriter) put(bit bool, branch *Branch, tmpValue uint64, tmpRange uint32) (uint64, uint32) {
+func (w *VPXBoolWriter) put(bit bool, branch *Branch, tmpValue uint64, tmpRange uint32, cmp ModelComponent) (uint64, uint32) {
 	probability := uint32(branch.GetProbability())
 
 	split := 1 + (((tmpRange - 1) * probability) >> 8)
@@ -46,6 +47,9 @@ func (w *VPXBoolWriter) put(bit bool, branch *Branch, tmpValue uint64, tmpRange
 	}
 
 	shift := leadingZeros8(uint8(tmpRange))
+	if w.metrics != nil {
+		w.metrics.record(cmp, shift)
+	}
 
 	tmpRange <<= shift
 	tmpValue <<= shift
@@ -98,11 +102,11 @@ func (w *VPXBoolWriter) carry() {
 }
 
 // PutBit writes a single bit using the given branch for probability
-func (w *VPXBoolWriter) PutBit(value bool, branch *Branch) error {
+func (w *VPXBoolWriter) PutBit(value bool, branch *Branch, cmp ModelComponent) error {
 	tmpValue := w.lowValue
 	tmpRange := w.rang
 
-	tmpValue, tmpRange = w.put(value, branch, tmpValue, tmpRange)
+	tmpValue, tmpRange = w.put(value, branch, tmpValue, tmpRange, cmp)
 
 	w.lowValue = tmpValue
 	w.rang = tmpRange
@@ -111,7 +115,7 @@ func (w *VPXBoolWriter) PutBit(value bool, branch *Branch) error {
 }
 
 // PutGrid writes a value using a grid (binary tree) of branches
-func (w *VPXBoolWriter) PutGrid(v uint8, branches []Branch) error {
+func (w *VPXBoolWriter) PutGrid(v uint8, branches []Branch, cmp ModelComponent) error {
 	A := len(branches)
 	// Check if A is power of 2
 	if A&(A-1) != 0 {
@@ -126,7 +130,7 @@ func (w *VPXBoolWriter) PutGrid(v uint8, branches []Branch) error {
 
 	for i := numBits - 1; i >= 0; i-- {
 		curBit := (v & (1 << i)) != 0
-		tmpValue, tmpRange = w.put(curBit, &branches[serializedSoFar], tmpValue, tmpRange)
+		tmpValue, tmpRange = w.put(curBit, &branches[serializedSoFar], tmpValue, tmpRange, cmp)
 
 		serializedSoFar <<= 1
 		if curBit {
@@ -141,13 +145,13 @@ func (w *VPXBoolWriter) PutGrid(v uint8, branches []Branch) error {
 }
 
 // PutNBits writes n bits using the given branches
-func (w *VPXBoolWriter) PutNBits(bits int, numBits int, branches []Branch) error {
+func (w *VPXBoolWriter) PutNBits(bits int, numBits int, branches []Branch, cmp ModelComponent) error {
 	tmpValue := w.lowValue
 	tmpRange := w.rang
 
 	for i := numBits - 1; i >= 0; i-- {
 		bit := (bits & (1 << i)) != 0
-		tmpValue, tmpRange = w.put(bit, &branches[i], tmpValue, tmpRange)
+		tmpValue, tmpRange = w.put(bit, &branches[i], tmpValue, tmpRange, cmp)
 	}
 
 	w.lowValue = tmpValue
@@ -157,7 +161,7 @@ func (w *VPXBoolWriter) PutNBits(bits int, numBits int, branches []Branch) error
 }
 
 // PutUnaryEncoded writes a unary encoded value
-func (w *VPXBoolWriter) PutUnaryEncoded(v int, branches []Branch) error {
+func (w *VPXBoolWriter) PutUnaryEncoded(v int, branches []Branch, cmp ModelComponent) error {
 	A := len(branches)
 	if v > A {
 		panic("value exceeds branches length")
@@ -168,7 +172,7 @@ func (w *VPXBoolWriter) PutUnaryEncoded(v int, branches []Branch) error {
 
 	for i := 0; i < A; i++ {
 		curBit := v != i
-		tmpValue, tmpRange = w.put(curBit, &branches[i], tmpValue, tmpRange)
+		tmpValue, tmpRange = w.put(curBit, &branches[i], tmpValue, tmpRange, cmp)
 		if !curBit {
 			break
 		}